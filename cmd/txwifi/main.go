@@ -0,0 +1,230 @@
+// Command txwifi is a command line tool for txwifi configurations.
+//
+//	txwifi validate [-json] [-pubkey KEYS] CONFIG...
+//	txwifi keygen PRIVATE_KEY_FILE
+//	txwifi sign -key PRIVATE_KEY_FILE CONFIG...
+//	txwifi passphrase -secret SECRET MAC...
+//
+// validate loads every configuration, from a file or an http(s) URL, and
+// reports all problems found. With -pubkey the detached signature of
+// every configuration is checked too. It exits with status 1 when any
+// configuration is invalid, so it can gate shipping configurations in CI.
+//
+// keygen writes a new Ed25519 private key and prints the public key to
+// bake into devices as iotwifi.CfgPublicKeys. sign writes CONFIG.sig for
+// every configuration file.
+//
+// passphrase prints the passphrase {{passphrase "SECRET"}} derives for
+// devices with the given MAC addresses, e.g. for their labels.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/txn2/txwifi/iotwifi"
+)
+
+// result is the outcome of validating one configuration.
+type result struct {
+	Config string                    `json:"config"`
+	Valid  bool                      `json:"valid"`
+	Error  string                    `json:"error,omitempty"`
+	Errors []iotwifi.ValidationError `json:"errors,omitempty"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "validate":
+		os.Exit(validate(os.Args[2:], os.Stdout, os.Stderr))
+	case "keygen":
+		os.Exit(keygen(os.Args[2:], os.Stdout, os.Stderr))
+	case "sign":
+		os.Exit(sign(os.Args[2:], os.Stdout, os.Stderr))
+	case "passphrase":
+		os.Exit(passphrase(os.Args[2:], os.Stdout, os.Stderr))
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "txwifi: unknown command %q\n", os.Args[1])
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: txwifi validate [-json] [-pubkey KEYS] CONFIG...")
+	fmt.Fprintln(w, "       txwifi keygen PRIVATE_KEY_FILE")
+	fmt.Fprintln(w, "       txwifi sign -key PRIVATE_KEY_FILE CONFIG...")
+	fmt.Fprintln(w, "       txwifi passphrase -secret SECRET MAC...")
+}
+
+// validate validates every configuration given in args and returns the
+// exit status.
+func validate(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	asJson := fs.Bool("json", false, "print results as JSON")
+	pubkey := fs.String("pubkey", "", "comma separated base64 Ed25519 public keys to verify signatures with")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		usage(stderr)
+		return 2
+	}
+
+	var verifier *iotwifi.CfgVerifier
+	if *pubkey != "" {
+		var err error
+		if verifier, err = iotwifi.NewCfgVerifier(*pubkey); err != nil {
+			fmt.Fprintf(stderr, "txwifi: -pubkey: %s\n", err)
+			return 2
+		}
+	}
+
+	status := 0
+	results := make([]result, 0, fs.NArg())
+	for _, cfg := range fs.Args() {
+		r := result{Config: cfg, Valid: true}
+
+		_, err := iotwifi.LoadSignedCfg(cfg, verifier)
+		if err != nil {
+			r.Valid = false
+			status = 1
+			if errs, ok := err.(iotwifi.ValidationErrors); ok {
+				r.Errors = errs
+			} else {
+				r.Error = err.Error()
+			}
+		}
+		results = append(results, r)
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+		return status
+	}
+
+	for _, r := range results {
+		switch {
+		case r.Valid:
+			fmt.Fprintf(stdout, "%s: ok\n", r.Config)
+		case r.Error != "":
+			fmt.Fprintf(stdout, "%s: %s\n", r.Config, r.Error)
+		default:
+			fmt.Fprintf(stdout, "%s: %d problem(s)\n", r.Config, len(r.Errors))
+			for _, e := range r.Errors {
+				fmt.Fprintf(stdout, "  %s\n", e)
+			}
+		}
+	}
+
+	return status
+}
+
+// keygen writes a new private key seed to the file given in args and
+// prints the public key.
+func keygen(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) != 1 {
+		usage(stderr)
+		return 2
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintf(stderr, "txwifi: %s\n", err)
+		return 1
+	}
+
+	seed := base64.StdEncoding.EncodeToString(priv.Seed()) + "\n"
+	if err := ioutil.WriteFile(args[0], []byte(seed), 0600); err != nil {
+		fmt.Fprintf(stderr, "txwifi: %s\n", err)
+		return 1
+	}
+
+	fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(pub))
+	return 0
+}
+
+// sign writes a detached signature next to every configuration file
+// given in args.
+func sign(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	keyFile := fs.String("key", "", "file with the base64 Ed25519 private key written by keygen")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *keyFile == "" || fs.NArg() == 0 {
+		usage(stderr)
+		return 2
+	}
+
+	seed, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "txwifi: %s\n", err)
+		return 1
+	}
+
+	for _, cfg := range fs.Args() {
+		doc, err := ioutil.ReadFile(cfg)
+		if err != nil {
+			fmt.Fprintf(stderr, "txwifi: %s\n", err)
+			return 1
+		}
+		sig, err := iotwifi.SignCfg(doc, string(seed))
+		if err != nil {
+			fmt.Fprintf(stderr, "txwifi: %s: %s\n", *keyFile, err)
+			return 1
+		}
+		sigFile := iotwifi.CfgSigLocation(cfg)
+		if err := ioutil.WriteFile(sigFile, sig, 0644); err != nil {
+			fmt.Fprintf(stderr, "txwifi: %s\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "%s: signed, %s\n", cfg, sigFile)
+	}
+
+	return 0
+}
+
+// passphrase prints the derived passphrase of every MAC address given in
+// args.
+func passphrase(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("passphrase", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	secret := fs.String("secret", "", "the secret of the {{passphrase}} template")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *secret == "" || fs.NArg() == 0 {
+		usage(stderr)
+		return 2
+	}
+
+	for _, mac := range fs.Args() {
+		p, err := iotwifi.DerivePassphrase(*secret, mac)
+		if err != nil {
+			fmt.Fprintf(stderr, "txwifi: %s\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "%s %s\n", mac, p)
+	}
+
+	return 0
+}
@@ -2,12 +2,16 @@
 
 // todo: update documentation!!!!
 // todo: update Dockerfile
-// todo: listen for shutdown signal, remove uap0, kill wpa,apd,dnsmasq
 
 package main
 
 import (
+	"context"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/static"
@@ -23,17 +27,22 @@ func init() {
 
 func NewSetupCfg() *iotwifi.SetupCfg {
 	cfg := iotwifi.SetupCfg{
-		iotwifi.DnsmasqCfg{
-			"/#/10.10.10.1", "10.10.10.10,10.10.10.20,1h", "set:device,IoT",
+		DnsmasqCfg: iotwifi.DnsmasqCfg{
+			Address:     "/#/10.10.10.1",
+			DhcpRange:   "10.10.10.10,10.10.10.20,1h",
+			VendorClass: "set:device,IoT",
 		},
-		iotwifi.HostApdCfg{
-			"Test AP", "", "6", "10.10.10.1",
+		HostApdCfg: iotwifi.HostApdCfg{
+			Ssid:          "Test AP",
+			WpaPassphrase: "",
+			Channel:       "6",
+			Ip:            "10.10.10.1",
 		},
-		iotwifi.WpaSupplicantCfg{
-			"/etc/wpa_supplicant/wpa_supplicant.conf",
+		WpaSupplicantCfg: iotwifi.WpaSupplicantCfg{
+			CfgFile: "/etc/wpa_supplicant/wpa_supplicant.conf",
 		},
-		true,
-		true,
+		DontFallBackToApMode: true,
+		AllowStartStop:       true,
 	}
 	return &cfg
 }
@@ -43,14 +52,38 @@ func main() {
 	port := "8080"
 
 	setupCfg := NewSetupCfg()
+	if err := setupCfg.Validate(); err != nil {
+		log.Fatalf("Invalid config: %s", err)
+	}
 	h := iotwifi.NewHttpHandler(setupCfg, true)
 
 	r := gin.Default()
 
 	// set app routes
 	r.GET("/status", gin.WrapF(h.StatusHandler))
+	r.GET("/state", gin.WrapF(h.StateHandler))
+	r.GET("/events", gin.WrapF(h.EventsHandler))
 	r.POST("/connect", gin.WrapF(h.ConnectHandler))
+	r.GET("/connect/:id", gin.WrapF(h.ConnectStatusHandler))
 	r.GET("/scan", gin.WrapF(h.ScanHandler))
+	r.GET("/networks", gin.WrapF(h.NetworksHandler))
+	r.POST("/networks", gin.WrapF(h.AddNetworkHandler))
+	r.PUT("/networks/:id", gin.WrapF(h.UpdateNetworkHandler))
+	r.DELETE("/networks/:id", gin.WrapF(h.ForgetNetworkHandler))
+	r.GET("/ap/config", gin.WrapF(h.ApConfigHandler))
+	r.PUT("/ap/config", gin.WrapF(h.UpdateApConfigHandler))
+	r.GET("/ap/stations", gin.WrapF(h.StationsHandler))
+	r.GET("/ap/stations/:mac", gin.WrapF(h.StationHandler))
+	r.DELETE("/ap/stations/:mac", gin.WrapF(h.KickStationHandler))
+	r.GET("/ap/leases", gin.WrapF(h.LeasesHandler))
+	r.GET("/ap/acl", gin.WrapF(h.AclHandler))
+	r.PUT("/ap/acl/deny/:mac", gin.WrapF(h.AddDenyMacHandler))
+	r.DELETE("/ap/acl/deny/:mac", gin.WrapF(h.RemoveDenyMacHandler))
+	r.PUT("/ap/acl/accept/:mac", gin.WrapF(h.AddAcceptMacHandler))
+	r.DELETE("/ap/acl/accept/:mac", gin.WrapF(h.RemoveAcceptMacHandler))
+	r.GET("/certs", gin.WrapF(h.CertsHandler))
+	r.PUT("/certs/:name", gin.WrapF(h.UploadCertHandler))
+	r.DELETE("/certs/:name", gin.WrapF(h.DeleteCertHandler))
 
 	// ---
 	if setupCfg.DontFallBackToApMode {
@@ -70,7 +103,29 @@ func main() {
 	}))
 
 	// serve http
-	log.Info("HTTP Listening on " + port)
-	// http.ListenAndServe(":"+port, handlers.CORS(originsOk, headersOk, methodsOk)(r))
-	r.Run(":" + port)
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: r,
+	}
+	go func() {
+		log.Info("HTTP Listening on " + port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// shut down on SIGINT or SIGTERM, e.g. docker stop, removing the AP
+	// interface and stopping wpa_supplicant, hostapd and dnsmasq
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	log.Info("Shutting down IoT Wifi...")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	if err := h.Shutdown(ctx); err != nil {
+		log.Errorf("Shutdown: %s", err)
+	}
+	srv.Shutdown(ctx)
 }
@@ -2,13 +2,16 @@
 
 // todo: update documentation!!!!
 // todo: update Dockerfile
-// todo: listen for shutdown signal, remove uap0, kill wpa,apd,dnsmasq
 
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -28,22 +31,65 @@ func main() {
 	port := setEnvIfEmpty("IOTWIFI_PORT", "8080")
 	static := setEnvIfEmpty("IOTWIFI_STATIC", "/static/")
 
-	setupCfg, err := iotwifi.LoadCfg(cfgUrl)
+	var setupCfg *iotwifi.SetupCfg
+	var remote *iotwifi.RemoteCfg
+	var err error
+	if iotwifi.IsCfgUrl(cfgUrl) {
+		remote = iotwifi.NewRemoteCfg(cfgUrl, setEnvIfEmpty("IOTWIFI_CFG_CACHE", iotwifi.DefaultCfgCacheFile))
+		refresh := setEnvIfEmpty("IOTWIFI_CFG_REFRESH", iotwifi.DefaultCfgRefresh.String())
+		if remote.Interval, err = time.ParseDuration(refresh); err != nil {
+			log.Fatalf("Invalid IOTWIFI_CFG_REFRESH %q: %s", refresh, err)
+		}
+		setupCfg, err = remote.Load()
+	} else {
+		setupCfg, err = iotwifi.LoadCfg(cfgUrl)
+	}
 	if err != nil {
-		log.Error("Could not load config: %s", err.Error())
-		panic(err)
+		log.Fatalf("Could not load config: %s", err)
 	}
 
 	h := iotwifi.NewHttpHandler(setupCfg, true)
 
+	// reload changed configurations, and on SIGHUP
+	var reload func()
+	if remote != nil {
+		h.WatchRemoteCfg(remote)
+		reload = remote.Reload
+	} else {
+		watcher := iotwifi.NewCfgWatcher(cfgUrl)
+		h.WatchCfgFile(watcher)
+		reload = watcher.Reload
+	}
+
 	// setup router and middleware
 	r := mux.NewRouter()
 	//r.Use(h.LogHandler)
 
 	// set app routes
 	r.HandleFunc("/status", h.StatusHandler)
+	r.HandleFunc("/state", h.StateHandler)
+	r.HandleFunc("/events", h.EventsHandler)
 	r.HandleFunc("/connect", h.ConnectHandler).Methods("POST")
+	r.HandleFunc("/connect/{id}", h.ConnectStatusHandler).Methods("GET")
 	r.HandleFunc("/scan", h.ScanHandler)
+	r.HandleFunc("/networks", h.NetworksHandler).Methods("GET")
+	r.HandleFunc("/networks", h.AddNetworkHandler).Methods("POST")
+	r.HandleFunc("/networks/{id}", h.UpdateNetworkHandler).Methods("PUT")
+	r.HandleFunc("/networks/{id}", h.ForgetNetworkHandler).Methods("DELETE")
+	r.HandleFunc("/ap/config", h.ApConfigHandler).Methods("GET")
+	r.HandleFunc("/ap/config", h.UpdateApConfigHandler).Methods("PUT")
+	r.HandleFunc("/ap/stations", h.StationsHandler).Methods("GET")
+	r.HandleFunc("/ap/stations/{mac}", h.StationHandler).Methods("GET")
+	r.HandleFunc("/ap/stations/{mac}", h.KickStationHandler).Methods("DELETE")
+	r.HandleFunc("/ap/leases", h.LeasesHandler).Methods("GET")
+	r.HandleFunc("/ap/acl", h.AclHandler).Methods("GET")
+	r.HandleFunc("/ap/acl/deny/{mac}", h.AddDenyMacHandler).Methods("PUT")
+	r.HandleFunc("/ap/acl/deny/{mac}", h.RemoveDenyMacHandler).Methods("DELETE")
+	r.HandleFunc("/ap/acl/accept/{mac}", h.AddAcceptMacHandler).Methods("PUT")
+	r.HandleFunc("/ap/acl/accept/{mac}", h.RemoveAcceptMacHandler).Methods("DELETE")
+	r.HandleFunc("/certs", h.CertsHandler).Methods("GET")
+	r.HandleFunc("/certs/{name}", h.UploadCertHandler).Methods("PUT")
+	r.HandleFunc("/certs/{name}", h.DeleteCertHandler).Methods("DELETE")
 
 	// ---
 	if setupCfg.DontFallBackToApMode {
@@ -64,9 +110,37 @@ func main() {
 	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS", "DELETE"})
 
 	// serve http
-	log.Info("HTTP Listening on " + port)
-	http.ListenAndServe(":"+port, handlers.CORS(originsOk, headersOk, methodsOk)(r))
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: handlers.CORS(originsOk, headersOk, methodsOk)(r),
+	}
+	go func() {
+		log.Info("HTTP Listening on " + port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// shut down on SIGINT or SIGTERM, e.g. docker stop, removing the AP
+	// interface and stopping wpa_supplicant, hostapd and dnsmasq
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			break
+		}
+		log.Info("SIGHUP, reloading configuration")
+		reload()
+	}
+
+	log.Info("Shutting down IoT Wifi...")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
 
+	if err := h.Shutdown(ctx); err != nil {
+		log.Errorf("Shutdown: %s", err)
+	}
+	srv.Shutdown(ctx)
 }
 
 // getEnv gets an environment variable or sets a default if
@@ -0,0 +1,160 @@
+package iotwifi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ErrCfgReadOnly is returned for changes to a configuration the device
+// can not write back.
+var ErrCfgReadOnly = errors.New("configuration is read-only")
+
+// maxApCfgSize bounds the body of an /ap/config update.
+const maxApCfgSize = 64 << 10
+
+// ApCfg is the access point configuration returned by /ap/config. The
+// passphrase itself is never returned.
+type ApCfg struct {
+	HostApdCfg
+
+	// WpaPassphrase shadows HostApdCfg.WpaPassphrase and is always
+	// empty, so it is left out.
+	WpaPassphrase    string `json:"wpa_passphrase,omitempty"`
+	WpaPassphraseSet bool   `json:"wpa_passphrase_set"`
+}
+
+// NewApCfg produces the ApCfg of a hostapd configuration.
+func NewApCfg(apd HostApdCfg) ApCfg {
+	return ApCfg{
+		HostApdCfg:       apd,
+		WpaPassphraseSet: apd.WpaPassphrase != "",
+	}
+}
+
+// UpdateApCfg applies a partial JSON update of HostApdCfg to cfg, e.g.
+// {"ssid":"site-42"}. Fields left out keep their value; an empty
+// wpa_passphrase makes the access point open. The files hostapd uses
+// can not be changed at runtime.
+func UpdateApCfg(cfg *SetupCfg, update []byte) error {
+	apd := cfg.HostApdCfg
+	if err := json.Unmarshal(update, &apd); err != nil {
+		return fmt.Errorf("decoding access point configuration: %w", err)
+	}
+
+	v := &validator{}
+	if apd.CfgFile != cfg.HostApdCfg.CfgFile {
+		v.add("host_apd_cfg.cfg_file", "can not be changed at runtime")
+	}
+	if apd.CtrlInterface != cfg.HostApdCfg.CtrlInterface {
+		v.add("host_apd_cfg.ctrl_interface", "can not be changed at runtime")
+	}
+	if apd.DenyMacFile != cfg.HostApdCfg.DenyMacFile {
+		v.add("host_apd_cfg.deny_mac_file", "can not be changed at runtime")
+	}
+	if apd.AcceptMacFile != cfg.HostApdCfg.AcceptMacFile {
+		v.add("host_apd_cfg.accept_mac_file", "can not be changed at runtime")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	next := *cfg
+	next.HostApdCfg = apd
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	cfg.HostApdCfg = apd
+	return nil
+}
+
+// saveHostApdCfg replaces the host_apd_cfg section of a watched
+// configuration file. The rest of the file, its formatting and its mode
+// are left as they are.
+func saveHostApdCfg(watcher *CfgWatcher, apd HostApdCfg) error {
+	info, err := os.Stat(watcher.Path)
+	if err != nil {
+		return fmt.Errorf("saving configuration: %w", err)
+	}
+	data, err := ioutil.ReadFile(watcher.Path)
+	if err != nil {
+		return fmt.Errorf("saving configuration: %w", err)
+	}
+
+	out, err := replaceCfgSection(data, "host_apd_cfg", apd)
+	if err != nil {
+		return fmt.Errorf("saving configuration: %s: %w", watcher.Path, err)
+	}
+
+	if err := watcher.Write(out, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("saving configuration: %w", err)
+	}
+	return nil
+}
+
+// replaceCfgSection returns the JSON document data with the value of the
+// top-level key replaced by v, indented like the document. A missing key
+// is added first.
+func replaceCfgSection(data []byte, key string, v interface{}) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("not a JSON object")
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keyEnd := int(dec.InputOffset())
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if tok != key {
+			continue
+		}
+
+		end := int(dec.InputOffset())
+		start := end - len(raw)
+		// the indentation of the line the key is on
+		lineStart := bytes.LastIndexByte(data[:keyEnd], '\n') + 1
+		indent := data[lineStart:keyEnd]
+		indent = indent[:len(indent)-len(bytes.TrimLeft(indent, " \t"))]
+
+		value, err := marshalIndented(v, string(indent))
+		if err != nil {
+			return nil, err
+		}
+		out := append([]byte{}, data[:start]...)
+		out = append(out, value...)
+		return append(out, data[end:]...), nil
+	}
+
+	// add the key after the opening brace
+	value, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	open, closing := bytes.IndexByte(data, '{')+1, bytes.LastIndexByte(data, '}')
+	entry := fmt.Sprintf("%q:%s", key, value)
+	if len(bytes.TrimSpace(data[open:closing])) > 0 {
+		entry += ","
+	}
+	out := append([]byte{}, data[:open]...)
+	out = append(out, entry...)
+	return append(out, data[open:]...), nil
+}
+
+// marshalIndented marshals v as a value nested one level below the top
+// of a document indented by indent, compact when indent is empty.
+func marshalIndented(v interface{}, indent string) ([]byte, error) {
+	if indent == "" {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, indent, indent)
+}
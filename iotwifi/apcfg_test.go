@@ -0,0 +1,167 @@
+package iotwifi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpdateApCfg(t *testing.T) {
+	cfg := validCfg()
+	if err := UpdateApCfg(cfg, []byte(`{"ssid":"site-42","channel":"11"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if apd := cfg.HostApdCfg; apd.Ssid != "site-42" || apd.Channel != "11" || apd.WpaPassphrase != "iotwifipass" || apd.Ip != "192.168.27.1" {
+		t.Errorf("unexpected config %+v", apd)
+	}
+
+	if err := UpdateApCfg(cfg, []byte(`{"wpa_passphrase":""}`)); err != nil || cfg.HostApdCfg.WpaPassphrase != "" {
+		t.Errorf("open access point: %v %+v", err, cfg.HostApdCfg)
+	}
+
+	tests := []struct {
+		update string
+		want   string
+	}{
+		{`{"wpa_passphrase":"short"}`, "host_apd_cfg.wpa_passphrase"},
+		{`{"ip":"10.0.0.1"}`, "dnsmasq_cfg.dhcp_range"},
+		{`{"cfg_file":"/tmp/hostapd.conf"}`, "host_apd_cfg.cfg_file"},
+		// a newline would add lines to hostapd.conf, here turning off WPA
+		{`{"ssid":"x\nwpa=0"}`, "host_apd_cfg.ssid"},
+	}
+	for _, tt := range tests {
+		before := cfg.HostApdCfg
+		err := UpdateApCfg(cfg, []byte(tt.update))
+		if got := fields(t, err); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.update, err, tt.want)
+		}
+		if cfg.HostApdCfg != before {
+			t.Errorf("%s: config changed by a rejected update", tt.update)
+		}
+	}
+
+	if err := UpdateApCfg(cfg, []byte(`{"channel":6}`)); err == nil {
+		t.Error("expected a decoding error")
+	}
+}
+
+func TestSaveHostApdCfg(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wificfg.json")
+	doc := `{
+  "dnsmasq_cfg": {"dhcp_range": "1,2"},
+  "host_apd_cfg": {
+    "ssid": "old"
+  },
+  "custom": [1, 2]
+}
+`
+	ioutil.WriteFile(path, []byte(doc), 0640)
+	w := NewCfgWatcher(path)
+
+	if err := saveHostApdCfg(w, HostApdCfg{Ssid: "new", Channel: "6"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	var saved map[string]interface{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if apd := saved["host_apd_cfg"].(map[string]interface{}); apd["ssid"] != "new" || apd["channel"] != "6" {
+		t.Errorf("host_apd_cfg %v", apd)
+	}
+
+	// only the section changes, nested at the indentation of the file
+	if !strings.HasPrefix(string(data), "{\n  \"dnsmasq_cfg\": {\"dhcp_range\": \"1,2\"},\n  \"host_apd_cfg\": {\n    \"ssid\": \"new\",\n") ||
+		!strings.HasSuffix(string(data), "\n  },\n  \"custom\": [1, 2]\n}\n") {
+		t.Errorf("saved\n%s", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("mode %o", info.Mode().Perm())
+	}
+
+	// the watcher takes the write as loaded
+	if _, changed := w.check(false); changed {
+		t.Error("write reported as a change")
+	}
+
+	// a missing section is added
+	ioutil.WriteFile(path, []byte(`{"custom":1}`), 0600)
+	if err := saveHostApdCfg(w, HostApdCfg{Ssid: "added"}); err != nil {
+		t.Fatal(err)
+	}
+	var added SetupCfg
+	data, _ = ioutil.ReadFile(path)
+	if err := json.Unmarshal(data, &added); err != nil || added.HostApdCfg.Ssid != "added" {
+		t.Errorf("added section: %s %v", data, err)
+	}
+}
+
+func TestApConfigHandler(t *testing.T) {
+	r := newFakeRadio(t)
+	cfgFile := filepath.Join(r.dir, "wificfg.json")
+	hostapdConf := r.cfg.HostApdCfg.CfgFile
+	data, _ := json.Marshal(r.cfg)
+	ioutil.WriteFile(cfgFile, data, 0600)
+
+	m := r.start()
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+	h := &HttpHandler{manager: m, cfgWatcher: NewCfgWatcher(cfgFile)}
+
+	ret := serveApi(t, h.UpdateApConfigHandler, "PUT", "/ap/config", `{"ssid":"site-42"}`)
+	if ret.Status != "OK" {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	payload := ret.Payload.(map[string]interface{})
+	if _, ok := payload["wpa_passphrase"]; ok || payload["wpa_passphrase_set"] != true || payload["ssid"] != "site-42" {
+		t.Errorf("unexpected payload %v", payload)
+	}
+
+	saved, err := LoadSignedCfg(cfgFile, nil)
+	if err != nil || saved.HostApdCfg.Ssid != "site-42" || saved.HostApdCfg.WpaPassphrase != "iotwifipass" {
+		t.Errorf("saved config %+v: %v", saved, err)
+	}
+
+	waitFor(t, "hostapd.conf", func() bool {
+		conf, _ := ioutil.ReadFile(hostapdConf)
+		return strings.Contains(string(conf), "ssid=site-42")
+	})
+
+	ret = serveApi(t, h.ApConfigHandler, "GET", "/ap/config", "")
+	if payload := ret.Payload.(map[string]interface{}); payload["ssid"] != "site-42" {
+		t.Errorf("unexpected payload %v", payload)
+	}
+
+	// validation errors are returned in the payload
+	ret = serveApi(t, h.UpdateApConfigHandler, "PUT", "/ap/config", `{"ssid":"","wpa_passphrase":"short"}`)
+	if errs, _ := ret.Payload.([]interface{}); ret.Status != "FAIL" || len(errs) != 2 {
+		t.Errorf("unexpected return %+v", ret)
+	}
+
+	// the body is bounded
+	ret = serveApi(t, h.UpdateApConfigHandler, "PUT", "/ap/config", `{"ssid":"`+strings.Repeat("x", maxApCfgSize)+`"}`)
+	if ret.Status != "FAIL" || !strings.Contains(ret.Message, "too large") {
+		t.Errorf("unexpected return %+v", ret)
+	}
+
+	h.cfgRemote = true
+	ret = serveApi(t, h.UpdateApConfigHandler, "PUT", "/ap/config", `{"ssid":"other"}`)
+	if ret.Status != "FAIL" || !strings.Contains(ret.Message, ErrCfgReadOnly.Error()) {
+		t.Errorf("unexpected return %+v", ret)
+	}
+}
+
+func TestNewApCfgHidesPassphrase(t *testing.T) {
+	data, _ := json.Marshal(NewApCfg(HostApdCfg{Ssid: "iot", WpaPassphrase: "secret-passphrase"}))
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("passphrase returned: %s", data)
+	}
+	var ret ApCfg
+	if err := json.Unmarshal(data, &ret); err != nil || !ret.WpaPassphraseSet {
+		t.Errorf("unexpected ApCfg %s", data)
+	}
+}
@@ -0,0 +1,197 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultApdCtrlDir is the hostapd ctrl_interface written by hostAPdConfig.
+const DefaultApdCtrlDir = "/var/run/hostapd"
+
+// ApdEventType identifies hostapd events of interest.
+type ApdEventType string
+
+const (
+	ApdStaConnected    ApdEventType = "AP-STA-CONNECTED"
+	ApdStaDisconnected ApdEventType = "AP-STA-DISCONNECTED"
+	ApdEnabled         ApdEventType = "AP-ENABLED"
+	ApdDisabled        ApdEventType = "AP-DISABLED"
+	ApdOther           ApdEventType = "OTHER"
+)
+
+// ApdEvent is a typed hostapd control event.
+type ApdEvent struct {
+	Type ApdEventType `json:"type"`
+	Mac  string       `json:"mac,omitempty"`
+	Raw  CtrlEvent    `json:"raw"`
+}
+
+// ApdStation is a station associated with the access point as reported
+// by the STA family of commands.
+type ApdStation struct {
+	Mac  string            `json:"mac"`
+	Info map[string]string `json:"info"`
+}
+
+// ApdCtrl is a client for the hostapd control interface of a single
+// network interface.
+type ApdCtrl struct {
+	*ctrlClient
+	Iface string
+}
+
+// NewApdCtrl produces an ApdCtrl for the socket of iface in ctrlDir.
+func NewApdCtrl(ctrlDir string, iface string) *ApdCtrl {
+	if ctrlDir == "" {
+		ctrlDir = DefaultApdCtrlDir
+	}
+	return &ApdCtrl{
+		ctrlClient: newCtrlClient(filepath.Join(ctrlDir, iface)),
+		Iface:      iface,
+	}
+}
+
+// Status returns the key/value pairs of the STATUS command.
+func (a *ApdCtrl) Status() (map[string]string, error) {
+	reply, err := a.Request("STATUS")
+	if err != nil {
+		return nil, err
+	}
+	return cfgMapper([]byte(reply)), nil
+}
+
+// State returns the interface state, e.g. ENABLED or DISABLED.
+func (a *ApdCtrl) State() (string, error) {
+	status, err := a.Status()
+	if err != nil {
+		return "", err
+	}
+	return status["state"], nil
+}
+
+// Sta returns a single station by MAC address.
+func (a *ApdCtrl) Sta(mac string) (ApdStation, error) {
+	reply, err := a.Request("STA " + mac)
+	if err != nil {
+		return ApdStation{}, err
+	}
+	sta, ok := parseApdStation(reply)
+	if !ok {
+		return ApdStation{}, ErrCtrlFail
+	}
+	return sta, nil
+}
+
+// AllSta returns every associated station. hostapd has no single command
+// for this; like hostapd_cli all_sta it walks STA-FIRST and STA-NEXT.
+// hostapd answers STA-NEXT with FAIL once the station handed over has
+// left, which ends the walk with the stations found so far.
+func (a *ApdCtrl) AllSta() ([]ApdStation, error) {
+	stations := make([]ApdStation, 0)
+
+	reply, err := a.Request("STA-FIRST")
+	for {
+		if err != nil {
+			return stations, err
+		}
+		sta, ok := parseApdStation(reply)
+		if !ok {
+			return stations, nil
+		}
+		stations = append(stations, sta)
+		reply, err = a.Request("STA-NEXT " + sta.Mac)
+		if errors.Is(err, ErrCtrlFail) {
+			return stations, nil
+		}
+	}
+}
+
+// HasStations reports whether any station is associated.
+func (a *ApdCtrl) HasStations() bool {
+	reply, err := a.Request("STA-FIRST")
+	if err != nil {
+		return false
+	}
+	_, ok := parseApdStation(reply)
+	return ok
+}
+
+// Deauthenticate disconnects a station.
+func (a *ApdCtrl) Deauthenticate(mac string) error {
+	return a.requestOK("DEAUTHENTICATE " + mac)
+}
+
+// AclAddMac adds a station to the running deny or accept list, see
+// MacAclDeny and MacAclAccept. Denying a station does not disconnect it.
+func (a *ApdCtrl) AclAddMac(list string, mac string) error {
+	return a.requestOK(aclCmd(list) + " ADD_MAC " + mac)
+}
+
+// AclDelMac removes a station from the running deny or accept list.
+func (a *ApdCtrl) AclDelMac(list string, mac string) error {
+	return a.requestOK(aclCmd(list) + " DEL_MAC " + mac)
+}
+
+// aclCmd returns the hostapd command of a MAC list.
+func aclCmd(list string) string {
+	if list == MacAclAccept {
+		return "ACCEPT_ACL"
+	}
+	return "DENY_ACL"
+}
+
+// ApdEvents attaches to hostapd and delivers typed events until ctx is done.
+func (a *ApdCtrl) ApdEvents(ctx context.Context) <-chan ApdEvent {
+	out := make(chan ApdEvent, 16)
+
+	go func() {
+		defer close(out)
+		for ev := range a.Events(ctx) {
+			select {
+			case out <- toApdEvent(ev):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+func toApdEvent(ev CtrlEvent) ApdEvent {
+	apdEvent := ApdEvent{Type: ApdOther, Raw: ev}
+
+	switch ApdEventType(ev.Name) {
+	case ApdStaConnected, ApdStaDisconnected:
+		apdEvent.Type = ApdEventType(ev.Name)
+		if fields := strings.Fields(ev.Message); len(fields) > 0 {
+			apdEvent.Mac = fields[0]
+		}
+	case ApdEnabled, ApdDisabled:
+		apdEvent.Type = ApdEventType(ev.Name)
+	}
+
+	return apdEvent
+}
+
+// parseApdStation parses a STA reply: the MAC address on the first line
+// followed by key=value lines. An empty reply means no (more) stations.
+func parseApdStation(reply string) (ApdStation, bool) {
+	reply = strings.TrimSpace(reply)
+	if reply == "" {
+		return ApdStation{}, false
+	}
+
+	lines := strings.SplitN(reply, "\n", 2)
+	sta := ApdStation{
+		Mac:  strings.TrimSpace(lines[0]),
+		Info: make(map[string]string),
+	}
+	if len(lines) > 1 {
+		sta.Info = cfgMapper([]byte(lines[1]))
+	}
+
+	return sta, true
+}
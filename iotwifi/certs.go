@@ -0,0 +1,166 @@
+package iotwifi
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultCertDir is where uploaded certificates and keys are kept unless
+// WpaSupplicantCfg.CertDir is set.
+const DefaultCertDir = "/var/lib/txwifi/certs"
+
+// maxCertSize bounds an uploaded certificate or key.
+const maxCertSize = 64 << 10
+
+var (
+	// ErrNoSuchCert is returned for a certificate that was not uploaded.
+	ErrNoSuchCert = errors.New("no such certificate")
+	// ErrInvalidCert is returned for uploads that are not a PEM file, a
+	// DER certificate or a .p12/.pfx bundle.
+	ErrInvalidCert = errors.New("invalid certificate")
+)
+
+var certName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// CertInfo describes an uploaded certificate or key. Subject and
+// NotAfter are set for certificates.
+type CertInfo struct {
+	Name     string     `json:"name"`
+	Type     string     `json:"type"` // certificate, private key or pkcs12
+	Size     int64      `json:"size"`
+	Subject  string     `json:"subject,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+}
+
+// CertStore keeps the certificates and keys referenced by enterprise
+// network credentials, readable by the owner only.
+type CertStore struct {
+	Dir string
+}
+
+// NewCertStore produces a CertStore for a directory, DefaultCertDir when
+// empty.
+func NewCertStore(dir string) *CertStore {
+	if dir == "" {
+		dir = DefaultCertDir
+	}
+	return &CertStore{Dir: dir}
+}
+
+// Save stores a certificate or key under a name such as ca.pem,
+// replacing any with the same name.
+func (s *CertStore) Save(name string, data []byte) (CertInfo, error) {
+	if !certName.MatchString(name) {
+		return CertInfo{}, fmt.Errorf("%w: %q is not a valid name", ErrInvalidCert, name)
+	}
+	if len(data) > maxCertSize {
+		return CertInfo{}, fmt.Errorf("%w: %d bytes, at most %d are allowed", ErrInvalidCert, len(data), maxCertSize)
+	}
+	info, err := certInfo(name, data)
+	if err != nil {
+		return CertInfo{}, err
+	}
+
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return CertInfo{}, err
+	}
+	if err := os.Chmod(s.Dir, 0700); err != nil {
+		return CertInfo{}, err
+	}
+	if err := writeFileAtomic(filepath.Join(s.Dir, name), data); err != nil {
+		return CertInfo{}, err
+	}
+	return info, nil
+}
+
+// List returns the stored certificates and keys sorted by name.
+func (s *CertStore) List() ([]CertInfo, error) {
+	certs := make([]CertInfo, 0)
+	for _, name := range listDir(s.Dir) {
+		if !certName.MatchString(name) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		info, err := certInfo(name, data)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, info)
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Name < certs[j].Name })
+	return certs, nil
+}
+
+// Path returns the file of a stored certificate or key.
+func (s *CertStore) Path(name string) (string, error) {
+	if !certName.MatchString(name) {
+		return "", fmt.Errorf("%w: %s", ErrNoSuchCert, name)
+	}
+	path := filepath.Join(s.Dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrNoSuchCert, name)
+	}
+	return path, nil
+}
+
+// Remove deletes a stored certificate or key.
+func (s *CertStore) Remove(name string) error {
+	path, err := s.Path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// certInfo checks and describes an upload.
+func certInfo(name string, data []byte) (CertInfo, error) {
+	info := CertInfo{Name: name, Size: int64(len(data))}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".p12" || ext == ".pfx" {
+		info.Type = "pkcs12"
+		return info, nil
+	}
+
+	var certs []*x509.Certificate
+	if block, _ := pem.Decode(data); block != nil {
+		for rest := data; ; {
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			switch {
+			case block.Type == "CERTIFICATE":
+				if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+					certs = append(certs, cert)
+				}
+			case strings.HasSuffix(block.Type, "PRIVATE KEY") && info.Type == "":
+				info.Type = "private key"
+			}
+		}
+	} else if cert, err := x509.ParseCertificate(data); err == nil {
+		certs = append(certs, cert)
+	}
+
+	if len(certs) > 0 {
+		info.Type = "certificate"
+		info.Subject = certs[0].Subject.String()
+		info.NotAfter = &certs[0].NotAfter
+	}
+	if info.Type == "" {
+		return CertInfo{}, fmt.Errorf("%w: %s is not a PEM or DER certificate, a PEM private key or a .p12 bundle", ErrInvalidCert, name)
+	}
+	return info, nil
+}
@@ -0,0 +1,122 @@
+package iotwifi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertPem returns a self-signed PEM certificate and its PEM key.
+func testCertPem(t *testing.T, cn string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestCertStore(t *testing.T) {
+	store := NewCertStore(filepath.Join(t.TempDir(), "certs"))
+	cert, key := testCertPem(t, "radius.example.com")
+
+	info, err := store.Save("ca.pem", cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != "certificate" || info.Subject != "CN=radius.example.com" || info.NotAfter == nil {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if _, err := store.Save("client.key", key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Save("client.p12", []byte{0x30, 0x82}); err != nil {
+		t.Fatal(err)
+	}
+
+	// readable by the owner only
+	if fi, err := os.Stat(store.Dir); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("dir mode %v: %v", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(filepath.Join(store.Dir, "client.key")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key mode %v: %v", fi.Mode(), err)
+	}
+
+	certs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 3 || certs[0].Name != "ca.pem" || certs[1].Type != "private key" || certs[2].Type != "pkcs12" {
+		t.Errorf("unexpected certs %+v", certs)
+	}
+
+	for name, data := range map[string][]byte{
+		"notes.txt":  []byte("not a certificate"),
+		"../ca.pem":  cert,
+		".hidden":    cert,
+		"broken.pem": []byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"),
+	} {
+		if _, err := store.Save(name, data); !errors.Is(err, ErrInvalidCert) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+
+	if err := store.Remove("ca.pem"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Path("ca.pem"); !errors.Is(err, ErrNoSuchCert) {
+		t.Errorf("err = %v", err)
+	}
+	if err := store.Remove("../wificfg.json"); !errors.Is(err, ErrNoSuchCert) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestCertHandlers(t *testing.T) {
+	h, _ := newNetworksHandler(t)
+	cert, _ := testCertPem(t, "radius.example.com")
+
+	ret := serveApi(t, h.UploadCertHandler, "PUT", "/certs/ca.pem", string(cert))
+	if ret.Status != "OK" {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	ret = serveApi(t, h.UploadCertHandler, "PUT", "/certs/ca.pem", "junk")
+	if ret.Status != "FAIL" {
+		t.Errorf("unexpected return %+v", ret)
+	}
+
+	ret = serveApi(t, h.CertsHandler, "GET", "/certs", "")
+	if certs, _ := ret.Payload.([]interface{}); len(certs) != 1 {
+		t.Errorf("unexpected return %+v", ret)
+	}
+
+	ret = serveApi(t, h.DeleteCertHandler, "DELETE", "/certs/ca.pem", "")
+	if ret.Status != "OK" {
+		t.Errorf("unexpected return %+v", ret)
+	}
+	ret = serveApi(t, h.DeleteCertHandler, "DELETE", "/certs/ca.pem", "")
+	if ret.Status != "FAIL" {
+		t.Errorf("unexpected return %+v", ret)
+	}
+}
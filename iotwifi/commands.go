@@ -1,47 +1,49 @@
 package iotwifi
 
 import (
-	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Command for device network commands.
 type Command struct {
-	Runner   CmdRunner
-	SetupCfg *SetupCfg
+	Runner     *CmdRunner
+	Supervisor *Supervisor
+	SetupCfg   *SetupCfg
+}
+
+// run runs a one-shot command to completion through the Executor.
+func (c *Command) run(name string, arg ...string) {
+	if _, err := c.Runner.Executor.Output(name, arg...); err != nil {
+		log.Debugf("%s %s: %s", name, strings.Join(arg, " "), err)
+	}
 }
 
 // RemoveApInterface removes the AP interface.
 func (c *Command) RemoveApInterface() {
-	cmd := exec.Command("iw", "dev", "uap0", "del")
-	cmd.Start()
-	cmd.Wait()
+	c.run("iw", "dev", c.SetupCfg.Interfaces.Ap, "del")
 }
 
 // ConfigureApInterface configured the AP interface.
 func (c *Command) ConfigureApInterface() {
-	cmd := exec.Command("ifconfig", "uap0", c.SetupCfg.HostApdCfg.Ip)
-	cmd.Start()
-	cmd.Wait()
+	c.run("ifconfig", c.SetupCfg.Interfaces.Ap, c.SetupCfg.HostApdCfg.Ip)
 }
 
 // UpApInterface ups the AP Interface.
 func (c *Command) UpApInterface() {
-	cmd := exec.Command("ifconfig", "uap0", "up")
-	cmd.Start()
-	cmd.Wait()
+	c.run("ifconfig", c.SetupCfg.Interfaces.Ap, "up")
 }
 
 // AddApInterface adds the AP interface.
 func (c *Command) AddApInterface() {
-	cmd := exec.Command("iw", "phy", "phy0", "interface", "add", "uap0", "type", "__ap")
-	cmd.Start()
-	cmd.Wait()
+	c.run("iw", "phy", c.SetupCfg.Interfaces.Phy, "interface", "add", c.SetupCfg.Interfaces.Ap, "type", "__ap")
 }
 
 // CheckInterface checks the AP interface.
 func (c *Command) CheckApInterface() {
-	cmd := exec.Command("ifconfig", "uap0")
-	go c.Runner.ProcessCmd("ifconfig_uap0", cmd)
+	ap := c.SetupCfg.Interfaces.Ap
+	go c.Runner.ProcessCmd("ifconfig_"+ap, "ifconfig", ap)
 }
 
 // StartWpaSupplicant starts wpa_supplicant.
@@ -49,50 +51,41 @@ func (c *Command) StartWpaSupplicant() {
 
 	args := []string{
 		"-Dnl80211",
-		"-iwlan0",
+		"-i" + c.SetupCfg.Interfaces.Station,
 		"-c" + c.SetupCfg.WpaSupplicantCfg.CfgFile,
 	}
 
-	cmd := exec.Command("wpa_supplicant", args...)
-	go c.Runner.ProcessCmd("wpa_supplicant", cmd)
+	c.Supervisor.Start("wpa_supplicant", args...)
 }
 
-// StartDnsmasq starts dnsmasq.
+// StartDnsmasq starts dnsmasq with the configuration written by
+// dnsmasqConfig.
 func (c *Command) StartDnsmasq() {
-	// hostapd is enabled, fire up dnsmasq
 	args := []string{
-		"--no-hosts", // Don't read the hostnames in /etc/hosts.
 		"--keep-in-foreground",
-		"--log-queries",
-		"--no-resolv",
-		"--address=" + c.SetupCfg.DnsmasqCfg.Address,
-		"--dhcp-range=" + c.SetupCfg.DnsmasqCfg.DhcpRange,
-		"--dhcp-vendorclass=" + c.SetupCfg.DnsmasqCfg.VendorClass,
-		"--dhcp-authoritative",
-		"--log-facility=-",
-		"--interface=uap0",
-		"--port=0",
+		"--conf-file=" + c.SetupCfg.DnsmasqCfg.cfgFile(),
 	}
 
-	cmd := exec.Command("dnsmasq", args...)
-	go c.Runner.ProcessCmd("dnsmasq", cmd)
+	c.Supervisor.Start("dnsmasq", args...)
 }
 
 func (c *Command) StartHostAPD() {
+	cfgFile := c.SetupCfg.HostApdCfg.CfgFile
+	if cfgFile == "" {
+		cfgFile = DefaultHostApdCfgFile
+	}
+
 	args := []string{
-		"/etc/hostapd/hostapd.conf",
+		cfgFile,
 	}
 
-	cmd := exec.Command("hostapd", args...)
-	go c.Runner.ProcessCmd("hostapd", cmd)
+	c.Supervisor.Start("hostapd", args...)
 }
 
+// killIt stops a supervised daemon, then a copy left running by an
+// earlier run, see Supervisor.KillStale. Copies started outside this
+// program are left alone.
 func (c *Command) killIt(it string) {
-	args := []string{
-		it,
-	}
-
-	cmd := exec.Command("killall", args...)
-	cmdId := "killall " + it
-	c.Runner.ProcessCmd(cmdId, cmd)
+	c.Supervisor.Stop(it)
+	c.Supervisor.KillStale(it)
 }
@@ -0,0 +1,321 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// wpa_supplicant and hostapd share the same control interface protocol:
+// a UNIX datagram socket per interface, one request per datagram and one
+// response per request. A client that sends ATTACH additionally receives
+// unsolicited event messages prefixed with a priority, e.g. "<3>CTRL-EVENT-CONNECTED".
+
+var (
+	// ErrCtrlUnavailable is returned when the daemon's control socket
+	// does not exist or nobody is listening on it.
+	ErrCtrlUnavailable = errors.New("control socket unavailable")
+
+	// ErrCtrlTimeout is returned when the daemon did not answer in time.
+	ErrCtrlTimeout = errors.New("control request timed out")
+
+	// ErrCtrlFail is returned when the daemon answered FAIL.
+	ErrCtrlFail = errors.New("control request failed")
+
+	// ErrCtrlUnknownCommand is returned when the daemon does not
+	// understand the request.
+	ErrCtrlUnknownCommand = errors.New("unknown control command")
+)
+
+const (
+	ctrlRequestTimeout = 10 * time.Second
+	ctrlPingInterval   = 5 * time.Second
+	ctrlRetryInterval  = time.Second
+	ctrlBufSize        = 8192
+)
+
+var ctrlCounter uint64
+
+// CtrlEvent is an unsolicited message received from an attached control socket.
+type CtrlEvent struct {
+	Level   int    `json:"level"`
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// parseCtrlEvent splits "<3>CTRL-EVENT-CONNECTED - Connection to ..." into a CtrlEvent.
+func parseCtrlEvent(msg string) CtrlEvent {
+	ev := CtrlEvent{}
+	if strings.HasPrefix(msg, "<") {
+		if end := strings.Index(msg, ">"); end > 0 {
+			ev.Level, _ = strconv.Atoi(msg[1:end])
+			msg = msg[end+1:]
+		}
+	}
+	ev.Name = msg
+	if sp := strings.IndexByte(msg, ' '); sp >= 0 {
+		ev.Name = msg[:sp]
+		ev.Message = strings.TrimSpace(msg[sp+1:])
+	}
+	return ev
+}
+
+// ctrlConn is a single datagram connection to a control socket.
+type ctrlConn struct {
+	conn      *net.UnixConn
+	localPath string
+}
+
+// dialCtrl connects to the control socket at path, binding a private
+// local socket so the daemon has an address to reply to.
+func dialCtrl(path string) (*ctrlConn, error) {
+	n := atomic.AddUint64(&ctrlCounter, 1)
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("txwifi_ctrl_%d-%d", os.Getpid(), n))
+	os.Remove(local)
+
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: local, Net: "unixgram"},
+		&net.UnixAddr{Name: path, Net: "unixgram"},
+	)
+	if err != nil {
+		os.Remove(local)
+		return nil, fmt.Errorf("%w: %s", ErrCtrlUnavailable, err)
+	}
+
+	return &ctrlConn{conn: conn, localPath: local}, nil
+}
+
+// request sends cmd and waits for the reply, skipping any unsolicited
+// event messages that arrive in the meantime.
+func (c *ctrlConn) request(cmd string, timeout time.Duration) (string, error) {
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrCtrlUnavailable, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, ctrlBufSize)
+	for {
+		c.conn.SetReadDeadline(deadline)
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return "", ErrCtrlTimeout
+			}
+			return "", fmt.Errorf("%w: %s", ErrCtrlUnavailable, err)
+		}
+		reply := string(buf[:n])
+		if strings.HasPrefix(reply, "<") {
+			continue
+		}
+		return reply, nil
+	}
+}
+
+// recv waits for the next message until timeout.
+func (c *ctrlConn) recv(timeout time.Duration) (string, error) {
+	buf := make([]byte, ctrlBufSize)
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+func (c *ctrlConn) close() error {
+	err := c.conn.Close()
+	os.Remove(c.localPath)
+	return err
+}
+
+// ctrlClient is a reconnecting client for a control socket shared by
+// the wpa_supplicant and hostapd clients.
+type ctrlClient struct {
+	path string
+
+	mu   sync.Mutex
+	conn *ctrlConn
+}
+
+func newCtrlClient(path string) *ctrlClient {
+	return &ctrlClient{path: path}
+}
+
+// Path returns the control socket path.
+func (c *ctrlClient) Path() string {
+	return c.path
+}
+
+// Request sends a raw command and returns the raw reply. FAIL and
+// UNKNOWN COMMAND replies are converted to errors.
+func (c *ctrlClient) Request(cmd string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := dialCtrl(c.path)
+		if err != nil {
+			return "", err
+		}
+		c.conn = conn
+	}
+
+	reply, err := c.conn.request(cmd, ctrlRequestTimeout)
+	if err != nil {
+		// the daemon may have restarted, dial again on the next request
+		c.conn.close()
+		c.conn = nil
+		return "", err
+	}
+
+	switch strings.TrimSpace(reply) {
+	case "FAIL":
+		return reply, fmt.Errorf("%w: %s", ErrCtrlFail, cmd)
+	case "UNKNOWN COMMAND":
+		return reply, fmt.Errorf("%w: %s", ErrCtrlUnknownCommand, cmd)
+	}
+
+	return reply, nil
+}
+
+// requestOK sends cmd and expects an OK reply.
+func (c *ctrlClient) requestOK(cmd string) error {
+	reply, err := c.Request(cmd)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "OK" {
+		return fmt.Errorf("%w: %s: unexpected reply %q", ErrCtrlFail, cmd, strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+// Ping checks that the daemon is answering on its control socket.
+func (c *ctrlClient) Ping() error {
+	reply, err := c.Request("PING")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "PONG" {
+		return fmt.Errorf("%w: PING: unexpected reply %q", ErrCtrlFail, strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+// Running reports whether the daemon answers on its control socket.
+func (c *ctrlClient) Running() bool {
+	return c.Ping() == nil
+}
+
+// Close closes the request connection. It is reopened on the next request.
+func (c *ctrlClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.close()
+	c.conn = nil
+	return err
+}
+
+// Events attaches to the control socket and delivers unsolicited events
+// until ctx is done. When the daemon goes away the client keeps trying to
+// attach again, so the channel survives daemon restarts. The channel is
+// closed when ctx is done.
+func (c *ctrlClient) Events(ctx context.Context) <-chan CtrlEvent {
+	events, _ := c.AttachedEvents(ctx)
+	return events
+}
+
+// AttachedEvents is Events, with a channel that is closed once the first
+// ATTACH succeeded. Waiting for it before a request makes sure the event
+// answering the request is not missed.
+func (c *ctrlClient) AttachedEvents(ctx context.Context) (<-chan CtrlEvent, <-chan struct{}) {
+	events := make(chan CtrlEvent, 16)
+	attached := make(chan struct{})
+	var once sync.Once
+	onAttach := func() { once.Do(func() { close(attached) }) }
+
+	go func() {
+		defer close(events)
+		for {
+			c.attachLoop(ctx, events, onAttach)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(ctrlRetryInterval):
+			}
+		}
+	}()
+
+	return events, attached
+}
+
+// attachLoop runs a single ATTACH session and returns when the daemon
+// stops answering or ctx is done. onAttach is called once attached.
+func (c *ctrlClient) attachLoop(ctx context.Context, events chan<- CtrlEvent, onAttach func()) {
+	conn, err := dialCtrl(c.path)
+	if err != nil {
+		return
+	}
+	defer conn.close()
+
+	reply, err := conn.request("ATTACH", ctrlRequestTimeout)
+	if err != nil || strings.TrimSpace(reply) != "OK" {
+		return
+	}
+	defer conn.conn.Write([]byte("DETACH"))
+	onAttach()
+
+	lastSeen := time.Now()
+	pinged := false
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		msg, err := conn.recv(time.Second)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				return
+			}
+			// datagram sockets do not notice a vanished peer, so ping it
+			if time.Since(lastSeen) > ctrlPingInterval {
+				if pinged {
+					return
+				}
+				if _, err := conn.conn.Write([]byte("PING")); err != nil {
+					return
+				}
+				pinged = true
+				lastSeen = time.Now()
+			}
+			continue
+		}
+
+		lastSeen = time.Now()
+		pinged = false
+		if !strings.HasPrefix(msg, "<") {
+			// PONG or a late reply
+			continue
+		}
+
+		select {
+		case events <- parseCtrlEvent(msg):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCtrlEvent(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want CtrlEvent
+	}{
+		{"<3>CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed", CtrlEvent{3, "CTRL-EVENT-CONNECTED", "- Connection to 00:11:22:33:44:55 completed"}},
+		{"<2>AP-STA-CONNECTED aa:bb:cc:dd:ee:ff", CtrlEvent{2, "AP-STA-CONNECTED", "aa:bb:cc:dd:ee:ff"}},
+		{"<3>CTRL-EVENT-SCAN-RESULTS ", CtrlEvent{3, "CTRL-EVENT-SCAN-RESULTS", ""}},
+		{"AP-ENABLED", CtrlEvent{0, "AP-ENABLED", ""}},
+	}
+
+	for _, tt := range tests {
+		if got := parseCtrlEvent(tt.msg); got != tt.want {
+			t.Errorf("parseCtrlEvent(%q) = %+v, want %+v", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestWpaCtrlStatus(t *testing.T) {
+	dir := t.TempDir()
+	startFakeDaemon(t, filepath.Join(dir, "wlan0"), map[string]string{
+		"STATUS": "bssid=00:11:22:33:44:55\nssid=home\nwpa_state=COMPLETED\nip_address=192.168.1.20\n",
+	})
+
+	wpa := NewWpaCtrl(dir, "wlan0")
+	defer wpa.Close()
+
+	state, err := wpa.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != "COMPLETED" {
+		t.Errorf("state = %q", state)
+	}
+
+	status, _ := wpa.Status()
+	if status["ip_address"] != "192.168.1.20" || status["ssid"] != "home" {
+		t.Errorf("unexpected status %v", status)
+	}
+}
+
+func TestWpaCtrlErrors(t *testing.T) {
+	dir := t.TempDir()
+	startFakeDaemon(t, filepath.Join(dir, "wlan0"), map[string]string{
+		"SELECT_NETWORK": "FAIL\n",
+	})
+
+	wpa := NewWpaCtrl(dir, "wlan0")
+	defer wpa.Close()
+
+	if err := wpa.SelectNetwork("3"); !errors.Is(err, ErrCtrlFail) {
+		t.Errorf("SelectNetwork err = %v, want ErrCtrlFail", err)
+	}
+	if _, err := wpa.Request("BOGUS"); !errors.Is(err, ErrCtrlUnknownCommand) {
+		t.Errorf("Request err = %v, want ErrCtrlUnknownCommand", err)
+	}
+
+	missing := NewWpaCtrl(dir, "wlan1")
+	if err := missing.Ping(); !errors.Is(err, ErrCtrlUnavailable) {
+		t.Errorf("Ping err = %v, want ErrCtrlUnavailable", err)
+	}
+	if missing.Running() {
+		t.Error("missing daemon reported running")
+	}
+}
+
+func TestWpaCtrlReconnect(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wlan0")
+	d := startFakeDaemon(t, path, nil)
+
+	wpa := NewWpaCtrl(dir, "wlan0")
+	defer wpa.Close()
+
+	if !wpa.Running() {
+		t.Fatal("daemon not running")
+	}
+
+	d.Stop()
+	if wpa.Running() {
+		t.Fatal("stopped daemon reported running")
+	}
+
+	startFakeDaemon(t, path, nil)
+	if !wpa.Running() {
+		t.Fatal("restarted daemon not running")
+	}
+}
+
+func TestCtrlEvents(t *testing.T) {
+	dir := t.TempDir()
+	d := startFakeDaemon(t, filepath.Join(dir, "wlan0"), nil)
+
+	wpa := NewWpaCtrl(dir, "wlan0")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := wpa.Events(ctx)
+	d.waitAttached(t)
+	d.Emit("<3>CTRL-EVENT-DISCONNECTED bssid=00:11:22:33:44:55 reason=3")
+
+	select {
+	case ev := <-events:
+		if ev.Name != "CTRL-EVENT-DISCONNECTED" || ev.Level != 3 {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestApdCtrlStations(t *testing.T) {
+	dir := t.TempDir()
+	startFakeDaemon(t, filepath.Join(dir, "uap0"), map[string]string{
+		"STATUS":                     "state=ENABLED\nchannel=6\n",
+		"STA-FIRST":                  "aa:bb:cc:dd:ee:01\nflags=[AUTH][ASSOC][AUTHORIZED]\nrx_bytes=100\n",
+		"STA-NEXT aa:bb:cc:dd:ee:01": "aa:bb:cc:dd:ee:02\nflags=[AUTH][ASSOC]\nrx_bytes=200\n",
+		"STA-NEXT aa:bb:cc:dd:ee:02": "",
+		"STA aa:bb:cc:dd:ee:02":      "aa:bb:cc:dd:ee:02\nrx_bytes=200\n",
+		"DEAUTHENTICATE":             "OK\n",
+	})
+
+	apd := NewApdCtrl(dir, "uap0")
+	defer apd.Close()
+
+	if state, err := apd.State(); err != nil || state != "ENABLED" {
+		t.Fatalf("State() = %q, %v", state, err)
+	}
+
+	stations, err := apd.AllSta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stations) != 2 || stations[0].Mac != "aa:bb:cc:dd:ee:01" || stations[1].Info["rx_bytes"] != "200" {
+		t.Errorf("unexpected stations %+v", stations)
+	}
+	if !apd.HasStations() {
+		t.Error("HasStations() = false")
+	}
+
+	sta, err := apd.Sta("aa:bb:cc:dd:ee:02")
+	if err != nil || sta.Mac != "aa:bb:cc:dd:ee:02" {
+		t.Errorf("Sta() = %+v, %v", sta, err)
+	}
+
+	if err := apd.Deauthenticate("aa:bb:cc:dd:ee:02"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApdEvents(t *testing.T) {
+	dir := t.TempDir()
+	d := startFakeDaemon(t, filepath.Join(dir, "uap0"), nil)
+
+	apd := NewApdCtrl(dir, "uap0")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := apd.ApdEvents(ctx)
+	d.waitAttached(t)
+	d.Emit("<3>AP-STA-CONNECTED aa:bb:cc:dd:ee:01")
+	d.Emit("<3>AP-STA-DISCONNECTED aa:bb:cc:dd:ee:01")
+
+	for _, want := range []ApdEventType{ApdStaConnected, ApdStaDisconnected} {
+		select {
+		case ev := <-events:
+			if ev.Type != want || ev.Mac != "aa:bb:cc:dd:ee:01" {
+				t.Errorf("got %+v, want %s", ev, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package iotwifi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultDnsmasqCfgFile is where dnsmasqConfig writes the dnsmasq
+// configuration unless DnsmasqCfg.CfgFile is set.
+const DefaultDnsmasqCfgFile = "/etc/txwifi/dnsmasq.conf"
+
+// RouterNone as DnsmasqCfg.Router advertises no default gateway, so
+// clients keep using their mobile data for everything else.
+const RouterNone = "none"
+
+// cfgFile returns the configured file, DefaultDnsmasqCfgFile when empty.
+func (c DnsmasqCfg) cfgFile() string {
+	if c.CfgFile == "" {
+		return DefaultDnsmasqCfgFile
+	}
+	return c.CfgFile
+}
+
+// dns reports whether dnsmasq answers DNS queries, which it only does
+// when there is something to answer: always with an uplink, the servers
+// or those of the station.
+func (c DnsmasqCfg) dns(uplink bool) bool {
+	return c.Address != "" || len(c.Addresses) > 0 || len(c.Records) > 0 || uplink
+}
+
+// dnsmasqConfig writes the dnsmasq configuration for the access point,
+// with the upstream servers when the station uplink is up, and reports
+// whether the file changed.
+func dnsmasqConfig(setupCfg *SetupCfg, uplink bool) (bool, error) {
+	cfgFile := setupCfg.DnsmasqCfg.cfgFile()
+	if err := os.MkdirAll(filepath.Dir(cfgFile), 0755); err != nil {
+		return false, err
+	}
+
+	cfg := renderDnsmasq(setupCfg.DnsmasqCfg, setupCfg.Interfaces.Ap, uplink)
+	if old, err := ioutil.ReadFile(cfgFile); err == nil && string(old) == cfg {
+		return false, nil
+	}
+	return true, ioutil.WriteFile(cfgFile, []byte(cfg), 0644)
+}
+
+// renderDnsmasq renders dnsmasq.conf for the access point interface.
+// The upstream servers are only reachable, and only written, when the
+// station uplink is up. Without servers dnsmasq then forwards to those
+// of the station in /etc/resolv.conf.
+func renderDnsmasq(c DnsmasqCfg, iface string, uplink bool) string {
+	lines := []string{
+		"# generated by txwifi from dnsmasq_cfg, changes are overwritten",
+		"interface=" + iface,
+		"bind-interfaces",
+		"no-hosts", // don't read the hostnames in /etc/hosts
+	}
+	if !uplink || len(c.Servers) > 0 {
+		lines = append(lines, "no-resolv")
+	}
+	lines = append(lines,
+		"log-queries",
+		"log-facility=-",
+	)
+
+	// DHCP
+	dhcpRange := c.DhcpRange
+	if c.LeaseTime != "" {
+		dhcpRange += "," + c.LeaseTime
+	}
+	lines = append(lines,
+		"dhcp-authoritative",
+		"dhcp-leasefile="+c.leaseFile(),
+		"dhcp-range="+dhcpRange,
+	)
+	if c.VendorClass != "" {
+		lines = append(lines, "dhcp-vendorclass="+c.VendorClass)
+	}
+	for _, host := range c.Hosts {
+		lines = append(lines, "dhcp-host="+host.arg())
+	}
+	switch c.Router {
+	case "":
+	case RouterNone:
+		lines = append(lines, "dhcp-option=option:router")
+	default:
+		lines = append(lines, "dhcp-option=option:router,"+c.Router)
+	}
+	if len(c.DnsServers) > 0 {
+		lines = append(lines, "dhcp-option=option:dns-server,"+strings.Join(c.DnsServers, ","))
+	}
+	for _, opt := range c.Options {
+		lines = append(lines, "dhcp-option="+opt)
+	}
+
+	// DNS
+	if !c.dns(uplink) {
+		lines = append(lines, "port=0")
+	}
+	if c.Address != "" {
+		lines = append(lines, "address="+c.Address)
+	}
+	for _, addr := range c.Addresses {
+		lines = append(lines, "address="+addr)
+	}
+	for _, rec := range c.Records {
+		lines = append(lines, "host-record="+rec.Name+","+rec.Ip)
+	}
+	if uplink {
+		for _, server := range c.Servers {
+			lines = append(lines, "server="+server)
+		}
+	}
+
+	lines = append(lines, c.Extra...)
+
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,93 @@
+package iotwifi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderDnsmasq(t *testing.T) {
+	dhcp := DnsmasqCfg{DhcpRange: "192.168.27.100,192.168.27.150", LeaseFile: "/data/leases"}
+
+	tests := []struct {
+		name    string
+		cfg     func(c *DnsmasqCfg)
+		uplink  bool
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "dhcp only",
+			cfg:  func(c *DnsmasqCfg) {},
+			want: []string{"interface=uap0\n", "bind-interfaces\n", "no-resolv\n", "dhcp-authoritative\n",
+				"dhcp-leasefile=/data/leases\n", "dhcp-range=192.168.27.100,192.168.27.150\n", "port=0\n"},
+			notWant: []string{"dhcp-vendorclass", "dhcp-option", "address=", "server="},
+		},
+		{
+			name: "catch-all address",
+			cfg:  func(c *DnsmasqCfg) { c.Address = "/#/192.168.27.1" },
+			want: []string{"address=/#/192.168.27.1\n"}, notWant: []string{"port=0"},
+		},
+		{
+			name: "local records and upstream servers",
+			cfg: func(c *DnsmasqCfg) {
+				c.Addresses = []string{"/setup.example.com/192.168.27.1", "/ads.example.com/"}
+				c.Records = []DnsRecord{{Name: "setup.local", Ip: "192.168.27.1"}}
+				c.Servers = []string{"1.1.1.1", "/corp/10.0.0.1#5353"}
+			},
+			uplink: true,
+			want: []string{"address=/setup.example.com/192.168.27.1\n", "address=/ads.example.com/\n",
+				"host-record=setup.local,192.168.27.1\n", "server=1.1.1.1\n", "server=/corp/10.0.0.1#5353\n", "no-resolv\n"},
+			notWant: []string{"port=0"},
+		},
+		{
+			name:    "uplink without servers",
+			cfg:     func(c *DnsmasqCfg) {},
+			uplink:  true,
+			notWant: []string{"no-resolv", "port=0", "server="},
+		},
+		{
+			name:    "upstream servers without uplink",
+			cfg:     func(c *DnsmasqCfg) { c.Servers = []string{"1.1.1.1"} },
+			want:    []string{"port=0\n"},
+			notWant: []string{"server="},
+		},
+		{
+			name: "dhcp options",
+			cfg: func(c *DnsmasqCfg) {
+				c.VendorClass = "set:device,IoT"
+				c.LeaseTime = "12h"
+				c.Router = RouterNone
+				c.DnsServers = []string{"192.168.27.1", "1.1.1.1"}
+				c.Options = []string{"option:ntp-server,192.168.27.1"}
+				c.Hosts = []DhcpHost{{Mac: "b8:27:eb:12:34:56", Ip: "192.168.27.20", Lease: "infinite"}}
+			},
+			want: []string{"dhcp-range=192.168.27.100,192.168.27.150,12h\n", "dhcp-vendorclass=set:device,IoT\n",
+				"dhcp-host=b8:27:eb:12:34:56,192.168.27.20,infinite\n", "dhcp-option=option:router\n",
+				"dhcp-option=option:dns-server,192.168.27.1,1.1.1.1\n", "dhcp-option=option:ntp-server,192.168.27.1\n"},
+		},
+		{
+			name: "router and extra lines",
+			cfg: func(c *DnsmasqCfg) {
+				c.Router = "192.168.27.254"
+				c.Extra = []string{"dhcp-ignore-names", "log-dhcp"}
+			},
+			want: []string{"dhcp-option=option:router,192.168.27.254\n", "dhcp-ignore-names\nlog-dhcp\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		cfg := dhcp
+		tt.cfg(&cfg)
+		conf := renderDnsmasq(cfg, "uap0", tt.uplink)
+		for _, want := range tt.want {
+			if !strings.Contains(conf, want) {
+				t.Errorf("%s: missing %q in\n%s", tt.name, want, conf)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(conf, notWant) {
+				t.Errorf("%s: unexpected %q in\n%s", tt.name, notWant, conf)
+			}
+		}
+	}
+}
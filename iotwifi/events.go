@@ -0,0 +1,95 @@
+package iotwifi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Event types published on the EventBus.
+const (
+	EventMode       = "mode"       // a ConnManager Transition
+	EventWpa        = "wpa"        // a wpa_supplicant CtrlEvent
+	EventHostapd    = "hostapd"    // a hostapd ApdEvent
+	EventScan       = "scan"       // a completed network scan
+	EventConnection = "connection" // the outcome of a connect request
+	EventDaemon     = "daemon"     // a supervised daemon DaemonStatus
+	EventConfig     = "config"     // an applied configuration CfgReload
+)
+
+// eventBuffer is the number of events buffered per subscriber. Events
+// for subscribers that fall further behind are dropped.
+const eventBuffer = 64
+
+// Event is a message published to event stream subscribers.
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// EventBus fans events out to subscribers.
+type EventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// NewEventBus produces an EventBus.
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish sends an event to every subscriber without blocking.
+func (b *EventBus) Publish(typ string, data interface{}) {
+	ev := Event{Type: typ, Time: time.Now(), Data: data}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		select {
+		case sub <- ev:
+		default:
+			log.Warnf("event subscriber is too slow, dropped %s event", typ)
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a function that ends the
+// subscription and closes the channel.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	sub := make(chan Event, eventBuffer)
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, sub)
+			b.mu.Unlock()
+			close(sub)
+		})
+	}
+
+	return sub, cancel
+}
+
+// PublishWpaEvents forwards wpa_supplicant control events until ctx is done.
+func (b *EventBus) PublishWpaEvents(ctx context.Context, wpa *WpaCtrl) {
+	for ev := range wpa.Events(ctx) {
+		b.Publish(EventWpa, ev)
+	}
+}
+
+// PublishApdEvents forwards hostapd control events until ctx is done.
+func (b *EventBus) PublishApdEvents(ctx context.Context, apd *ApdCtrl) {
+	for ev := range apd.ApdEvents(ctx) {
+		b.Publish(EventHostapd, ev)
+	}
+}
@@ -0,0 +1,214 @@
+package iotwifi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe()
+
+	bus.Publish(EventScan, 3)
+	ev := <-events
+	if ev.Type != EventScan || ev.Data != 3 {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("channel open after cancel")
+	}
+
+	// publishing without subscribers or to a full subscriber never blocks
+	bus.Publish(EventScan, nil)
+	_, cancel = bus.Subscribe()
+	defer cancel()
+	for i := 0; i < eventBuffer*2; i++ {
+		bus.Publish(EventScan, i)
+	}
+}
+
+func newEventsHandler() *HttpHandler {
+	return &HttpHandler{
+		manager: NewConnManager(make(chan CmdMessage, 1), &SetupCfg{Executor: newFakeExecutor()}),
+	}
+}
+
+func TestEventsHandlerSSE(t *testing.T) {
+	h := newEventsHandler()
+	srv := httptest.NewServer(http.HandlerFunc(h.EventsHandler))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+
+	h.manager.transition(StateStartingAP, "sse test")
+
+	r := bufio.NewReader(res.Body)
+	eventLine, _ := r.ReadString('\n')
+	dataLine, _ := r.ReadString('\n')
+	if eventLine != "event: mode\n" {
+		t.Fatalf("event line %q", eventLine)
+	}
+
+	var ev struct {
+		Type string     `json:"type"`
+		Data Transition `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(dataLine, "data: ")), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Data.To != StateStartingAP || ev.Data.Reason != "sse test" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
+
+func TestEventsHandlerWebsocket(t *testing.T) {
+	h := newEventsHandler()
+	srv := httptest.NewServer(http.HandlerFunc(h.EventsHandler))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	// the example key from RFC 6455
+	if accept := res.Header.Get("Sec-Websocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("accept %q", accept)
+	}
+
+	// wait for the subscription before publishing
+	waitFor(t, "subscriber", func() bool {
+		h.manager.Events.mu.Lock()
+		defer h.manager.Events.mu.Unlock()
+		return len(h.manager.Events.subs) == 1
+	})
+	h.manager.Events.Publish(EventConnection, WpaConnection{Ssid: "home", State: "COMPLETED"})
+
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	if head[0] != 0x80|wsOpText {
+		t.Fatalf("frame header %x", head[0])
+	}
+	n := int(head[1])
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	io.ReadFull(r, payload)
+
+	var ev struct {
+		Type string        `json:"type"`
+		Data WpaConnection `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != EventConnection || ev.Data.State != "COMPLETED" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	// masked close frame from the client
+	conn.Write([]byte{0x80 | wsOpClose, 0x80, 1, 2, 3, 4})
+	waitFor(t, "unsubscribe", func() bool {
+		h.manager.Events.mu.Lock()
+		defer h.manager.Events.mu.Unlock()
+		return len(h.manager.Events.subs) == 0
+	})
+}
+
+func TestEventsHandlerShutdown(t *testing.T) {
+	r := newFakeRadio(t)
+	h := NewHttpHandler(r.cfg, true)
+	srv := httptest.NewServer(http.HandlerFunc(h.EventsHandler))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream ends instead of waiting for the client to go away
+	if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingHijacker is a response whose connection cannot be taken over.
+type failingHijacker struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrHijacked
+}
+
+func TestEventsHandlerWebsocketErrors(t *testing.T) {
+	h := newEventsHandler()
+	req := func() *http.Request {
+		r := httptest.NewRequest("GET", "/events", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	h.EventsHandler(w, req())
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("no hijacker: status %d", w.Code)
+	}
+
+	// nothing is written once the hijack was attempted
+	w = httptest.NewRecorder()
+	h.EventsHandler(failingHijacker{w}, req())
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || len(w.Header()) != 0 {
+		t.Errorf("failed hijack: status %d, body %q", w.Code, w.Body.String())
+	}
+}
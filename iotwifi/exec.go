@@ -0,0 +1,91 @@
+package iotwifi
+
+import (
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Executor runs the external programs used to manage the radios
+// (iw, ifconfig, hostapd, dnsmasq, wpa_supplicant ...). It is set on
+// SetupCfg so tests can replace the real programs with a scripted fake.
+type Executor interface {
+	// Output runs a command to completion and returns its standard output.
+	Output(name string, arg ...string) ([]byte, error)
+
+	// Start starts a command without waiting for it to finish.
+	Start(name string, arg ...string) (Process, error)
+}
+
+// Process is a command started by an Executor.
+type Process interface {
+	Pid() int
+	Stdout() io.Reader
+	Stderr() io.Reader
+	Wait() error
+	Signal(sig os.Signal) error
+}
+
+// OsExecutor is the Executor backed by os/exec.
+type OsExecutor struct{}
+
+// Output runs a command and returns its standard output.
+func (OsExecutor) Output(name string, arg ...string) ([]byte, error) {
+	return exec.Command(name, arg...).Output()
+}
+
+// Start starts a command with its output connected to pipes.
+func (OsExecutor) Start(name string, arg ...string) (Process, error) {
+	cmd := exec.Command(name, arg...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &osProcess{cmd: cmd, stdout: stdout, stderr: stderr}, nil
+}
+
+// osProcess is a Process backed by exec.Cmd.
+type osProcess struct {
+	cmd    *exec.Cmd
+	stdout io.Reader
+	stderr io.Reader
+}
+
+func (p *osProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *osProcess) Stdout() io.Reader {
+	return p.stdout
+}
+
+func (p *osProcess) Stderr() io.Reader {
+	return p.stderr
+}
+
+func (p *osProcess) Wait() error {
+	return p.cmd.Wait()
+}
+
+func (p *osProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+// executor returns the configured Executor or the os/exec default.
+func (s *SetupCfg) executor() Executor {
+	if s.Executor == nil {
+		return OsExecutor{}
+	}
+	return s.Executor
+}
@@ -0,0 +1,385 @@
+package iotwifi
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDaemon plays wpa_supplicant or hostapd on a control socket,
+// answering requests with canned replies.
+type fakeDaemon struct {
+	conn *net.UnixConn
+	path string
+
+	mu       sync.Mutex
+	replies  map[string]string
+	emits    map[string]string // events emitted after a reply
+	requests []string
+	attached []*net.UnixAddr
+	done     chan struct{}
+}
+
+// startFakeDaemon listens on path. Replies are looked up by the full
+// request first and then by its first word.
+func startFakeDaemon(t *testing.T, path string, replies map[string]string) *fakeDaemon {
+	t.Helper()
+
+	os.MkdirAll(filepath.Dir(path), 0755)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen %s: %s", path, err)
+	}
+
+	d := &fakeDaemon{
+		conn: conn,
+		path: path,
+		replies: map[string]string{
+			"PING":   "PONG\n",
+			"ATTACH": "OK\n",
+			"DETACH": "OK\n",
+		},
+		emits: make(map[string]string),
+		done:  make(chan struct{}),
+	}
+	for k, v := range replies {
+		d.replies[k] = v
+	}
+
+	go d.serve()
+	t.Cleanup(d.Stop)
+
+	return d
+}
+
+func (d *fakeDaemon) serve() {
+	buf := make([]byte, ctrlBufSize)
+	for {
+		n, addr, err := d.conn.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+		req := string(buf[:n])
+
+		d.mu.Lock()
+		d.requests = append(d.requests, req)
+		if req == "ATTACH" {
+			d.attached = append(d.attached, addr)
+		}
+		reply, ok := d.replies[req]
+		if !ok {
+			reply, ok = d.replies[strings.Fields(req)[0]]
+		}
+		if !ok {
+			reply = "UNKNOWN COMMAND\n"
+		}
+		emit := d.emits[req]
+		d.mu.Unlock()
+
+		d.conn.WriteToUnix([]byte(reply), addr)
+		if emit != "" {
+			d.Emit(emit)
+		}
+	}
+}
+
+// SetReply changes the reply for a request.
+func (d *fakeDaemon) SetReply(req string, reply string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.replies[req] = reply
+}
+
+// EmitOn emits msg to the attached clients right after replying to req.
+func (d *fakeDaemon) EmitOn(req string, msg string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.emits[req] = msg
+}
+
+// Requests returns every request received so far.
+func (d *fakeDaemon) Requests() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.requests...)
+}
+
+// Emit sends an unsolicited event to every attached client.
+func (d *fakeDaemon) Emit(msg string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, addr := range d.attached {
+		d.conn.WriteToUnix([]byte(msg), addr)
+	}
+}
+
+// waitAttached waits for a client to send ATTACH.
+func (d *fakeDaemon) waitAttached(t *testing.T) {
+	t.Helper()
+	waitFor(t, "ATTACH", func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.attached) > 0
+	})
+}
+
+// Stop closes the socket as if the daemon exited.
+func (d *fakeDaemon) Stop() {
+	select {
+	case <-d.done:
+		return
+	default:
+	}
+	close(d.done)
+	d.conn.Close()
+	os.Remove(d.path)
+}
+
+// fakeProcess is a Process with canned output. One-shot processes exit
+// immediately, daemons run until signaled.
+type fakeProcess struct {
+	name   string
+	stdout string
+	done   chan struct{}
+	once   sync.Once
+	onExit func()
+}
+
+func (p *fakeProcess) Pid() int          { return 4242 }
+func (p *fakeProcess) Stdout() io.Reader { return strings.NewReader(p.stdout) }
+func (p *fakeProcess) Stderr() io.Reader { return strings.NewReader("") }
+func (p *fakeProcess) Wait() error       { <-p.done; return nil }
+func (p *fakeProcess) exit() {
+	p.once.Do(func() {
+		if p.onExit != nil {
+			p.onExit()
+		}
+		close(p.done)
+	})
+}
+func (p *fakeProcess) Signal(os.Signal) error {
+	p.exit()
+	return nil
+}
+
+// fakeExecutor is a scripted Executor. Output and Start return the
+// canned output registered for the command line, Output the canned
+// error, and optional hooks let a test bring fake daemons up and down.
+type fakeExecutor struct {
+	mu      sync.Mutex
+	calls   []string
+	outputs map[string]string
+	errs    map[string]error
+	hooks   map[string]func(arg []string)
+	running map[string][]*fakeProcess
+}
+
+func newFakeExecutor() *fakeExecutor {
+	return &fakeExecutor{
+		outputs: make(map[string]string),
+		errs:    make(map[string]error),
+		hooks:   make(map[string]func(arg []string)),
+		running: make(map[string][]*fakeProcess),
+	}
+}
+
+var fakeDaemons = map[string]bool{
+	"hostapd":        true,
+	"dnsmasq":        true,
+	"wpa_supplicant": true,
+}
+
+func (f *fakeExecutor) record(name string, arg []string) string {
+	line := strings.TrimSpace(name + " " + strings.Join(arg, " "))
+	f.mu.Lock()
+	f.calls = append(f.calls, line)
+	f.mu.Unlock()
+	return line
+}
+
+func (f *fakeExecutor) Output(name string, arg ...string) ([]byte, error) {
+	line := f.record(name, arg)
+	if hook, ok := f.hooks[name]; ok {
+		hook(arg)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return []byte(f.outputs[line]), f.errs[line]
+}
+
+func (f *fakeExecutor) Start(name string, arg ...string) (Process, error) {
+	line := f.record(name, arg)
+
+	f.mu.Lock()
+	p := &fakeProcess{name: name, stdout: f.outputs[line], done: make(chan struct{})}
+	if fakeDaemons[name] {
+		f.running[name] = append(f.running[name], p)
+		// the "exit <name>" hook runs when the daemon exits
+		if hook, ok := f.hooks["exit "+name]; ok {
+			p.onExit = func() { hook(nil) }
+		}
+	} else {
+		p.exit()
+	}
+	hook := f.hooks[name]
+	f.mu.Unlock()
+
+	if hook != nil {
+		hook(arg)
+	}
+
+	return p, nil
+}
+
+// Calls returns every command line run so far.
+func (f *fakeExecutor) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// called reports whether a command line starting with prefix was run.
+func (f *fakeExecutor) called(prefix string) bool {
+	for _, c := range f.Calls() {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeRadio wires a fakeExecutor to fake hostapd and wpa_supplicant
+// daemons that appear when started and vanish when signaled.
+type fakeRadio struct {
+	t    *testing.T
+	dir  string
+	exec *fakeExecutor
+	cfg  *SetupCfg
+
+	mu      sync.Mutex
+	wpa     *fakeDaemon
+	apd     *fakeDaemon
+	wpaPath string // control sockets, see setPaths
+	apdPath string
+}
+
+// setPaths fixes the control socket paths from the configuration, which
+// the manager may change while the hooks run.
+func (r *fakeRadio) setPaths() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.apdPath = filepath.Join(r.cfg.HostApdCfg.CtrlInterface, r.cfg.Interfaces.Ap)
+	r.wpaPath = filepath.Join(r.cfg.WpaSupplicantCfg.CtrlInterface, r.cfg.Interfaces.Station)
+}
+
+func newFakeRadio(t *testing.T) *fakeRadio {
+	dir := t.TempDir()
+	r := &fakeRadio{
+		t:    t,
+		dir:  dir,
+		exec: newFakeExecutor(),
+	}
+
+	r.cfg = &SetupCfg{
+		Interfaces: InterfaceCfg{
+			Phy:     "phy0",
+			Station: "wlan0",
+			Ap:      "uap0",
+		},
+		DnsmasqCfg: DnsmasqCfg{
+			Address:     "/#/192.168.27.1",
+			DhcpRange:   "192.168.27.100,192.168.27.150,1h",
+			VendorClass: "set:device,IoT",
+			LeaseFile:   filepath.Join(dir, "dnsmasq.leases"),
+			CfgFile:     filepath.Join(dir, "dnsmasq.conf"),
+		},
+		HostApdCfg: HostApdCfg{
+			Ssid:          "iot-wifi-test",
+			WpaPassphrase: "iotwifipass",
+			Channel:       "6",
+			Ip:            "192.168.27.1",
+			CfgFile:       filepath.Join(dir, "hostapd.conf"),
+			CtrlInterface: filepath.Join(dir, "hostapd"),
+			DenyMacFile:   filepath.Join(dir, "hostapd.deny"),
+			AcceptMacFile: filepath.Join(dir, "hostapd.accept"),
+		},
+		WpaSupplicantCfg: WpaSupplicantCfg{
+			CfgFile:       filepath.Join(dir, "wpa_supplicant.conf"),
+			CtrlInterface: filepath.Join(dir, "wpa_supplicant"),
+			CertDir:       filepath.Join(dir, "certs"),
+		},
+		PidDir:   filepath.Join(dir, "run"),
+		Executor: r.exec,
+	}
+	r.setPaths()
+
+	r.exec.hooks["hostapd"] = func([]string) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.apd = startFakeDaemon(t, r.apdPath, map[string]string{
+			"STATUS":    "state=ENABLED\nchannel=6\n",
+			"STA-FIRST": "",
+		})
+	}
+	r.exec.hooks["exit hostapd"] = func([]string) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.apd != nil {
+			r.apd.Stop()
+			r.apd = nil
+		}
+	}
+	r.exec.hooks["wpa_supplicant"] = func([]string) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.wpa = startFakeDaemon(t, r.wpaPath, map[string]string{
+			"STATUS": "wpa_state=SCANNING\n",
+		})
+	}
+	r.exec.hooks["exit wpa_supplicant"] = func([]string) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.wpa != nil {
+			r.wpa.Stop()
+			r.wpa = nil
+		}
+	}
+
+	return r
+}
+
+// start runs a ConnManager against the fake radio.
+func (r *fakeRadio) start() *ConnManager {
+	r.setPaths()
+
+	messages := make(chan CmdMessage, 1)
+	manager := NewConnManager(messages, r.cfg)
+
+	go HandleLog(messages)
+	go manager.Run()
+
+	return manager
+}
+
+// waitState waits for the manager to reach state.
+func waitState(t *testing.T, m *ConnManager, state WifiState) {
+	t.Helper()
+	waitFor(t, string(state), func() bool { return m.State() == state })
+}
@@ -0,0 +1,257 @@
+package iotwifi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Bands of HostApdCfg.Band.
+const (
+	Band2GHz = "2.4GHz"
+	Band5GHz = "5GHz"
+)
+
+// Security modes of HostApdCfg.Security.
+const (
+	SecurityOpen       = "open"
+	SecurityOwe        = "owe"       // encrypted without a passphrase
+	SecurityWpa2       = "wpa2"      // WPA2-PSK with CCMP
+	SecurityWpa3       = "wpa3"      // WPA3-SAE
+	SecurityTransition = "wpa2-wpa3" // WPA2-PSK and WPA3-SAE for older clients
+)
+
+// Protected management frame settings of HostApdCfg.Pmf.
+const (
+	PmfDisabled = "disabled"
+	PmfOptional = "optional"
+	PmfRequired = "required"
+)
+
+// channels5GHz are the 20MHz 5GHz channels hostapd can use.
+var channels5GHz = []int{
+	36, 40, 44, 48, 52, 56, 60, 64,
+	100, 104, 108, 112, 116, 120, 124, 128, 132, 136, 140, 144,
+	149, 153, 157, 161, 165,
+}
+
+// band returns the configured band, 2.4GHz when empty.
+func (c HostApdCfg) band() string {
+	if c.Band == "" {
+		return Band2GHz
+	}
+	return c.Band
+}
+
+// security returns the configured security mode, see securityMode.
+func (c HostApdCfg) security() string {
+	return securityMode(c.Security, c.WpaPassphrase)
+}
+
+// pmf returns the configured protected management frame setting, see
+// pmfMode.
+func (c HostApdCfg) pmf() string {
+	return pmfMode(c.Pmf, c.security())
+}
+
+// securityMode returns a security mode, wpa2 with a passphrase and open
+// without one when empty.
+func securityMode(security string, passphrase string) string {
+	switch {
+	case security != "":
+		return security
+	case passphrase != "":
+		return SecurityWpa2
+	}
+	return SecurityOpen
+}
+
+// pmfMode returns a protected management frame setting, by default
+// required where the security mode requires it, optional for transition
+// mode and disabled otherwise.
+func pmfMode(pmf string, security string) string {
+	if pmf != "" {
+		return pmf
+	}
+	switch security {
+	case SecurityWpa3, SecurityOwe, KeyMgmtWpa3Eap:
+		return PmfRequired
+	case SecurityTransition:
+		return PmfOptional
+	}
+	return PmfDisabled
+}
+
+// channel returns the configured channel number, 0 when it is invalid.
+func (c HostApdCfg) channel() int {
+	ch, err := strconv.Atoi(c.Channel)
+	if err != nil {
+		return 0
+	}
+	return ch
+}
+
+// isChannel reports whether ch is a 20MHz channel of a band.
+func isChannel(band string, ch int) bool {
+	if band == Band2GHz {
+		return ch >= 1 && ch <= 14
+	}
+	for _, c := range channels5GHz {
+		if c == ch {
+			return true
+		}
+	}
+	return false
+}
+
+// isDfsChannel reports whether a 5GHz channel needs radar detection.
+func isDfsChannel(ch int) bool {
+	return ch >= 52 && ch <= 144
+}
+
+// ht40Allowed reports whether a 40MHz channel can be formed with the
+// secondary channel above (plus) or below the primary channel ch.
+func ht40Allowed(band string, ch int, plus bool) bool {
+	if band == Band2GHz {
+		if plus {
+			return ch <= 9
+		}
+		return ch >= 5 && ch <= 13
+	}
+
+	// 5GHz channels pair up as 36+40, 44+48, ... and 149+153, ...
+	first := 36
+	if ch >= 149 {
+		first = 149
+	}
+	if ch == 165 || !isChannel(Band5GHz, ch) {
+		return false
+	}
+	lower := (ch-first)/4%2 == 0
+	return lower == plus
+}
+
+// vhtCenter80 returns the center channel of the 80MHz block of a 5GHz
+// channel, 0 when there is none.
+func vhtCenter80(ch int) int {
+	for _, center := range []int{42, 58, 106, 122, 138, 155} {
+		if ch >= center-6 && ch <= center+6 {
+			return center
+		}
+	}
+	return 0
+}
+
+// renderHostApd renders hostapd.conf for the access point interface.
+func renderHostApd(apd HostApdCfg, iface string, ctrlDir string) string {
+	hwMode := "g"
+	if apd.band() == Band5GHz {
+		hwMode = "a"
+	}
+
+	lines := []string{
+		"interface=" + iface,
+		"ssid=" + apd.Ssid,
+		"hw_mode=" + hwMode,
+		"channel=" + apd.Channel,
+	}
+
+	if apd.CountryCode != "" {
+		lines = append(lines, "country_code="+apd.CountryCode, "ieee80211d=1")
+		if apd.band() == Band5GHz && isDfsChannel(apd.channel()) {
+			lines = append(lines, "ieee80211h=1")
+		}
+	}
+
+	if apd.Ieee80211n || apd.Ieee80211ac {
+		lines = append(lines, "wmm_enabled=1", "ieee80211n=1")
+		if apd.HtCapab != "" {
+			lines = append(lines, "ht_capab="+apd.HtCapab)
+		}
+	}
+
+	if apd.Ieee80211ac {
+		lines = append(lines, "ieee80211ac=1")
+		if apd.VhtCapab != "" {
+			lines = append(lines, "vht_capab="+apd.VhtCapab)
+		}
+		lines = append(lines, fmt.Sprintf("vht_oper_chwidth=%d", apd.VhtOperChwidth))
+		center := apd.VhtCenterFreqSeg0
+		if center == 0 && apd.VhtOperChwidth == 1 {
+			center = vhtCenter80(apd.channel())
+		}
+		if center != 0 {
+			lines = append(lines, fmt.Sprintf("vht_oper_centr_freq_seg0_idx=%d", center))
+		}
+	}
+
+	hidden := 0
+	if apd.Hidden {
+		hidden = 1
+	}
+	acl := 0
+	if apd.macAcl() == MacAclAccept {
+		acl = 1
+	}
+	lines = append(lines,
+		fmt.Sprintf("macaddr_acl=%d", acl),
+		"deny_mac_file="+apd.macFile(MacAclDeny),
+		"accept_mac_file="+apd.macFile(MacAclAccept),
+		fmt.Sprintf("ignore_broadcast_ssid=%d", hidden),
+		"disassoc_low_ack=0",
+		"skip_inactivity_poll=1",
+	)
+
+	if apd.MaxStations > 0 {
+		lines = append(lines, fmt.Sprintf("max_num_sta=%d", apd.MaxStations))
+	}
+	if apd.BeaconInterval > 0 {
+		lines = append(lines, fmt.Sprintf("beacon_int=%d", apd.BeaconInterval))
+	}
+	if apd.ApIsolate {
+		lines = append(lines, "ap_isolate=1")
+	}
+
+	lines = append(lines,
+		"ctrl_interface="+ctrlDir,
+		"ctrl_interface_group=0",
+	)
+
+	return strings.Join(append(lines, renderSecurity(apd)...), "\n") + "\n"
+}
+
+// renderSecurity renders the hostapd settings of the security mode.
+func renderSecurity(apd HostApdCfg) []string {
+	var lines []string
+	switch apd.security() {
+	case SecurityOpen:
+		return nil
+	case SecurityOwe:
+		lines = []string{"wpa=2", "wpa_key_mgmt=OWE"}
+	case SecurityWpa2:
+		// hostapd takes a 64 digit hex key as wpa_psk, not as a passphrase
+		key := "wpa_passphrase=" + apd.WpaPassphrase
+		if hexKey.MatchString(apd.WpaPassphrase) {
+			key = "wpa_psk=" + apd.WpaPassphrase
+		}
+		lines = []string{"auth_algs=1", "wpa=2", key, "wpa_key_mgmt=WPA-PSK"}
+	case SecurityWpa3:
+		lines = []string{"auth_algs=1", "wpa=2", "sae_password=" + apd.WpaPassphrase, "wpa_key_mgmt=SAE"}
+	case SecurityTransition:
+		lines = []string{"auth_algs=1", "wpa=2", "wpa_passphrase=" + apd.WpaPassphrase, "wpa_key_mgmt=WPA-PSK SAE"}
+	}
+	lines = append(lines, "rsn_pairwise=CCMP")
+
+	switch apd.pmf() {
+	case PmfOptional:
+		lines = append(lines, "ieee80211w=1")
+	case PmfRequired:
+		lines = append(lines, "ieee80211w=2")
+	}
+	if apd.security() == SecurityWpa3 || apd.security() == SecurityTransition {
+		// WPA3 clients always use PMF, even when WPA2 clients may not
+		lines = append(lines, "sae_require_mfp=1")
+	}
+
+	return lines
+}
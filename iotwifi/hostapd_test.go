@@ -0,0 +1,115 @@
+package iotwifi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderHostApd(t *testing.T) {
+	tests := []struct {
+		name    string
+		apd     HostApdCfg
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "defaults",
+			apd:  HostApdCfg{Ssid: "iot", WpaPassphrase: "iotwifipass", Channel: "6"},
+			want: []string{"interface=uap0\n", "hw_mode=g\n", "channel=6\n", "ignore_broadcast_ssid=0\n",
+				"ctrl_interface=/var/run/hostapd\n", "wpa_passphrase=iotwifipass\n", "wpa_key_mgmt=WPA-PSK\n", "rsn_pairwise=CCMP\n"},
+			notWant: []string{"country_code", "ieee80211", "wmm_enabled", "max_num_sta", "beacon_int", "ap_isolate", "TKIP", "sae"},
+		},
+		{
+			name: "wpa2 with pmf",
+			apd:  HostApdCfg{Ssid: "iot", WpaPassphrase: "iotwifipass", Channel: "6", Pmf: PmfOptional},
+			want: []string{"wpa_key_mgmt=WPA-PSK\n", "ieee80211w=1\n"},
+		},
+		{
+			name:    "wpa2 hex key",
+			apd:     HostApdCfg{Ssid: "iot", WpaPassphrase: strings.Repeat("0123456789abcdef", 4), Channel: "6"},
+			want:    []string{"wpa_psk=" + strings.Repeat("0123456789abcdef", 4) + "\n", "wpa_key_mgmt=WPA-PSK\n"},
+			notWant: []string{"wpa_passphrase"},
+		},
+		{
+			name:    "wpa3",
+			apd:     HostApdCfg{Ssid: "iot", WpaPassphrase: "iotwifipass", Channel: "6", Security: SecurityWpa3},
+			want:    []string{"sae_password=iotwifipass\n", "wpa_key_mgmt=SAE\n", "ieee80211w=2\n", "sae_require_mfp=1\n"},
+			notWant: []string{"wpa_passphrase", "WPA-PSK"},
+		},
+		{
+			name: "transition",
+			apd:  HostApdCfg{Ssid: "iot", WpaPassphrase: "iotwifipass", Channel: "6", Security: SecurityTransition},
+			want: []string{"wpa_passphrase=iotwifipass\n", "wpa_key_mgmt=WPA-PSK SAE\n", "ieee80211w=1\n", "sae_require_mfp=1\n"},
+		},
+		{
+			name:    "owe",
+			apd:     HostApdCfg{Ssid: "iot", Channel: "6", Security: SecurityOwe},
+			want:    []string{"wpa=2\n", "wpa_key_mgmt=OWE\n", "rsn_pairwise=CCMP\n", "ieee80211w=2\n"},
+			notWant: []string{"passphrase", "sae"},
+		},
+		{
+			name: "open",
+			apd:  HostApdCfg{Ssid: "iot", Channel: "6"},
+			want: []string{"ctrl_interface_group=0\n"}, notWant: []string{"wpa"},
+		},
+		{
+			name: "2.4GHz 802.11n",
+			apd:  HostApdCfg{Ssid: "iot", Channel: "1", CountryCode: "US", Ieee80211n: true, HtCapab: "[HT40+][SHORT-GI-20]"},
+			want: []string{"hw_mode=g\n", "country_code=US\n", "ieee80211d=1\n", "wmm_enabled=1\n", "ieee80211n=1\n",
+				"ht_capab=[HT40+][SHORT-GI-20]\n"},
+			notWant: []string{"ieee80211h", "ieee80211ac"},
+		},
+		{
+			name: "5GHz 802.11ac",
+			apd: HostApdCfg{Ssid: "iot", Band: Band5GHz, Channel: "100", CountryCode: "DE", Ieee80211n: true,
+				HtCapab: "[HT40+]", Ieee80211ac: true, VhtCapab: "[SHORT-GI-80]", VhtOperChwidth: 1},
+			want: []string{"hw_mode=a\n", "channel=100\n", "ieee80211h=1\n", "ieee80211ac=1\n", "vht_capab=[SHORT-GI-80]\n",
+				"vht_oper_chwidth=1\n", "vht_oper_centr_freq_seg0_idx=106\n"},
+		},
+		{
+			name: "hidden",
+			apd:  HostApdCfg{Ssid: "iot", Channel: "6", Hidden: true, MaxStations: 4, BeaconInterval: 200, ApIsolate: true},
+			want: []string{"ignore_broadcast_ssid=1\n", "max_num_sta=4\n", "beacon_int=200\n", "ap_isolate=1\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		conf := renderHostApd(tt.apd, "uap0", DefaultApdCtrlDir)
+		for _, want := range tt.want {
+			if !strings.Contains(conf, want) {
+				t.Errorf("%s: missing %q in\n%s", tt.name, want, conf)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(conf, notWant) {
+				t.Errorf("%s: unexpected %q in\n%s", tt.name, notWant, conf)
+			}
+		}
+	}
+}
+
+func TestHt40Allowed(t *testing.T) {
+	tests := []struct {
+		band string
+		ch   int
+		plus bool
+		want bool
+	}{
+		{Band2GHz, 1, true, true},
+		{Band2GHz, 1, false, false},
+		{Band2GHz, 11, true, false},
+		{Band2GHz, 11, false, true},
+		{Band5GHz, 36, true, true},
+		{Band5GHz, 40, true, false},
+		{Band5GHz, 40, false, true},
+		{Band5GHz, 149, true, true},
+		{Band5GHz, 153, false, true},
+		{Band5GHz, 165, true, false},
+	}
+
+	for _, tt := range tests {
+		if got := ht40Allowed(tt.band, tt.ch, tt.plus); got != tt.want {
+			t.Errorf("%s channel %d plus %v: got %v", tt.band, tt.ch, tt.plus, got)
+		}
+	}
+}
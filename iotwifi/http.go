@@ -2,16 +2,20 @@
 
 // todo: update documentation!!!!
 // todo: update Dockerfile
-// todo: listen for shutdown signal, remove uap0, kill wpa,apd,dnsmasq
 
 package iotwifi
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -25,9 +29,19 @@ type ApiReturn struct {
 
 type HttpHandler struct {
 	wpacfg   *WpaCfg
+	apd      *ApdCtrl
 	messages chan CmdMessage
-	signal   chan string
+	manager  *ConnManager
+	jobs     *ConnectJobs
 	disabled bool
+
+	ctx      context.Context // done once Shutdown is called
+	cancel   context.CancelFunc
+	monitors sync.WaitGroup
+
+	cfgMu      sync.Mutex  // serializes configuration changes
+	cfgWatcher *CfgWatcher // of the configuration file, if any
+	cfgRemote  bool        // the configuration is fetched from a URL
 }
 
 func NewHttpHandler(setupCfg *SetupCfg, disabled bool) *HttpHandler {
@@ -35,26 +49,109 @@ func NewHttpHandler(setupCfg *SetupCfg, disabled bool) *HttpHandler {
 
 	//Todo: is a queue of 1 blocking wpa,hostapd,dnsmasq?
 	messages := make(chan CmdMessage, 1)
-	signal := make(chan string, 1)
+	manager := NewConnManager(messages, setupCfg)
 
 	go HandleLog(messages)
-	go RunWifi(messages, signal, setupCfg)
+	go manager.Run()
 	if !disabled {
 		if WpaSupplicantHasNetowrkConfig(setupCfg.WpaSupplicantCfg.CfgFile) {
-			signal <- "CL"
+			manager.Request(ModeClient, "wpa_supplicant has network config")
 		} else {
-			signal <- "AP"
+			manager.Request(ModeAP, "wpa_supplicant has no network config")
 		}
 	}
-	go MonitorWPA(signal)
-	go MonitorAPD(signal, setupCfg.WpaSupplicantCfg.CfgFile)
-
-	return &HttpHandler{
+	ctx, cancel := context.WithCancel(context.Background())
+	apd := NewApdCtrl(setupCfg.HostApdCfg.CtrlInterface, setupCfg.Interfaces.Ap)
+	h := &HttpHandler{
 		wpacfg:   wpacfg,
+		apd:      apd,
 		messages: messages,
-		signal:   signal,
+		manager:  manager,
+		jobs:     NewConnectJobs(),
 		disabled: disabled,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	h.monitor(func() { MonitorWPA(ctx, manager, wpacfg.Ctrl) })
+	h.monitor(func() { MonitorAPD(ctx, manager, apd, setupCfg.WpaSupplicantCfg.CfgFile) })
+	h.monitor(func() { manager.Events.PublishWpaEvents(ctx, wpacfg.Ctrl) })
+	h.monitor(func() { manager.Events.PublishApdEvents(ctx, apd) })
+	if setupCfg.Routing.Enabled {
+		if nat, err := NewNat(setupCfg); err != nil {
+			log.Errorf("not sharing the uplink: %s", err)
+		} else {
+			h.monitor(func() { MonitorNat(ctx, manager, wpacfg.Ctrl, apd, nat) })
+		}
+	}
+
+	return h
+}
+
+// monitor runs fn in a goroutine tracked for Shutdown.
+func (ap *HttpHandler) monitor(fn func()) {
+	ap.monitors.Add(1)
+	go func() {
+		defer ap.monitors.Done()
+		fn()
+	}()
+}
+
+// WatchRemoteCfg refreshes a remote configuration until Shutdown and
+// reloads it when it changes.
+func (ap *HttpHandler) WatchRemoteCfg(remote *RemoteCfg) {
+	ap.cfgMu.Lock()
+	ap.cfgRemote = true
+	ap.cfgMu.Unlock()
+
+	remote.OnChange = func(cfg *SetupCfg) {
+		ap.manager.Reload(cfg, "remote configuration changed")
 	}
+	ap.monitor(func() { remote.Run(ap.ctx) })
+}
+
+// WatchCfgFile watches a configuration file until Shutdown and reloads
+// it when it changes. Changes made through the API are saved to it.
+func (ap *HttpHandler) WatchCfgFile(watcher *CfgWatcher) {
+	ap.cfgMu.Lock()
+	ap.cfgWatcher = watcher
+	ap.cfgMu.Unlock()
+
+	watcher.OnChange = func(cfg *SetupCfg) {
+		ap.manager.Reload(cfg, "configuration file changed")
+	}
+	ap.monitor(func() { watcher.Run(ap.ctx) })
+}
+
+// shuttingDown returns a channel closed once Shutdown is called.
+func (ap *HttpHandler) shuttingDown() <-chan struct{} {
+	if ap.ctx == nil {
+		return nil
+	}
+	return ap.ctx.Done()
+}
+
+// Shutdown closes the event streams, stops the monitors and the
+// connection manager, terminating the daemons it started and removing
+// the AP interface. It returns the context error if ctx is done before
+// everything has stopped.
+func (ap *HttpHandler) Shutdown(ctx context.Context) error {
+	if ap.cancel != nil {
+		ap.cancel()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		ap.monitors.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Warn("monitors did not stop in time")
+	}
+
+	return ap.manager.Shutdown(ctx)
 }
 
 func apiPayloadReturn(w http.ResponseWriter, message string, payload interface{}) {
@@ -70,12 +167,12 @@ func apiPayloadReturn(w http.ResponseWriter, message string, payload interface{}
 }
 
 // marshallPost populates a struct with json in post body
-func marshallPost(w http.ResponseWriter, r *http.Request, v interface{}) {
+func marshallPost(w http.ResponseWriter, r *http.Request, v interface{}) error {
 	bytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Error(err)
-		return
+		return err
 	}
 
 	defer r.Body.Close()
@@ -86,19 +183,29 @@ func marshallPost(w http.ResponseWriter, r *http.Request, v interface{}) {
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Error(err)
-		return
+		return err
 	}
+
+	return nil
 }
 
-// common error return from api
+// common error return from api, validation errors are returned in the
+// payload with 400 Bad Request
 func retError(w http.ResponseWriter, err error) {
 	apiReturn := &ApiReturn{
 		Status:  "FAIL",
 		Message: err.Error(),
 	}
+	status := http.StatusOK
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		apiReturn.Payload = errs
+		status = http.StatusBadRequest
+	}
 	ret, _ := json.Marshal(apiReturn)
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(ret)
 }
 
@@ -113,16 +220,42 @@ func (ap *HttpHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 // handle /connect POSTs json in the form of WpaConnect
 func (ap *HttpHandler) ConnectHandler(w http.ResponseWriter, r *http.Request) {
 	var creds WpaCredentials
-	marshallPost(w, r, &creds)
+	if err := marshallPost(w, r, &creds); err != nil {
+		return
+	}
 
-	log.Info("Connect Handler Got: ssid:|%s| psk:|redacted|", creds.Ssid)
+	log.Infof("Connect Handler Got: ssid:|%s| psk:|redacted| key_mgmt:|%s|", creds.Ssid, creds.KeyMgmt)
+
+	if err := creds.Validate(); err != nil {
+		retError(w, err)
+		return
+	}
+	if err := ap.wpacfg.checkCerts(creds); err != nil {
+		retError(w, err)
+		return
+	}
 
-	go ap.wpacfg.ConnectNetwork(creds)
+	job := ap.jobs.New(creds.Ssid)
+	ap.manager.Events.Publish(EventConnection, job)
+
+	go func() {
+		connection, err := ap.wpacfg.ConnectNetworkProgress(creds, func(stage ConnectStage, wpaState string) {
+			if updated, ok := ap.jobs.Progress(job.Id, stage, wpaState); ok {
+				ap.manager.Events.Publish(EventConnection, updated)
+			}
+		})
+		if err != nil {
+			log.Warnf("connect to %s failed: %s", creds.Ssid, err)
+		}
+		if finished, ok := ap.jobs.Finish(job.Id, connection); ok {
+			ap.manager.Events.Publish(EventConnection, finished)
+		}
+	}()
 
 	apiReturn := &ApiReturn{
 		Status:  "OK",
-		Message: "Connection",
-		Payload: "Attempting to connect to " + creds.Ssid,
+		Message: "Attempting to connect to " + creds.Ssid,
+		Payload: job,
 	}
 
 	ret, err := json.Marshal(apiReturn)
@@ -133,10 +266,369 @@ func (ap *HttpHandler) ConnectHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(ret)
-	ap.signal <- "CL"
+	ap.manager.Request(ModeClient, "connect requested for "+creds.Ssid)
+}
+
+// handle /connect/{id} returns the progress and result of a connect job
+func (ap *HttpHandler) ConnectStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathId(r)
+	job, ok := ap.jobs.Get(id)
+	if !ok {
+		retError(w, fmt.Errorf("no connect job %s", id))
+		return
+	}
+
+	apiPayloadReturn(w, "Connection", job)
+}
+
+// handle GET /networks lists the saved networks
+func (ap *HttpHandler) NetworksHandler(w http.ResponseWriter, r *http.Request) {
+	networks, err := ap.wpacfg.ListNetworks()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	apiPayloadReturn(w, "Networks", networks)
+}
+
+// handle POST /networks saves a network in the form of WpaCredentials
+// without connecting to it
+func (ap *HttpHandler) AddNetworkHandler(w http.ResponseWriter, r *http.Request) {
+	var creds WpaCredentials
+	if err := marshallPost(w, r, &creds); err != nil {
+		return
+	}
+
+	log.Infof("Add Network Handler Got: ssid:|%s| psk:|redacted| key_mgmt:|%s| priority:|%d|", creds.Ssid, creds.KeyMgmt, creds.Priority)
+
+	network, err := ap.wpacfg.AddNetwork(creds)
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	apiPayloadReturn(w, "Added network "+network.Id, network)
+}
+
+// handle PUT /networks/{id} changes a saved network in the form of
+// WpaNetworkUpdate
+func (ap *HttpHandler) UpdateNetworkHandler(w http.ResponseWriter, r *http.Request) {
+	var update WpaNetworkUpdate
+	if err := marshallPost(w, r, &update); err != nil {
+		return
+	}
+
+	network, err := ap.wpacfg.UpdateNetwork(pathId(r), update)
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	apiPayloadReturn(w, "Updated network "+network.Id, network)
+}
+
+// handle DELETE /networks/{id} forgets a saved network
+func (ap *HttpHandler) ForgetNetworkHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathId(r)
+	if _, err := ap.wpacfg.GetNetwork(id); err != nil {
+		retError(w, err)
+		return
+	}
+
+	if err := ap.wpacfg.DisconnectNetwork(id); err != nil {
+		retError(w, err)
+		return
+	}
+
+	apiPayloadReturn(w, "Forgot network "+id, nil)
+}
+
+// handle GET /certs lists the uploaded certificates and keys
+func (ap *HttpHandler) CertsHandler(w http.ResponseWriter, r *http.Request) {
+	certs, err := ap.wpacfg.Certs.List()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	apiPayloadReturn(w, "Certificates", certs)
 }
 
-// scan for wifi networks
+// handle PUT /certs/{name} stores the PEM or DER certificate, PEM private
+// key or .p12 bundle in the body for enterprise networks to reference
+func (ap *HttpHandler) UploadCertHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCertSize+1))
+	if err != nil {
+		retError(w, fmt.Errorf("%w: %s", ErrInvalidCert, err))
+		return
+	}
+
+	name := pathId(r)
+	log.Infof("Upload Cert Handler Got: name:|%s| size:|%d|", name, len(data))
+
+	info, err := ap.wpacfg.Certs.Save(name, data)
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	apiPayloadReturn(w, "Stored "+name, info)
+}
+
+// handle DELETE /certs/{name} removes an uploaded certificate or key
+func (ap *HttpHandler) DeleteCertHandler(w http.ResponseWriter, r *http.Request) {
+	name := pathId(r)
+	if err := ap.wpacfg.Certs.Remove(name); err != nil {
+		retError(w, err)
+		return
+	}
+
+	apiPayloadReturn(w, "Removed "+name, nil)
+}
+
+// handle GET /ap/config returns the access point configuration without
+// the passphrase
+func (ap *HttpHandler) ApConfigHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := ap.manager.Config()
+	apiPayloadReturn(w, "Access point configuration", NewApCfg(cfg.HostApdCfg))
+}
+
+// handle PUT /ap/config changes the access point configuration with a
+// partial HostApdCfg, saves it to the configuration file and applies it
+func (ap *HttpHandler) UpdateApConfigHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	update, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxApCfgSize))
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	ap.cfgMu.Lock()
+	defer ap.cfgMu.Unlock()
+
+	switch {
+	case ap.cfgRemote:
+		retError(w, fmt.Errorf("%w: it is fetched from a URL, change it on the server", ErrCfgReadOnly))
+		return
+	case CfgPublicKeys != "":
+		retError(w, fmt.Errorf("%w: it is signed, sign and ship a new one", ErrCfgReadOnly))
+		return
+	}
+
+	cfg := ap.manager.Config()
+	if err := UpdateApCfg(&cfg, update); err != nil {
+		retError(w, err)
+		return
+	}
+
+	message := "Access point configuration updated"
+	if ap.cfgWatcher != nil {
+		if err := saveHostApdCfg(ap.cfgWatcher, cfg.HostApdCfg); err != nil {
+			retError(w, err)
+			return
+		}
+	} else {
+		message += ", not saved without a configuration file"
+	}
+
+	log.Infof("AP Config Handler Got: ssid:|%s| psk:|redacted| channel:|%s| ip:|%s|", cfg.HostApdCfg.Ssid, cfg.HostApdCfg.Channel, cfg.HostApdCfg.Ip)
+	ap.manager.Reload(&cfg, "access point configuration changed through the API")
+
+	apiPayloadReturn(w, message, NewApCfg(cfg.HostApdCfg))
+}
+
+// handle GET /ap/stations lists the stations associated with the access
+// point along with their DHCP leases
+func (ap *HttpHandler) StationsHandler(w http.ResponseWriter, r *http.Request) {
+	all, err := ap.apd.AllSta()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	leases := ap.leases()
+	stations := make([]ApStation, len(all))
+	for i, sta := range all {
+		stations[i] = newApStation(sta, leases)
+	}
+
+	apiPayloadReturn(w, "Stations", stations)
+}
+
+// handle GET /ap/stations/{mac} returns a station with everything hostapd
+// reports about it
+func (ap *HttpHandler) StationHandler(w http.ResponseWriter, r *http.Request) {
+	mac, err := parseMac(pathId(r))
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	sta, err := ap.apd.Sta(mac)
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	station := newApStation(sta, ap.leases())
+	station.Info = sta.Info
+	apiPayloadReturn(w, "Station "+mac, station)
+}
+
+// handle DELETE /ap/stations/{mac} disconnects a station, which may
+// connect again unless it is denied
+func (ap *HttpHandler) KickStationHandler(w http.ResponseWriter, r *http.Request) {
+	mac, err := parseMac(pathId(r))
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	log.Infof("Kick Station Handler Got: mac:|%s|", mac)
+	if err := ap.apd.Deauthenticate(mac); err != nil {
+		retError(w, err)
+		return
+	}
+
+	apiPayloadReturn(w, "Disconnected "+mac, nil)
+}
+
+// handle GET /ap/leases lists the DHCP leases dnsmasq handed out on the
+// access point network
+func (ap *HttpHandler) LeasesHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := ap.manager.Config()
+	leases, err := ReadLeases(cfg.DnsmasqCfg.leaseFile())
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	apiPayloadReturn(w, "Leases", leases)
+}
+
+// leases returns the DHCP leases by MAC address, none when they can not
+// be read.
+func (ap *HttpHandler) leases() map[string]DhcpLease {
+	cfg := ap.manager.Config()
+	leases, err := ReadLeases(cfg.DnsmasqCfg.leaseFile())
+	if err != nil {
+		log.Warnf("Could not read DHCP leases: %s", err)
+	}
+	return leasesByMac(leases)
+}
+
+// handle GET /ap/acl returns the MAC address policy with the deny and
+// accept lists
+func (ap *HttpHandler) AclHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := ap.manager.Config()
+	acl, err := cfg.HostApdCfg.readAcl()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	apiPayloadReturn(w, "MAC address access control", acl)
+}
+
+// handle PUT /ap/acl/deny/{mac} denies a station and disconnects it
+func (ap *HttpHandler) AddDenyMacHandler(w http.ResponseWriter, r *http.Request) {
+	ap.editAcl(w, r, MacAclDeny, true)
+}
+
+// handle DELETE /ap/acl/deny/{mac} no longer denies a station
+func (ap *HttpHandler) RemoveDenyMacHandler(w http.ResponseWriter, r *http.Request) {
+	ap.editAcl(w, r, MacAclDeny, false)
+}
+
+// handle PUT /ap/acl/accept/{mac} accepts a station when the policy is
+// accept
+func (ap *HttpHandler) AddAcceptMacHandler(w http.ResponseWriter, r *http.Request) {
+	ap.editAcl(w, r, MacAclAccept, true)
+}
+
+// handle DELETE /ap/acl/accept/{mac} no longer accepts a station,
+// disconnecting it when the policy is accept
+func (ap *HttpHandler) RemoveAcceptMacHandler(w http.ResponseWriter, r *http.Request) {
+	ap.editAcl(w, r, MacAclAccept, false)
+}
+
+// editAcl adds a station to or removes it from a MAC list. The list file
+// is what persists; a running hostapd is updated as well and reads the
+// file when it starts otherwise.
+func (ap *HttpHandler) editAcl(w http.ResponseWriter, r *http.Request, list string, add bool) {
+	mac, err := parseMac(pathId(r))
+	if err != nil {
+		retError(w, err)
+		return
+	}
+	log.Infof("ACL Handler Got: list:|%s| mac:|%s| add:|%t|", list, mac, add)
+
+	ap.cfgMu.Lock()
+	defer ap.cfgMu.Unlock()
+
+	cfg := ap.manager.Config().HostApdCfg
+	changed, err := editMacFile(cfg.macFile(list), mac, add)
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	if changed {
+		if add {
+			err = ap.apd.AclAddMac(list, mac)
+		} else {
+			err = ap.apd.AclDelMac(list, mac)
+		}
+		if err != nil {
+			log.Debugf("hostapd %s list not updated: %s", list, err)
+		}
+	}
+
+	// not every hostapd version disconnects stations that are no
+	// longer allowed
+	if (add && list == MacAclDeny) || (!add && list == MacAclAccept && cfg.macAcl() == MacAclAccept) {
+		ap.apd.Deauthenticate(mac)
+	}
+
+	acl, err := cfg.readAcl()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	message := fmt.Sprintf("Added %s to the %s list", mac, list)
+	if !add {
+		message = fmt.Sprintf("Removed %s from the %s list", mac, list)
+	}
+	apiPayloadReturn(w, message, acl)
+}
+
+// pathId returns the last element of the request path, the {id} of
+// routes like /connect/{id}, independent of the router in use.
+func pathId(r *http.Request) string {
+	return path.Base(strings.TrimSuffix(r.URL.Path, "/"))
+}
+
+// handle /state returns the connection manager state, recent transitions
+// and the status of the supervised daemons
+func (ap *HttpHandler) StateHandler(w http.ResponseWriter, r *http.Request) {
+	state := map[string]interface{}{
+		"state":       ap.manager.State(),
+		"transitions": ap.manager.Transitions(),
+		"daemons":     ap.manager.Daemons(),
+	}
+	if last, ok := ap.manager.LastTransition(); ok {
+		state["reason"] = last.Reason
+	}
+
+	apiPayloadReturn(w, "state", state)
+}
+
+// handle /scan returns every BSS found as a list of WpaNetwork, strongest
+// first. This replaced the object keyed by SSID of the iwlist scan, which
+// kept only one BSS of each network.
 func (ap *HttpHandler) ScanHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info("Got Scan")
 	wpaNetworks, err := ap.wpacfg.ScanNetworks()
@@ -144,6 +636,7 @@ func (ap *HttpHandler) ScanHandler(w http.ResponseWriter, r *http.Request) {
 		retError(w, err)
 		return
 	}
+	ap.manager.Events.Publish(EventScan, wpaNetworks)
 
 	apiReturn := &ApiReturn{
 		Status:  "OK",
@@ -161,18 +654,121 @@ func (ap *HttpHandler) ScanHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(ret)
 }
 
+// eventKeepAlive is how often an idle event stream is pinged.
+const eventKeepAlive = 15 * time.Second
+
+// handle /events streams events as Server-Sent Events, or as websocket
+// text messages when the request asks for a websocket upgrade.
+func (ap *HttpHandler) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if isWebsocketRequest(r) {
+		ap.websocketEvents(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := ap.manager.Events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ap.shuttingDown():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// websocketEvents streams events over a websocket.
+func (ap *HttpHandler) websocketEvents(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebsocket(w, r)
+	switch {
+	case err == errNotWebsocket:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == errNoHijack:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case err != nil:
+		// the connection is no longer ours to answer on
+		log.Errorf("websocket upgrade: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	events, cancel := ap.manager.Events.Subscribe()
+	defer cancel()
+
+	closed := make(chan struct{})
+	go func() {
+		conn.readLoop()
+		close(closed)
+	}()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ap.shuttingDown():
+			conn.writeFrame(wsOpClose, nil)
+			return
+		case <-keepAlive.C:
+			if err := conn.writeFrame(wsOpPing, nil); err != nil {
+				return
+			}
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if err := conn.WriteText(data); err != nil {
+				return
+			}
+		}
+	}
+}
+
 // kill the application
 func (ap *HttpHandler) ResetHandler(w http.ResponseWriter, r *http.Request) {
 	apiReturn := &ApiReturn{
 		Status:  "OK",
-		Message: "Disconnected from configured network",
+		Message: "Disconnected from configured networks",
 	}
 
-	if err := ap.wpacfg.DisconnectNetwork("0"); err != nil {
+	if err := ap.wpacfg.DisconnectNetwork("all"); err != nil {
 		apiReturn.Status = "FAILED"
 		apiReturn.Message = fmt.Sprintf("Failed %s", err)
 	} else {
-		ap.signal <- "AP"
+		ap.manager.Request(ModeAP, "reset requested")
 	}
 
 	ret, err := json.Marshal(apiReturn)
@@ -187,7 +783,7 @@ func (ap *HttpHandler) ResetHandler(w http.ResponseWriter, r *http.Request) {
 
 // kill the application
 func (ap *HttpHandler) StopHandler(w http.ResponseWriter, r *http.Request) {
-	ap.signal <- "OFF"
+	ap.manager.Request(ModeOff, "stop requested")
 
 	apiReturn := &ApiReturn{
 		Status:  "OK",
@@ -205,7 +801,7 @@ func (ap *HttpHandler) StopHandler(w http.ResponseWriter, r *http.Request) {
 
 // kill the application
 func (ap *HttpHandler) StartHandler(w http.ResponseWriter, r *http.Request) {
-	ap.signal <- "AP"
+	ap.manager.Request(ModeAP, "start requested")
 
 	apiReturn := &ApiReturn{
 		Status:  "OK",
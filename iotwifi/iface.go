@@ -0,0 +1,86 @@
+package iotwifi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Interface names used when nothing is configured or discovered.
+const (
+	DefaultPhy              = "phy0"
+	DefaultStationInterface = "wlan0"
+	DefaultApInterface      = "uap0"
+)
+
+// sysIeee80211Dir lists the wireless phys, one directory each.
+var sysIeee80211Dir = "/sys/class/ieee80211"
+
+// DiscoverInterfaces fills in the interface names left empty in the
+// configuration. The phy is the one owning the station interface, or
+// the first phy found; the station interface is the first network
+// device of that phy other than the AP interface.
+func (s *SetupCfg) DiscoverInterfaces() {
+	ifaces := discoverInterfaces(sysIeee80211Dir, s.Interfaces)
+	if ifaces != s.Interfaces {
+		log.Infof("Using phy %s, station interface %s, AP interface %s", ifaces.Phy, ifaces.Station, ifaces.Ap)
+		s.Interfaces = ifaces
+	}
+}
+
+// discoverInterfaces resolves empty names in cfg from the phys in root.
+func discoverInterfaces(root string, cfg InterfaceCfg) InterfaceCfg {
+	if cfg.Ap == "" {
+		cfg.Ap = DefaultApInterface
+	}
+
+	phys := listDir(root)
+
+	if cfg.Phy == "" && cfg.Station != "" {
+		for _, phy := range phys {
+			if _, err := os.Stat(filepath.Join(root, phy, "device", "net", cfg.Station)); err == nil {
+				cfg.Phy = phy
+				break
+			}
+		}
+	}
+	if cfg.Phy == "" && len(phys) > 0 {
+		cfg.Phy = phys[0]
+	}
+	if cfg.Phy == "" {
+		cfg.Phy = DefaultPhy
+	}
+
+	if cfg.Station == "" {
+		for _, iface := range listDir(filepath.Join(root, cfg.Phy, "device", "net")) {
+			if iface != cfg.Ap {
+				cfg.Station = iface
+				break
+			}
+		}
+	}
+	if cfg.Station == "" {
+		cfg.Station = DefaultStationInterface
+	}
+
+	return cfg
+}
+
+// listDir returns the sorted entry names of dir, nil if it is unreadable.
+func listDir(dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,49 @@
+package iotwifi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSysfs creates a /sys/class/ieee80211 layout with the given
+// network devices per phy.
+func fakeSysfs(t *testing.T, phys map[string][]string) string {
+	root := t.TempDir()
+	for phy, ifaces := range phys {
+		net := filepath.Join(root, phy, "device", "net")
+		if err := os.MkdirAll(net, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, iface := range ifaces {
+			os.Mkdir(filepath.Join(net, iface), 0755)
+		}
+	}
+	return root
+}
+
+func TestDiscoverInterfaces(t *testing.T) {
+	root := fakeSysfs(t, map[string][]string{
+		"phy0": {"uap0", "wlan0"},
+		"phy1": {"wlan1"},
+	})
+
+	tests := []struct {
+		name string
+		root string
+		cfg  InterfaceCfg
+		want InterfaceCfg
+	}{
+		{"first phy", root, InterfaceCfg{}, InterfaceCfg{"phy0", "wlan0", "uap0"}},
+		{"phy of station", root, InterfaceCfg{Station: "wlan1"}, InterfaceCfg{"phy1", "wlan1", "uap0"}},
+		{"station of phy", root, InterfaceCfg{Phy: "phy1", Ap: "uap1"}, InterfaceCfg{"phy1", "wlan1", "uap1"}},
+		{"configured", root, InterfaceCfg{"phy3", "wlan3", "ap3"}, InterfaceCfg{"phy3", "wlan3", "ap3"}},
+		{"no sysfs", filepath.Join(root, "missing"), InterfaceCfg{}, InterfaceCfg{DefaultPhy, DefaultStationInterface, DefaultApInterface}},
+	}
+
+	for _, tt := range tests {
+		if got := discoverInterfaces(tt.root, tt.cfg); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
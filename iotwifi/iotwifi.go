@@ -6,15 +6,18 @@ package iotwifi
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os/exec"
-	"regexp"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -24,7 +27,11 @@ import (
 type CmdRunner struct {
 	Messages chan CmdMessage
 	Handlers map[string]func(CmdMessage)
-	Commands map[string]*exec.Cmd
+	Commands map[string]Process
+	Executor Executor
+
+	mu     sync.Mutex
+	closed bool
 }
 
 // CmdMessage structures command output.
@@ -33,217 +40,252 @@ type CmdMessage struct {
 	Command string
 	Message string
 	Error   bool
-	Cmd     *exec.Cmd
+	Process Process
 	Stdin   *io.WriteCloser
 }
 
-func hostAPdConfig(setupCfg *SetupCfg) {
-	cfg := `interface=uap0
-ssid=` + setupCfg.HostApdCfg.Ssid + `
-hw_mode=g
-channel=` + setupCfg.HostApdCfg.Channel + `
-macaddr_acl=0
-ignore_broadcast_ssid=0
-disassoc_low_ack=0
-skip_inactivity_poll=1
-ctrl_interface=/var/run/hostapd
-ctrl_interface_group=0`
-
-	if setupCfg.HostApdCfg.WpaPassphrase != "" {
-		cfg = fmt.Sprintf(`%s
-auth_algs=1
-wpa=2
-wpa_passphrase=%s
-wpa_key_mgmt=WPA-PSK
-wpa_pairwise=TKIP
-rsn_pairwise=CCMP
-`, cfg, setupCfg.HostApdCfg.WpaPassphrase)
+// DefaultHostApdCfgFile is where hostAPdConfig writes the hostapd
+// configuration unless HostApdCfg.CfgFile is set.
+const DefaultHostApdCfgFile = "/etc/hostapd/hostapd.conf"
+
+// hostAPdConfig writes the hostapd configuration with the Ssid and
+// WpaPassphrase templates executed for this device, see DeviceInfo.
+func hostAPdConfig(setupCfg *SetupCfg) error {
+	apd := setupCfg.HostApdCfg
+	if isTemplate(apd.Ssid) || isTemplate(apd.WpaPassphrase) {
+		var err error
+		if apd, err = apd.Expand(ReadDeviceInfo(setupCfg.Interfaces.Station)); err != nil {
+			return err
+		}
 	}
 
-	err := ioutil.WriteFile("/etc/hostapd/hostapd.conf", []byte(cfg), 0600)
-	if err != nil {
-		panic(err)
+	ctrlDir := apd.CtrlInterface
+	if ctrlDir == "" {
+		ctrlDir = DefaultApdCtrlDir
 	}
 
+	cfgFile := apd.CfgFile
+	if cfgFile == "" {
+		cfgFile = DefaultHostApdCfgFile
+	}
+
+	for _, list := range []string{MacAclDeny, MacAclAccept} {
+		if err := ensureMacFile(apd.macFile(list)); err != nil {
+			return err
+		}
+	}
+
+	cfg := renderHostApd(apd, setupCfg.Interfaces.Ap, ctrlDir)
+	return ioutil.WriteFile(cfgFile, []byte(cfg), 0600)
 }
 
-// loadCfg loads the configuration.
+// cfgFetchTimeout bounds fetching a configuration over HTTP.
+var cfgFetchTimeout = 30 * time.Second
+
+// LoadCfg loads the configuration from a file or an http(s) URL and
+// validates it. Validation problems are returned as ValidationErrors
+// along with the decoded configuration. When CfgPublicKeys are baked in
+// the configuration must be signed, see LoadSignedCfg.
 func LoadCfg(cfgLocation string) (*SetupCfg, error) {
+	verifier, err := bakedCfgVerifier()
+	if err != nil {
+		return nil, err
+	}
 
-	v := &SetupCfg{}
-	var jsonData []byte
+	return LoadSignedCfg(cfgLocation, verifier)
+}
 
-	urlDelimR, _ := regexp.Compile("://")
-	isUrl := urlDelimR.Match([]byte(cfgLocation))
+// LoadSignedCfg loads a configuration like LoadCfg and, unless verifier
+// is nil, rejects it unless the signature at CfgSigLocation is valid.
+func LoadSignedCfg(cfgLocation string, verifier *CfgVerifier) (*SetupCfg, error) {
+	jsonData, err := readCfg(cfgLocation)
+	if err != nil {
+		return nil, err
+	}
 
-	// if not a url
-	if !isUrl {
-		fileData, err := ioutil.ReadFile(cfgLocation)
+	if verifier != nil {
+		sigLocation := CfgSigLocation(cfgLocation)
+		sig, err := readCfg(sigLocation)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("%w: no signature at %s: %s", ErrCfgSignature, sigLocation, err)
+		}
+		if err := verifier.Verify(jsonData, sig); err != nil {
+			return nil, err
 		}
-		jsonData = fileData
 	}
 
-	if isUrl {
-		res, err := http.Get(cfgLocation)
-		if err != nil {
-			panic(err)
-		}
+	return ParseCfg(jsonData)
+}
 
-		defer res.Body.Close()
+// ParseCfg decodes and validates a JSON configuration.
+func ParseCfg(jsonData []byte) (*SetupCfg, error) {
+	v := &SetupCfg{}
+	if err := json.Unmarshal(jsonData, v); err != nil {
+		return nil, fmt.Errorf("decoding configuration: %w", err)
+	}
 
-		urlData, err := ioutil.ReadAll(res.Body)
+	return v, v.Validate()
+}
+
+// readCfg reads a configuration file or fetches it when cfgLocation is
+// a URL.
+func readCfg(cfgLocation string) ([]byte, error) {
+	if !IsCfgUrl(cfgLocation) {
+		fileData, err := ioutil.ReadFile(cfgLocation)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("reading configuration: %w", err)
 		}
+		return fileData, nil
+	}
 
-		jsonData = urlData
+	client := &http.Client{Timeout: cfgFetchTimeout}
+	res, err := client.Get(cfgLocation)
+	if err != nil {
+		return nil, fmt.Errorf("fetching configuration: %w", err)
 	}
+	defer res.Body.Close()
 
-	err := json.Unmarshal(jsonData, v)
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching configuration: %s returned %s", cfgLocation, res.Status)
+	}
 
-	return v, err
+	urlData, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching configuration: %w", err)
+	}
+
+	return urlData, nil
 }
 
-func MonitorAPD(signal chan<- string, wpaSupplicantConfig string) {
-	var apdTimeout int64 = 90
+// MonitorAPD switches to client mode when the access point has had no
+// stations for the timeout and wpa_supplicant has a network to join. It
+// reacts to hostapd station events with a slow periodic check as backup,
+// until ctx is done.
+func MonitorAPD(ctx context.Context, manager *ConnManager, apd *ApdCtrl, wpaSupplicantConfig string) {
+	var apdTimeout = 90 * time.Second
 	staticFields := make(map[string]interface{})
 	staticFields["cmd_id"] = " ~~ apd monitor ~~"
 	log.Info(staticFields, "Start.")
-	for {
-		apd := apdState("uap0")
-		if apd == "ENABLED" {
-			startTime := time.Now().Unix()
-			log.Info(staticFields, apd+", timeout in "+strconv.FormatInt(apdTimeout, 10)+" seconds")
-			for {
-				apd = apdState("uap0")
-				if startTime+apdTimeout < time.Now().Unix() {
-					//check to see if APD has clients, if yes, reset timer
-					if apdHasClient("uap0") {
-						log.Info(staticFields, "has client(s), timeout aborted")
-						break
-					}
-					//check to see if WPA has any networks configured, if none, reset timer
-					if !WpaSupplicantHasNetowrkConfig(wpaSupplicantConfig) {
-						log.Info(staticFields, "wpa_supplicant has no network config, timeout aborted")
-						break
-					}
-					log.Info(staticFields, "Timeout.")
-					signal <- "CL"
-					break
-				}
-				if apd != "ENABLED" {
-					log.Info(staticFields, apd+" timeout aborted ")
-					break
-				}
-				time.Sleep(1 * time.Second)
-			}
+
+	events := apd.ApdEvents(ctx)
+	check := time.NewTicker(30 * time.Second)
+	defer check.Stop()
+	timeout := time.NewTimer(apdTimeout)
+	timeout.Stop()
+	pending := false
+
+	disarm := func(reason string) {
+		if pending {
+			log.Info(staticFields, reason+", timeout aborted")
+			pending = false
+			timeout.Stop()
 		}
-		time.Sleep(30 * time.Second)
 	}
 
-}
+	evaluate := func() {
+		apdState, err := apd.State()
+		if err != nil || apdState != "ENABLED" {
+			disarm("hostapd not enabled")
+			return
+		}
+		if apd.HasStations() {
+			disarm("has client(s)")
+			return
+		}
+		if !pending {
+			log.Info(staticFields, apdState+", timeout in "+strconv.FormatInt(int64(apdTimeout/time.Second), 10)+" seconds")
+			pending = true
+			timeout.Reset(apdTimeout)
+		}
+	}
 
-func MonitorWPA(signal chan<- string) {
-	var wpaTimeout int64 = 90
-	staticFields := make(map[string]interface{})
-	staticFields["cmd_id"] = " ~~ wpa monitor ~~"
-	log.Info(staticFields, "Start.")
+	evaluate()
 	for {
-		wpa := wpaState("wlan0")
-		if wpa != "COMPLETED" && wpa != "NONE" {
-			startTime := time.Now().Unix()
-			log.Info(staticFields, wpa+", timeout in "+strconv.FormatInt(wpaTimeout, 10)+" seconds")
-			for {
-				wpa = wpaState("wlan0")
-				if startTime+wpaTimeout < time.Now().Unix() {
-					log.Info(staticFields, "Timeout.")
-					signal <- "AP"
-					break
-				}
-				if wpa == "COMPLETED" {
-					log.Info(staticFields, wpa+" timeout aborted")
-					break
-				}
-				time.Sleep(1 * time.Second)
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				log.Info(staticFields, "Stop.")
+				return
+			}
+			if ev.Type == ApdStaConnected {
+				log.Info(staticFields, "station connected: "+ev.Mac)
 			}
+			if ev.Type == ApdStaDisconnected {
+				log.Info(staticFields, "station disconnected: "+ev.Mac)
+			}
+			evaluate()
+		case <-check.C:
+			evaluate()
+		case <-timeout.C:
+			pending = false
+			//check to see if APD has clients, if yes, wait for them to leave
+			if apd.HasStations() {
+				log.Info(staticFields, "has client(s), timeout aborted")
+				continue
+			}
+			//check to see if WPA has any networks configured, if none, start over
+			if !WpaSupplicantHasNetowrkConfig(wpaSupplicantConfig) {
+				log.Info(staticFields, "wpa_supplicant has no network config, timeout aborted")
+				evaluate()
+				continue
+			}
+			log.Info(staticFields, "Timeout.")
+			manager.RequestFrom(StateAP, ModeClient, "no stations on access point before timeout")
 		}
-		time.Sleep(30 * time.Second)
 	}
 }
 
-// RunWifi starts AP and Station modes.
-func RunWifi(messages chan CmdMessage, signal chan string, setupCfg *SetupCfg) {
+// MonitorWPA falls back to AP mode when wpa_supplicant is running but has
+// not completed a connection within the timeout. It is driven by
+// wpa_supplicant control events with a slow periodic check as backup,
+// until ctx is done.
+func MonitorWPA(ctx context.Context, manager *ConnManager, wpa *WpaCtrl) {
+	var wpaTimeout = 90 * time.Second
 	staticFields := make(map[string]interface{})
+	staticFields["cmd_id"] = " ~~ wpa monitor ~~"
+	log.Info(staticFields, "Start.")
 
-	log.Info("Loading IoT Wifi...")
-
-	cmdRunner := CmdRunner{
-		Messages: messages,
-		Handlers: make(map[string]func(cmsg CmdMessage), 0),
-		Commands: make(map[string]*exec.Cmd, 0),
-	}
-
-	command := &Command{
-		Runner:   cmdRunner,
-		SetupCfg: setupCfg,
+	events := wpa.Events(ctx)
+	check := time.NewTicker(30 * time.Second)
+	defer check.Stop()
+	timeout := time.NewTimer(wpaTimeout)
+	timeout.Stop()
+	pending := false
+
+	evaluate := func() {
+		wpaState, err := wpa.State()
+		if err != nil || wpaState == "COMPLETED" {
+			if pending {
+				log.Info(staticFields, "timeout aborted")
+				pending = false
+				timeout.Stop()
+			}
+			return
+		}
+		if !pending {
+			log.Info(staticFields, wpaState+", timeout in "+strconv.FormatInt(int64(wpaTimeout/time.Second), 10)+" seconds")
+			pending = true
+			timeout.Reset(wpaTimeout)
+		}
 	}
 
+	evaluate()
 	for {
-		mode := <-signal
-		log.Info(staticFields, "Signal: "+mode)
-		if mode == "AP" {
-			log.Info(staticFields, "-=-=-=- start Access Point -=-=-=-")
-			command.killIt("wpa_supplicant")
-			command.killIt("hostapd")
-			command.killIt("dnsmasq")
-			log.Info(staticFields, "... wait for wpa_supplicant to finish")
-			for {
-				if wpaState("wlan0") == "NONE" {
-					log.Info(staticFields, "wpa_supplicant finished")
-					break
-				}
+		select {
+		case _, ok := <-events:
+			if !ok {
+				log.Info(staticFields, "Stop.")
+				return
 			}
-			command.RemoveApInterface()
-			command.AddApInterface()
-			command.UpApInterface()
-			command.ConfigureApInterface()
-			hostAPdConfig(setupCfg)
-			command.StartHostAPD() //hostapd
-			log.Info(staticFields, "... wait for host_apd to start")
-			for {
-				if apdState("uap0") != "NONE" {
-					log.Info(staticFields, "host_apd started")
-					break
-				}
+			evaluate()
+		case <-check.C:
+			evaluate()
+		case <-timeout.C:
+			pending = false
+			if wpaState, err := wpa.State(); err == nil && wpaState != "COMPLETED" {
+				log.Info(staticFields, "Timeout.")
+				manager.RequestFrom(StateClient, ModeAP, "wpa_supplicant did not complete a connection before timeout")
 			}
-			command.StartDnsmasq() //dnsmasq
-		}
-		if mode == "CL" {
-			if wpaState("wlan0") != "NONE" {
-				log.Info(staticFields, "-=-=-=- client already started. -=-=-=-")
-				continue
-			}
-			log.Info(staticFields, "-=-=-=- start Client -=-=-=-")
-			command.killIt("wpa_supplicant")
-			command.killIt("hostapd")
-			command.killIt("dnsmasq")
-			log.Info(staticFields, "... wait for host_apd to finish")
-			for {
-				if apdState("uap0") == "NONE" {
-					log.Info(staticFields, "host_apd finished")
-					break
-				}
-			}
-			command.RemoveApInterface()
-			command.StartWpaSupplicant()
-		}
-		if mode == "OFF" {
-			command.killIt("wpa_supplicant")
-			command.killIt("hostapd")
-			command.killIt("dnsmasq")
-			command.RemoveApInterface()
 		}
 	}
 }
@@ -253,7 +295,7 @@ func HandleLog(messages chan CmdMessage) {
 	cmdRunner := CmdRunner{
 		Messages: messages,
 		Handlers: make(map[string]func(cmsg CmdMessage), 0),
-		Commands: make(map[string]*exec.Cmd, 0),
+		Commands: make(map[string]Process, 0),
 	}
 
 	// staticFields for logger
@@ -282,65 +324,136 @@ func (c *CmdRunner) HandleFunc(cmdId string, handler func(cmdMessage CmdMessage)
 	c.Handlers[cmdId] = handler
 }
 
-// ProcessCmd processes an internal command.
-func (c *CmdRunner) ProcessCmd(id string, cmd *exec.Cmd) {
-	log.Debug("ProcessCmd got %s", id)
+// ErrRunnerClosed is returned for commands started after Terminate.
+var ErrRunnerClosed = errors.New("command runner is shutting down")
 
-	// add command to the commands map TODO close the readers
-	c.Commands[id] = cmd
+// ProcessCmd starts a command through the Executor, forwards its output
+// to the Messages channel and waits for it to exit.
+func (c *CmdRunner) ProcessCmd(id string, name string, arg ...string) {
+	log.Debugf("ProcessCmd got %s", id)
 
-	cmdStdoutReader, err := cmd.StdoutPipe()
+	_, wait, err := c.StartCmd(id, name, arg...)
 	if err != nil {
-		panic(err)
+		if err == ErrRunnerClosed {
+			log.Debugf("ProcessCmd %s not started, shutting down", id)
+			return
+		}
+		c.Messages <- CmdMessage{
+			Id:      id,
+			Command: name,
+			Message: err.Error(),
+			Error:   true,
+		}
+		return
+	}
+
+	log.Debugf("ProcessCmd waiting %s", id)
+	wait()
+	log.Debugf("ProcessCmd done %s", id)
+}
+
+// StartCmd starts a command through the Executor, records it in the
+// Commands map under id and forwards its output to the Messages channel.
+// The returned wait function waits for the command to exit, removes it
+// from the map and returns the error of Process.Wait.
+func (c *CmdRunner) StartCmd(id string, name string, arg ...string) (Process, func() error, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, nil, ErrRunnerClosed
 	}
 
-	cmdStderrReader, err := cmd.StderrPipe()
+	proc, err := c.Executor.Start(name, arg...)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 
-	stdOutScanner := bufio.NewScanner(cmdStdoutReader)
-	go func() {
-		for stdOutScanner.Scan() {
+	// add command to the commands map, or stop it right away when
+	// Terminate got here first
+	c.mu.Lock()
+	if c.closed {
+		proc.Signal(syscall.SIGTERM)
+	}
+	c.Commands[id] = proc
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	forward := func(r io.Reader, isError bool) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
 			c.Messages <- CmdMessage{
 				Id:      id,
-				Command: cmd.Path,
-				Message: stdOutScanner.Text(),
-				Error:   false,
-				Cmd:     cmd,
+				Command: name,
+				Message: scanner.Text(),
+				Error:   isError,
+				Process: proc,
 			}
 		}
-	}()
+	}
 
-	stdErrScanner := bufio.NewScanner(cmdStderrReader)
-	go func() {
-		for stdErrScanner.Scan() {
-			c.Messages <- CmdMessage{
-				Id:      id,
-				Command: cmd.Path,
-				Message: stdErrScanner.Text(),
-				Error:   true,
-				Cmd:     cmd,
-			}
+	wg.Add(2)
+	go forward(proc.Stdout(), false)
+	go forward(proc.Stderr(), true)
+
+	wait := func() error {
+		wg.Wait()
+		err := proc.Wait()
+
+		c.mu.Lock()
+		if c.Commands[id] == proc {
+			delete(c.Commands, id)
 		}
-	}()
+		c.mu.Unlock()
+		return err
+	}
 
-	err = cmd.Start()
+	return proc, wait, nil
+}
 
-	if err != nil {
-		panic(err)
+// Terminate stops every process started through StartCmd with SIGTERM
+// and waits for them to exit. Processes still running when ctx is done
+// are killed. No processes are started once Terminate has been called.
+func (c *CmdRunner) Terminate(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = true
+	for id, proc := range c.Commands {
+		log.Infof("Terminating %s (pid %d)", id, proc.Pid())
+		proc.Signal(syscall.SIGTERM)
 	}
+	c.mu.Unlock()
 
-	log.Debug("ProcessCmd waiting %s", id)
-	err = cmd.Wait()
-	log.Debug("ProcessCmd done %s ", id)
+	running := func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.Commands) > 0
+	}
+
+	for running() {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			for id, proc := range c.Commands {
+				log.Warnf("Killing %s (pid %d)", id, proc.Pid())
+				proc.Signal(os.Kill)
+			}
+			c.mu.Unlock()
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
 
+	return nil
 }
 
+// WpaSupplicantHasNetowrkConfig reports whether the wpa_supplicant
+// configuration has a network block. An unreadable file has none.
 func WpaSupplicantHasNetowrkConfig(wpaSupplicantConfig string) bool {
 	fileData, err := ioutil.ReadFile(wpaSupplicantConfig)
 	if err != nil {
-		panic(err)
+		log.Warnf("Could not read wpa_supplicant config: %s", err)
+		return false
 	}
 	lines := strings.Split(string(fileData), "\n")
 	for _, line := range lines {
@@ -0,0 +1,47 @@
+package iotwifi
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// assertOrder checks that each prefix appears in calls after the previous one.
+func assertOrder(t *testing.T, calls []string, prefixes ...string) {
+	t.Helper()
+	i := 0
+	for _, c := range calls {
+		if i < len(prefixes) && strings.HasPrefix(c, prefixes[i]) {
+			i++
+		}
+	}
+	if i < len(prefixes) {
+		t.Fatalf("expected %q in order, missing %q in:\n%s", prefixes, prefixes[i], strings.Join(calls, "\n"))
+	}
+}
+
+func TestWpaSupplicantHasNetowrkConfig(t *testing.T) {
+	dir := t.TempDir()
+	withNet := dir + "/with.conf"
+	withoutNet := dir + "/without.conf"
+	ioutil.WriteFile(withNet, []byte("ctrl_interface=/var/run/wpa_supplicant\nnetwork={\n\tssid=\"home\"\n}\n"), 0600)
+	ioutil.WriteFile(withoutNet, []byte("ctrl_interface=/var/run/wpa_supplicant\n"), 0600)
+
+	if !WpaSupplicantHasNetowrkConfig(withNet) {
+		t.Error("expected network config")
+	}
+	if WpaSupplicantHasNetowrkConfig(withoutNet) {
+		t.Error("expected no network config")
+	}
+	if WpaSupplicantHasNetowrkConfig(dir + "/missing.conf") {
+		t.Error("expected no network config for a missing file")
+	}
+}
@@ -0,0 +1,155 @@
+package iotwifi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ConnectStage is the progress of a connection attempt.
+type ConnectStage string
+
+const (
+	StagePending     ConnectStage = "pending"
+	StageAssociating ConnectStage = "associating"
+	StageHandshake   ConnectStage = "4way_handshake"
+	StageDhcp        ConnectStage = "dhcp"
+	StageDone        ConnectStage = "done"
+	StageFailed      ConnectStage = "failed"
+)
+
+// Failure reasons reported in WpaConnection.Reason.
+const (
+	ReasonWrongKey      = "wrong_key"
+	ReasonNotFound      = "network_not_found"
+	ReasonAssocRejected = "association_rejected"
+	ReasonTimeout       = "timeout"
+	ReasonUnavailable   = "wpa_supplicant_unavailable"
+	ReasonInvalid       = "invalid_credentials"
+	ReasonError         = "error"
+)
+
+// connectJobHistory is the number of finished jobs kept for lookup.
+const connectJobHistory = 20
+
+// stageForState maps a wpa_state to a connection stage.
+func stageForState(wpaState string, ip string) ConnectStage {
+	switch wpaState {
+	case "4WAY_HANDSHAKE", "GROUP_HANDSHAKE":
+		return StageHandshake
+	case "COMPLETED":
+		if ip == "" {
+			return StageDhcp
+		}
+		return StageDone
+	}
+	return StageAssociating
+}
+
+// ConnectJob tracks a connection attempt started through /connect.
+type ConnectJob struct {
+	Id       string         `json:"id"`
+	Ssid     string         `json:"ssid"`
+	Stage    ConnectStage   `json:"stage"`
+	WpaState string         `json:"wpa_state"`
+	Result   *WpaConnection `json:"result,omitempty"`
+	Started  time.Time      `json:"started"`
+	Updated  time.Time      `json:"updated"`
+}
+
+// ConnectJobs stores recent connection jobs.
+type ConnectJobs struct {
+	mu    sync.Mutex
+	jobs  map[string]*ConnectJob
+	order []string
+}
+
+// NewConnectJobs produces an empty job store.
+func NewConnectJobs() *ConnectJobs {
+	return &ConnectJobs{
+		jobs: make(map[string]*ConnectJob),
+	}
+}
+
+// New creates a pending job for ssid, evicting the oldest job when the
+// store is full.
+func (j *ConnectJobs) New(ssid string) ConnectJob {
+	now := time.Now()
+	job := &ConnectJob{
+		Id:      newJobId(),
+		Ssid:    ssid,
+		Stage:   StagePending,
+		Started: now,
+		Updated: now,
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.jobs[job.Id] = job
+	j.order = append(j.order, job.Id)
+	if len(j.order) > connectJobHistory {
+		delete(j.jobs, j.order[0])
+		j.order = j.order[1:]
+	}
+
+	return *job
+}
+
+// Progress records a new stage for a job and returns the updated job,
+// or false when the job was evicted.
+func (j *ConnectJobs) Progress(id string, stage ConnectStage, wpaState string) (ConnectJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return ConnectJob{}, false
+	}
+	job.Stage = stage
+	if wpaState != "" {
+		job.WpaState = wpaState
+	}
+	job.Updated = time.Now()
+
+	return *job, true
+}
+
+// Finish records the result of a job and returns the updated job, or
+// false when the job was evicted.
+func (j *ConnectJobs) Finish(id string, result WpaConnection) (ConnectJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return ConnectJob{}, false
+	}
+	job.Result = &result
+	job.Stage = StageDone
+	if result.State == "FAIL" {
+		job.Stage = StageFailed
+	}
+	job.Updated = time.Now()
+
+	return *job, true
+}
+
+// Get returns a job by id.
+func (j *ConnectJobs) Get(id string) (ConnectJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return ConnectJob{}, false
+	}
+	return *job, true
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
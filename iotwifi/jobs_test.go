@@ -0,0 +1,66 @@
+package iotwifi
+
+import "testing"
+
+func TestConnectJobs(t *testing.T) {
+	jobs := NewConnectJobs()
+
+	job := jobs.New("home")
+	if job.Id == "" || job.Stage != StagePending {
+		t.Fatalf("unexpected job %+v", job)
+	}
+
+	jobs.Progress(job.Id, StageHandshake, "4WAY_HANDSHAKE")
+	got, ok := jobs.Get(job.Id)
+	if !ok || got.Stage != StageHandshake || got.WpaState != "4WAY_HANDSHAKE" {
+		t.Errorf("unexpected job %+v", got)
+	}
+
+	done, ok := jobs.Finish(job.Id, WpaConnection{Ssid: "home", State: "FAIL", Reason: ReasonWrongKey})
+	if !ok || done.Stage != StageFailed || done.Result.Reason != ReasonWrongKey {
+		t.Errorf("unexpected job %+v", done)
+	}
+
+	if _, ok := jobs.Get("missing"); ok {
+		t.Error("found missing job")
+	}
+}
+
+func TestConnectJobsEviction(t *testing.T) {
+	jobs := NewConnectJobs()
+
+	first := jobs.New("first")
+	for i := 0; i < connectJobHistory; i++ {
+		jobs.New("other")
+	}
+
+	if _, ok := jobs.Get(first.Id); ok {
+		t.Error("oldest job was not evicted")
+	}
+	// an evicted job still running is not updated
+	if job, ok := jobs.Progress(first.Id, StageHandshake, ""); ok {
+		t.Errorf("progress of an evicted job %+v", job)
+	}
+	if job, ok := jobs.Finish(first.Id, WpaConnection{State: "OK"}); ok {
+		t.Errorf("result of an evicted job %+v", job)
+	}
+}
+
+func TestStageForState(t *testing.T) {
+	tests := []struct {
+		state, ip string
+		want      ConnectStage
+	}{
+		{"SCANNING", "", StageAssociating},
+		{"ASSOCIATING", "", StageAssociating},
+		{"4WAY_HANDSHAKE", "", StageHandshake},
+		{"COMPLETED", "", StageDhcp},
+		{"COMPLETED", "10.0.0.2", StageDone},
+	}
+
+	for _, tt := range tests {
+		if got := stageForState(tt.state, tt.ip); got != tt.want {
+			t.Errorf("stageForState(%q, %q) = %s, want %s", tt.state, tt.ip, got, tt.want)
+		}
+	}
+}
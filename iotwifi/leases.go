@@ -0,0 +1,109 @@
+package iotwifi
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLeaseFile is where dnsmasq keeps its DHCP leases unless
+// DnsmasqCfg.LeaseFile is set.
+const DefaultLeaseFile = "/var/lib/misc/dnsmasq.leases"
+
+// DhcpLease is a lease handed out by dnsmasq to a station of the access
+// point.
+type DhcpLease struct {
+	Expires  *time.Time `json:"expires,omitempty"` // nil for infinite leases
+	Mac      string     `json:"mac"`
+	Ip       string     `json:"ip"`
+	Hostname string     `json:"hostname,omitempty"`
+	ClientId string     `json:"client_id,omitempty"`
+}
+
+// leaseFile returns the configured lease file, DefaultLeaseFile when
+// empty.
+func (c DnsmasqCfg) leaseFile() string {
+	if c.LeaseFile == "" {
+		return DefaultLeaseFile
+	}
+	return c.LeaseFile
+}
+
+// arg returns the reservation as a --dhcp-host value,
+// mac,ip[,hostname][,lease].
+func (h DhcpHost) arg() string {
+	fields := []string{h.Mac, h.Ip}
+	if h.Hostname != "" {
+		fields = append(fields, h.Hostname)
+	}
+	if h.Lease != "" {
+		fields = append(fields, h.Lease)
+	}
+	return strings.Join(fields, ",")
+}
+
+// ReadLeases reads a dnsmasq lease file, one "expiry mac ip hostname
+// client-id" line per lease. A missing file has no leases.
+func ReadLeases(file string) ([]DhcpLease, error) {
+	leases := make([]DhcpLease, 0)
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return leases, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if lease, ok := parseLease(scanner.Text()); ok {
+			leases = append(leases, lease)
+		}
+	}
+	return leases, scanner.Err()
+}
+
+// parseLease parses a lease line. The "duid" line and the leases of
+// DHCPv6 clients, which have no MAC address, are skipped.
+func parseLease(line string) (DhcpLease, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return DhcpLease{}, false
+	}
+
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return DhcpLease{}, false
+	}
+	mac, err := net.ParseMAC(fields[1])
+	if err != nil || len(mac) != 6 {
+		return DhcpLease{}, false
+	}
+
+	lease := DhcpLease{Mac: mac.String(), Ip: fields[2]}
+	if expires != 0 {
+		t := time.Unix(expires, 0).UTC()
+		lease.Expires = &t
+	}
+	if fields[3] != "*" {
+		lease.Hostname = fields[3]
+	}
+	if len(fields) > 4 && fields[4] != "*" {
+		lease.ClientId = fields[4]
+	}
+	return lease, true
+}
+
+// leasesByMac indexes leases by MAC address.
+func leasesByMac(leases []DhcpLease) map[string]DhcpLease {
+	byMac := make(map[string]DhcpLease, len(leases))
+	for _, lease := range leases {
+		byMac[lease.Mac] = lease
+	}
+	return byMac
+}
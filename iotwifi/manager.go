@@ -0,0 +1,610 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WifiState is a state of the ConnManager.
+type WifiState string
+
+const (
+	StateOff            WifiState = "OFF"
+	StateStartingAP     WifiState = "STARTING_AP"
+	StateAP             WifiState = "AP"
+	StateStartingClient WifiState = "STARTING_CLIENT"
+	StateClient         WifiState = "CLIENT"
+	StateFailed         WifiState = "FAILED"
+)
+
+// WifiMode is a mode that can be requested from the ConnManager.
+type WifiMode string
+
+const (
+	ModeAP     WifiMode = "AP"
+	ModeClient WifiMode = "CL"
+	ModeOff    WifiMode = "OFF"
+)
+
+// validTransitions lists the states reachable from each state.
+var validTransitions = map[WifiState][]WifiState{
+	StateOff:            {StateStartingAP, StateStartingClient},
+	StateStartingAP:     {StateAP, StateFailed, StateOff},
+	StateAP:             {StateStartingAP, StateStartingClient, StateOff},
+	StateStartingClient: {StateClient, StateFailed, StateOff},
+	StateClient:         {StateStartingAP, StateStartingClient, StateOff},
+	StateFailed:         {StateStartingAP, StateStartingClient, StateOff},
+}
+
+// ErrInvalidTransition is returned for transitions not in validTransitions.
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+const (
+	// daemonStopTimeout bounds the wait for a killed daemon to go away.
+	daemonStopTimeout = 15 * time.Second
+	// daemonStartTimeout bounds the wait for a daemon's control socket.
+	daemonStartTimeout = 30 * time.Second
+	// transitionHistory is the number of transitions kept for inspection.
+	transitionHistory = 20
+)
+
+// Transition records a state change and why it happened.
+type Transition struct {
+	From   WifiState `json:"from"`
+	To     WifiState `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// modeRequest is a pending request for a mode. A request with a From
+// state only applies if the manager is still in that state when the
+// request is processed. A restart request starts the mode again even if
+// it is already up.
+type modeRequest struct {
+	mode    WifiMode
+	from    WifiState
+	reason  string
+	restart bool
+}
+
+// cfgReload is a pending configuration change.
+type cfgReload struct {
+	cfg    SetupCfg
+	reason string
+}
+
+// ConnManager switches the device between access point and client
+// modes. Mode requests are processed one at a time; requests arriving
+// while a transition is in progress are coalesced so only the latest
+// one is applied.
+type ConnManager struct {
+	SetupCfg *SetupCfg
+	Events   *EventBus
+
+	command *Command
+	wpa     *WpaCtrl
+	apd     *ApdCtrl
+
+	mu          sync.Mutex
+	state       WifiState
+	transitions []Transition
+	pending     *modeRequest
+	reload      *cfgReload
+	wake        chan struct{}
+	running     bool
+	stopping    bool
+	stop        chan struct{} // closed by Shutdown
+	done        chan struct{} // closed when Run returns
+}
+
+// NewConnManager produces a ConnManager in the OFF state. Call Run to
+// start processing requests.
+func NewConnManager(messages chan CmdMessage, setupCfg *SetupCfg) *ConnManager {
+	cmdRunner := &CmdRunner{
+		Messages: messages,
+		Handlers: make(map[string]func(cmsg CmdMessage), 0),
+		Commands: make(map[string]Process, 0),
+		Executor: setupCfg.executor(),
+	}
+
+	setupCfg.DiscoverInterfaces()
+
+	events := NewEventBus()
+	supervisor := NewSupervisor(cmdRunner, setupCfg.RestartPolicies)
+	supervisor.PidDir = setupCfg.pidDir()
+	supervisor.OnChange = func(status DaemonStatus) {
+		events.Publish(EventDaemon, status)
+	}
+
+	return &ConnManager{
+		SetupCfg: setupCfg,
+		Events:   events,
+		command: &Command{
+			Runner:     cmdRunner,
+			Supervisor: supervisor,
+			SetupCfg:   setupCfg,
+		},
+		wpa:   NewWpaCtrl(setupCfg.WpaSupplicantCfg.CtrlInterface, setupCfg.Interfaces.Station),
+		apd:   NewApdCtrl(setupCfg.HostApdCfg.CtrlInterface, setupCfg.Interfaces.Ap),
+		state: StateOff,
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// State returns the current state.
+func (m *ConnManager) State() WifiState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Config returns a copy of the configuration in use, or of the one being
+// applied when a Reload is pending.
+func (m *ConnManager) Config() SetupCfg {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.reload != nil {
+		return m.reload.cfg
+	}
+	return *m.SetupCfg
+}
+
+// Daemons returns the status of the supervised daemons.
+func (m *ConnManager) Daemons() []DaemonStatus {
+	return m.command.Supervisor.Status()
+}
+
+// LastTransition returns the most recent transition, if any.
+func (m *ConnManager) LastTransition() (Transition, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.transitions) == 0 {
+		return Transition{}, false
+	}
+	return m.transitions[len(m.transitions)-1], true
+}
+
+// Transitions returns the recent transitions, oldest first.
+func (m *ConnManager) Transitions() []Transition {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Transition(nil), m.transitions...)
+}
+
+// Request asks for a mode. It replaces any request not yet processed.
+func (m *ConnManager) Request(mode WifiMode, reason string) {
+	m.enqueue(&modeRequest{mode: mode, reason: reason})
+}
+
+// RequestFrom asks for a mode only if the manager is in state from when
+// the request is processed. It is used by the monitors, whose view of the
+// world may be stale by the time the request is handled, and it never
+// replaces a pending unconditional request.
+func (m *ConnManager) RequestFrom(from WifiState, mode WifiMode, reason string) {
+	m.enqueue(&modeRequest{mode: mode, from: from, reason: reason})
+}
+
+func (m *ConnManager) enqueue(req *modeRequest) {
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		log.Infof("mode request %s (%s) dropped, shutting down", req.mode, req.reason)
+		return
+	}
+	if m.pending != nil && m.pending.from == "" && req.from != "" {
+		m.mu.Unlock()
+		log.Infof("mode request %s (%s) dropped, %s pending", req.mode, req.reason, m.pending.mode)
+		return
+	}
+	m.pending = req
+	m.mu.Unlock()
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Reload applies a changed configuration with as little disruption as
+// possible. While the access point is up only the affected daemons are
+// restarted: hostapd for hostapd settings, dnsmasq for DHCP settings;
+// otherwise the settings are used the next time it starts. Settings that
+// need a process restart, like the interfaces, are logged and ignored.
+func (m *ConnManager) Reload(cfg *SetupCfg, reason string) {
+	next := *cfg
+	next.DiscoverInterfaces()
+
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		log.Infof("configuration reload (%s) dropped, shutting down", reason)
+		return
+	}
+	m.reload = &cfgReload{cfg: next, reason: reason}
+	m.mu.Unlock()
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// reconfigure applies a pending configuration change. The settings are
+// only written here, on the Run goroutine, which is also the only reader
+// outside the lock.
+func (m *ConnManager) reconfigure() {
+	m.mu.Lock()
+	upd := m.reload
+	m.reload = nil
+	if upd == nil {
+		m.mu.Unlock()
+		return
+	}
+
+	diff := DiffCfg(m.SetupCfg, &upd.cfg)
+	apd := upd.cfg.HostApdCfg
+	apd.CfgFile = m.SetupCfg.HostApdCfg.CfgFile
+	apd.CtrlInterface = m.SetupCfg.HostApdCfg.CtrlInterface
+	m.SetupCfg.HostApdCfg = apd
+	m.SetupCfg.DnsmasqCfg = upd.cfg.DnsmasqCfg
+	m.SetupCfg.RestartPolicies = upd.cfg.RestartPolicies
+	state := m.state
+	m.mu.Unlock()
+
+	for _, field := range diff.Ignored {
+		log.Warnf("%s changed, restart to apply it", field)
+	}
+	if diff.RestartPolicies {
+		m.command.Supervisor.SetPolicies(upd.cfg.RestartPolicies)
+	}
+	if !diff.Changed() {
+		log.Infof("access point settings unchanged (%s)", upd.reason)
+		return
+	}
+
+	log.Infof("access point settings changed: %s", upd.reason)
+	m.Events.Publish(EventConfig, CfgReload{Reason: upd.reason, Changes: diff})
+	apUp := state == StateAP || (state == StateClient && m.SetupCfg.Routing.Enabled)
+	if !apUp {
+		// keep hostapd.conf in step for whoever reads it next
+		if diff.Hostapd {
+			if err := hostAPdConfig(m.SetupCfg); err != nil {
+				log.Warnf("unable to write hostapd config: %s", err)
+			}
+		}
+		return
+	}
+
+	if err := m.restartApDaemons(diff); err != nil {
+		log.Errorf("%s, restarting the access point", err)
+		mode := ModeAP
+		if state == StateClient {
+			mode = ModeClient
+		}
+		m.apply(&modeRequest{mode: mode, from: state, reason: upd.reason, restart: true})
+	}
+}
+
+// restartApDaemons restarts the access point daemons affected by a
+// configuration change, leaving the others running.
+func (m *ConnManager) restartApDaemons(diff CfgDiff) error {
+	if diff.ApIp {
+		m.command.ConfigureApInterface()
+	}
+
+	if diff.Hostapd {
+		if err := hostAPdConfig(m.SetupCfg); err != nil {
+			return fmt.Errorf("unable to write hostapd config: %w", err)
+		}
+		log.Info("-=-=-=- restart hostapd -=-=-=-")
+		m.command.killIt("hostapd")
+		if !m.waitUntil(func() bool { return !m.apd.Running() }, daemonStopTimeout) {
+			return errors.New("hostapd did not stop")
+		}
+		m.command.StartHostAPD()
+		if !m.waitUntil(m.apd.Running, daemonStartTimeout) {
+			return errors.New("hostapd did not restart")
+		}
+	}
+
+	if diff.Dnsmasq {
+		if _, err := dnsmasqConfig(m.SetupCfg, m.State() == StateClient); err != nil {
+			return fmt.Errorf("unable to write dnsmasq config: %w", err)
+		}
+		log.Info("-=-=-=- restart dnsmasq -=-=-=-")
+		m.command.StartDnsmasq()
+	}
+
+	return nil
+}
+
+func (m *ConnManager) takePending() *modeRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	req := m.pending
+	m.pending = nil
+	return req
+}
+
+// transition moves to state to if the rules allow it.
+func (m *ConnManager) transition(to WifiState, reason string) error {
+	m.mu.Lock()
+
+	from := m.state
+	allowed := false
+	for _, s := range validTransitions[from] {
+		if s == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+	}
+
+	t := Transition{From: from, To: to, Reason: reason, At: time.Now()}
+	m.state = to
+	m.transitions = append(m.transitions, t)
+	if len(m.transitions) > transitionHistory {
+		m.transitions = m.transitions[len(m.transitions)-transitionHistory:]
+	}
+	m.mu.Unlock()
+
+	m.Events.Publish(EventMode, t)
+	log.WithFields(log.Fields{"from": from, "to": to}).Info("state: " + reason)
+	return nil
+}
+
+// Run processes mode requests until the process exits.
+func (m *ConnManager) Run() {
+	log.Info("Loading IoT Wifi...")
+
+	m.mu.Lock()
+	m.running = true
+	m.mu.Unlock()
+	defer close(m.done)
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-m.wake:
+		}
+
+		m.reconfigure()
+		req := m.takePending()
+		if req == nil {
+			continue
+		}
+		m.apply(req)
+	}
+}
+
+// apply carries out a single mode request.
+func (m *ConnManager) apply(req *modeRequest) {
+	state := m.State()
+	log.Infof("mode request %s in state %s: %s", req.mode, state, req.reason)
+
+	if req.from != "" && req.from != state {
+		log.Infof("mode request %s ignored, state is %s not %s", req.mode, state, req.from)
+		return
+	}
+
+	var starting, done WifiState
+	var start func() error
+
+	switch req.mode {
+	case ModeAP:
+		starting, done, start = StateStartingAP, StateAP, m.startAP
+	case ModeClient:
+		starting, done, start = StateStartingClient, StateClient, m.startClient
+	case ModeOff:
+		if state == StateOff {
+			return
+		}
+		m.stopAll()
+		if err := m.transition(StateOff, req.reason); err != nil {
+			log.Warn(err.Error())
+		}
+		return
+	default:
+		log.Warnf("unknown mode request %q", req.mode)
+		return
+	}
+
+	if state == done && !req.restart {
+		log.Infof("-=-=-=- %s already started. -=-=-=-", done)
+		return
+	}
+
+	if err := m.transition(starting, req.reason); err != nil {
+		log.Warn(err.Error())
+		return
+	}
+
+	if err := start(); err != nil {
+		select {
+		case <-m.stop:
+			// aborted by Shutdown, which moves on to OFF
+		default:
+			m.transition(StateFailed, err.Error())
+		}
+		return
+	}
+
+	m.transition(done, string(done)+" started")
+	if done == StateClient && m.SetupCfg.Routing.Enabled {
+		m.uplinkDnsmasq()
+	}
+}
+
+// uplinkDnsmasq gives dnsmasq the upstream servers, or those of the
+// station, once the client is started next to the access point. startAP
+// leaves them out.
+func (m *ConnManager) uplinkDnsmasq() {
+	changed, err := dnsmasqConfig(m.SetupCfg, true)
+	if err != nil {
+		log.Warnf("unable to write dnsmasq config: %s", err)
+		return
+	}
+	if changed {
+		log.Info("-=-=-=- restart dnsmasq with the uplink -=-=-=-")
+		m.command.StartDnsmasq()
+	}
+}
+
+// Shutdown stops processing mode requests, waits for a transition in
+// progress, terminates the daemons started by the manager and removes
+// the AP interface. Daemons still running when ctx is done are killed
+// and the context error is returned.
+func (m *ConnManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		return nil
+	}
+	m.stopping = true
+	m.pending = nil
+	running := m.running
+	m.mu.Unlock()
+
+	log.Info("Shutting down IoT Wifi...")
+	close(m.stop)
+
+	if running {
+		select {
+		case <-m.done:
+		case <-ctx.Done():
+			log.Warn("transition still in progress, shutting down anyway")
+		}
+	}
+
+	m.command.Supervisor.Close()
+	err := m.command.Runner.Terminate(ctx)
+	m.command.RemoveApInterface()
+
+	if m.State() != StateOff {
+		if terr := m.transition(StateOff, "shutdown"); terr != nil {
+			log.Warn(terr.Error())
+		}
+	}
+
+	return err
+}
+
+// stopAll stops every daemon and removes the AP interface.
+func (m *ConnManager) stopAll() {
+	m.command.killIt("wpa_supplicant")
+	m.command.killIt("hostapd")
+	m.command.killIt("dnsmasq")
+	m.command.RemoveApInterface()
+}
+
+// startAP brings up the access point.
+func (m *ConnManager) startAP() error {
+	log.Info("-=-=-=- start Access Point -=-=-=-")
+	m.command.killIt("wpa_supplicant")
+	m.command.killIt("hostapd")
+	m.command.killIt("dnsmasq")
+
+	log.Info("... wait for wpa_supplicant to finish")
+	if !m.waitUntil(func() bool { return !m.wpa.Running() }, daemonStopTimeout) {
+		return errors.New("wpa_supplicant did not stop")
+	}
+	log.Info("wpa_supplicant finished")
+
+	m.command.RemoveApInterface()
+	m.command.AddApInterface()
+	m.command.UpApInterface()
+	m.command.ConfigureApInterface()
+	if err := hostAPdConfig(m.SetupCfg); err != nil {
+		return fmt.Errorf("unable to write hostapd config: %w", err)
+	}
+
+	m.command.StartHostAPD() //hostapd
+	log.Info("... wait for host_apd to start")
+	if !m.waitUntil(m.apd.Running, daemonStartTimeout) {
+		return errors.New("hostapd did not start")
+	}
+	log.Info("host_apd started")
+
+	if _, err := dnsmasqConfig(m.SetupCfg, false); err != nil {
+		return fmt.Errorf("unable to write dnsmasq config: %w", err)
+	}
+	m.command.StartDnsmasq() //dnsmasq
+	return nil
+}
+
+// startClient brings up wpa_supplicant. With routing enabled the access
+// point stays up, or is brought up, to share the connection.
+func (m *ConnManager) startClient() error {
+	routing := m.SetupCfg.Routing.Enabled
+	if m.wpa.Running() && (!routing || m.apd.Running()) {
+		log.Info("-=-=-=- client already started. -=-=-=-")
+		return nil
+	}
+
+	log.Info("-=-=-=- start Client -=-=-=-")
+	if routing {
+		return m.startRoutedClient()
+	}
+
+	m.command.killIt("wpa_supplicant")
+	m.command.killIt("hostapd")
+	m.command.killIt("dnsmasq")
+
+	log.Info("... wait for host_apd to finish")
+	if !m.waitUntil(func() bool { return !m.apd.Running() }, daemonStopTimeout) {
+		return errors.New("hostapd did not stop")
+	}
+	log.Info("host_apd finished")
+
+	m.command.RemoveApInterface()
+	m.command.StartWpaSupplicant()
+
+	if !m.waitUntil(m.wpa.Running, daemonStartTimeout) {
+		return errors.New("wpa_supplicant did not start")
+	}
+	return nil
+}
+
+// startRoutedClient starts wpa_supplicant next to the access point.
+func (m *ConnManager) startRoutedClient() error {
+	if !m.apd.Running() {
+		if err := m.startAP(); err != nil {
+			return err
+		}
+	}
+
+	m.command.StartWpaSupplicant()
+	if !m.waitUntil(m.wpa.Running, daemonStartTimeout) {
+		return errors.New("wpa_supplicant did not start")
+	}
+	return nil
+}
+
+// waitUntil polls cond until it is true, timeout passes or the manager
+// is shutting down.
+func (m *ConnManager) waitUntil(cond func() bool, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for !cond() {
+		select {
+		case <-m.stop:
+			return false
+		case <-deadline.C:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return true
+}
@@ -0,0 +1,424 @@
+package iotwifi
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnManagerAccessPoint(t *testing.T) {
+	r := newFakeRadio(t)
+	m := r.start()
+
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+	waitFor(t, "dnsmasq", func() bool { return r.exec.called("dnsmasq") })
+
+	assertOrder(t, r.exec.Calls(),
+		"iw dev uap0 del",
+		"iw phy phy0 interface add uap0 type __ap",
+		"ifconfig uap0 up",
+		"ifconfig uap0 192.168.27.1",
+		"hostapd "+r.cfg.HostApdCfg.CfgFile,
+		"dnsmasq",
+	)
+
+	hostapdConf, err := ioutil.ReadFile(r.cfg.HostApdCfg.CfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"interface=uap0",
+		"ssid=iot-wifi-test",
+		"channel=6",
+		"wpa_passphrase=iotwifipass",
+		"ctrl_interface=" + r.cfg.HostApdCfg.CtrlInterface,
+	} {
+		if !strings.Contains(string(hostapdConf), want) {
+			t.Errorf("hostapd.conf missing %q", want)
+		}
+	}
+}
+
+func TestConnManagerAccessPointToClient(t *testing.T) {
+	r := newFakeRadio(t)
+	m := r.start()
+
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+	waitFor(t, "dnsmasq", func() bool { return r.exec.called("dnsmasq") })
+
+	m.Request(ModeClient, "test")
+	waitState(t, m, StateClient)
+
+	calls := r.exec.Calls()
+	assertOrder(t, calls,
+		"dnsmasq",
+		"iw dev uap0 del",
+		"wpa_supplicant -Dnl80211 -iwlan0 -c"+r.cfg.WpaSupplicantCfg.CfgFile,
+	)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.apd != nil {
+		t.Error("hostapd still running in client mode")
+	}
+}
+
+func TestConnManagerClientAlreadyStarted(t *testing.T) {
+	r := newFakeRadio(t)
+	m := r.start()
+
+	m.Request(ModeClient, "test")
+	waitState(t, m, StateClient)
+	before := len(r.exec.Calls())
+
+	// a second CL is ignored while already a client
+	m.Request(ModeClient, "test again")
+	time.Sleep(100 * time.Millisecond)
+	if got := len(r.exec.Calls()); got != before {
+		t.Fatalf("second client request ran %d commands", got-before)
+	}
+
+	m.Request(ModeOff, "test")
+	waitState(t, m, StateOff)
+
+	assertOrder(t, r.exec.Calls()[before:], "iw dev uap0 del")
+	r.mu.Lock()
+	if r.wpa != nil {
+		t.Error("wpa_supplicant still running after OFF")
+	}
+	r.mu.Unlock()
+	if n := strings.Count(strings.Join(r.exec.Calls(), "\n"), "wpa_supplicant -D"); n != 1 {
+		t.Errorf("wpa_supplicant started %d times", n)
+	}
+}
+
+func TestConnManagerTransitions(t *testing.T) {
+	r := newFakeRadio(t)
+	m := r.start()
+
+	if m.State() != StateOff {
+		t.Fatalf("initial state %s", m.State())
+	}
+	if _, ok := m.LastTransition(); ok {
+		t.Fatal("unexpected transition before any request")
+	}
+
+	m.Request(ModeAP, "no network config")
+	waitState(t, m, StateAP)
+
+	var got []WifiState
+	for _, tr := range m.Transitions() {
+		got = append(got, tr.To)
+	}
+	if strings.Join(toStrings(got), ",") != "STARTING_AP,AP" {
+		t.Errorf("transitions %v", got)
+	}
+	if tr := m.Transitions()[0]; tr.From != StateOff || tr.Reason != "no network config" {
+		t.Errorf("unexpected transition %+v", tr)
+	}
+}
+
+func TestConnManagerRequestFrom(t *testing.T) {
+	r := newFakeRadio(t)
+	m := r.start()
+
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+
+	// a stale monitor request for the client state is ignored
+	m.RequestFrom(StateClient, ModeAP, "wpa timeout")
+	m.RequestFrom(StateClient, ModeOff, "stale")
+	time.Sleep(100 * time.Millisecond)
+	if m.State() != StateAP {
+		t.Fatalf("state %s, want AP", m.State())
+	}
+
+	m.RequestFrom(StateAP, ModeClient, "no stations")
+	waitState(t, m, StateClient)
+	if last, _ := m.LastTransition(); last.From != StateStartingClient {
+		t.Errorf("unexpected last transition %+v", last)
+	}
+}
+
+func TestConnManagerCoalesce(t *testing.T) {
+	m := NewConnManager(make(chan CmdMessage, 1), &SetupCfg{Executor: newFakeExecutor()})
+
+	m.Request(ModeAP, "first")
+	m.Request(ModeClient, "second")
+	m.RequestFrom(StateAP, ModeOff, "monitor")
+
+	req := m.takePending()
+	if req == nil || req.mode != ModeClient || req.reason != "second" {
+		t.Fatalf("pending %+v, want second client request", req)
+	}
+	if m.takePending() != nil {
+		t.Fatal("expected a single pending request")
+	}
+}
+
+func TestConnManagerInvalidTransition(t *testing.T) {
+	m := NewConnManager(make(chan CmdMessage, 1), &SetupCfg{Executor: newFakeExecutor()})
+
+	if err := m.transition(StateClient, "skip starting"); err == nil {
+		t.Fatal("expected error for OFF to CLIENT")
+	}
+	if err := m.transition(StateStartingClient, "ok"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnManagerFailed(t *testing.T) {
+	r := newFakeRadio(t)
+	r.cfg.HostApdCfg.CfgFile = r.dir + "/missing/hostapd.conf"
+	m := r.start()
+
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateFailed)
+
+	last, _ := m.LastTransition()
+	if !strings.Contains(last.Reason, "hostapd config") {
+		t.Errorf("reason %q", last.Reason)
+	}
+}
+
+func toStrings(states []WifiState) []string {
+	s := make([]string, len(states))
+	for i, st := range states {
+		s[i] = string(st)
+	}
+	return s
+}
+
+func TestConnManagerInterfaces(t *testing.T) {
+	r := newFakeRadio(t)
+	r.cfg.Interfaces = InterfaceCfg{Phy: "phy1", Station: "wlan1", Ap: "uap1"}
+	m := r.start()
+
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+	waitFor(t, "dnsmasq", func() bool { return r.exec.called("dnsmasq") })
+
+	m.Request(ModeClient, "test")
+	waitState(t, m, StateClient)
+
+	assertOrder(t, r.exec.Calls(),
+		"iw dev uap1 del",
+		"iw phy phy1 interface add uap1 type __ap",
+		"ifconfig uap1 up",
+		"dnsmasq",
+		"wpa_supplicant -Dnl80211 -iwlan1",
+	)
+	for _, c := range r.exec.Calls() {
+		if strings.Contains(c, "uap0") || strings.Contains(c, "wlan0") || strings.Contains(c, "phy0") {
+			t.Errorf("unexpected call %q", c)
+		}
+	}
+}
+
+func TestConnManagerShutdown(t *testing.T) {
+	r := newFakeRadio(t)
+	m := r.start()
+
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+	waitFor(t, "dnsmasq", func() bool { return r.exec.called("dnsmasq") })
+	before := len(r.exec.Calls())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.State() != StateOff {
+		t.Errorf("state %s, want OFF", m.State())
+	}
+	r.exec.mu.Lock()
+	for name, procs := range r.exec.running {
+		for _, p := range procs {
+			select {
+			case <-p.done:
+			default:
+				t.Errorf("%s still running", name)
+			}
+		}
+	}
+	r.exec.mu.Unlock()
+
+	after := r.exec.Calls()[before:]
+	assertOrder(t, after, "iw dev uap0 del")
+	for _, c := range after {
+		if strings.HasPrefix(c, "killall") {
+			t.Errorf("unexpected call %q", c)
+		}
+	}
+
+	// requests after shutdown are dropped
+	m.Request(ModeClient, "test")
+	time.Sleep(50 * time.Millisecond)
+	if m.State() != StateOff || r.exec.called("wpa_supplicant -Dnl80211") {
+		t.Errorf("request processed after shutdown")
+	}
+}
+
+func TestConnManagerShutdownDuringStart(t *testing.T) {
+	r := newFakeRadio(t)
+	delete(r.exec.hooks, "hostapd") // hostapd never answers
+	m := r.start()
+
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateStartingAP)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("shutdown took %s", time.Since(start))
+	}
+
+	last, _ := m.LastTransition()
+	if last.From != StateStartingAP || last.To != StateOff || last.Reason != "shutdown" {
+		t.Errorf("unexpected transition %+v", last)
+	}
+}
+
+func TestConnManagerReload(t *testing.T) {
+	r := newFakeRadio(t)
+	m := r.start()
+	cfgFile := r.cfg.HostApdCfg.CfgFile
+	next := *r.cfg
+
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+	waitFor(t, "dnsmasq", func() bool { return r.exec.called("dnsmasq") })
+
+	// an unchanged configuration leaves the access point alone
+	before := len(r.exec.Calls())
+	m.Reload(&next, "same")
+	time.Sleep(100 * time.Millisecond)
+	if calls := r.exec.Calls()[before:]; len(calls) != 0 {
+		t.Fatalf("unexpected calls %q", calls)
+	}
+
+	// hostapd settings only restart hostapd
+	next.HostApdCfg.Ssid = "renamed"
+	next.HostApdCfg.Channel = "11"
+	next.HostApdCfg.CfgFile = "/ignored"
+	m.Reload(&next, "new ssid")
+	waitFor(t, "hostapd restart", func() bool { return countCalls(r.exec, "hostapd "+cfgFile) == 2 })
+	time.Sleep(100 * time.Millisecond)
+
+	calls := r.exec.Calls()[before:]
+	for _, c := range calls {
+		if strings.HasPrefix(c, "dnsmasq") || strings.HasPrefix(c, "iw ") {
+			t.Errorf("unexpected call %q", c)
+		}
+	}
+	hostapdConf, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"ssid=renamed", "channel=11"} {
+		if !strings.Contains(string(hostapdConf), want) {
+			t.Errorf("hostapd.conf missing %q", want)
+		}
+	}
+
+	// DHCP settings only restart dnsmasq
+	before = len(r.exec.Calls())
+	next.DnsmasqCfg.DhcpRange = "192.168.27.50,192.168.27.60,2h"
+	next.DnsmasqCfg.Hosts = []DhcpHost{{Mac: "b8:27:eb:12:34:56", Ip: "192.168.27.20", Hostname: "sensor-1"}}
+	m.Reload(&next, "new range")
+	waitFor(t, "dnsmasq restart", func() bool { return countPrefix(r.exec, "dnsmasq ") == 2 })
+
+	calls = r.exec.Calls()[before:]
+	if len(calls) != 1 || !strings.Contains(calls[0], "--conf-file="+r.cfg.DnsmasqCfg.CfgFile) {
+		t.Errorf("calls %q, want a single dnsmasq start", calls)
+	}
+	dnsmasqConf, _ := ioutil.ReadFile(r.cfg.DnsmasqCfg.CfgFile)
+	for _, want := range []string{"dhcp-range=192.168.27.50,192.168.27.60,2h\n", "dhcp-host=b8:27:eb:12:34:56,192.168.27.20,sensor-1\n"} {
+		if !strings.Contains(string(dnsmasqConf), want) {
+			t.Errorf("dnsmasq.conf missing %q", want)
+		}
+	}
+
+	if n := len(m.Transitions()); n != 2 {
+		t.Errorf("%d transitions, want the access point to stay up", n)
+	}
+}
+
+func TestRoutedClientServers(t *testing.T) {
+	r := newFakeRadio(t)
+	r.cfg.Routing = RoutingCfg{Enabled: true, Firewall: FirewallIptables}
+	r.cfg.DnsmasqCfg.Servers = []string{"1.1.1.1"}
+	dnsmasqConf := func() string {
+		conf, _ := ioutil.ReadFile(r.cfg.DnsmasqCfg.CfgFile)
+		return string(conf)
+	}
+
+	m := r.start()
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+	waitFor(t, "dnsmasq", func() bool { return r.exec.called("dnsmasq") })
+	if strings.Contains(dnsmasqConf(), "server=") {
+		t.Errorf("upstream servers without an uplink:\n%s", dnsmasqConf())
+	}
+
+	// the client brings the upstream servers
+	m.Request(ModeClient, "test")
+	waitState(t, m, StateClient)
+	waitFor(t, "dnsmasq restart", func() bool { return countPrefix(r.exec, "dnsmasq ") == 2 })
+	if !strings.Contains(dnsmasqConf(), "server=1.1.1.1\n") {
+		t.Errorf("missing upstream server:\n%s", dnsmasqConf())
+	}
+
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+	waitFor(t, "dnsmasq restart", func() bool { return countPrefix(r.exec, "dnsmasq ") == 3 })
+	if strings.Contains(dnsmasqConf(), "server=") {
+		t.Errorf("upstream servers without an uplink:\n%s", dnsmasqConf())
+	}
+}
+
+func TestConnManagerReloadClient(t *testing.T) {
+	r := newFakeRadio(t)
+	m := r.start()
+
+	cfgFile := r.cfg.HostApdCfg.CfgFile
+	m.Request(ModeClient, "test")
+	waitState(t, m, StateClient)
+	before := len(r.exec.Calls())
+
+	// the station connection stays up, the settings are used later
+	next := *r.cfg
+	next.HostApdCfg.Ssid = "renamed"
+	m.Reload(&next, "new ssid")
+	time.Sleep(100 * time.Millisecond)
+	if calls := r.exec.Calls()[before:]; len(calls) != 0 {
+		t.Fatalf("unexpected calls %q", calls)
+	}
+
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+	hostapdConf, _ := ioutil.ReadFile(cfgFile)
+	if !strings.Contains(string(hostapdConf), "ssid=renamed") {
+		t.Error("hostapd.conf does not have the reloaded ssid")
+	}
+}
+
+func countPrefix(f *fakeExecutor, prefix string) int {
+	n := 0
+	for _, c := range f.Calls() {
+		if strings.HasPrefix(c, prefix) {
+			n++
+		}
+	}
+	return n
+}
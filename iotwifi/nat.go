@@ -0,0 +1,296 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Firewalls of RoutingCfg.Firewall.
+const (
+	FirewallNftables = "nftables"
+	FirewallIptables = "iptables"
+)
+
+// ipForwardFile switches IPv4 forwarding.
+var ipForwardFile = "/proc/sys/net/ipv4/ip_forward"
+
+// natTable is the nftables table, and the iptables rule comment, that
+// marks the rules installed by Nat.
+const natTable = "txwifi"
+
+// Nat shares the station uplink with the access point clients: it
+// enables IP forwarding and masquerades the access point subnet.
+type Nat struct {
+	Executor Executor
+	Firewall string // nftables or iptables
+	Ap       string // uap0
+	Uplink   string // wlan0
+	Subnet   string // 192.168.27.0/24
+
+	mu      sync.Mutex
+	up      bool
+	forward string // ip_forward before Up, restored by Down
+}
+
+// NewNat produces the Nat of a configuration. The firewall is nftables
+// when the executor runs the nft command and iptables otherwise, unless
+// RoutingCfg.Firewall is set.
+func NewNat(setupCfg *SetupCfg) (*Nat, error) {
+	subnet, err := natSubnet(setupCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	nat := &Nat{
+		Executor: setupCfg.executor(),
+		Firewall: setupCfg.Routing.Firewall,
+		Ap:       setupCfg.Interfaces.Ap,
+		Uplink:   setupCfg.Interfaces.Station,
+		Subnet:   subnet,
+	}
+	if nat.Firewall == "" {
+		nat.Firewall = FirewallIptables
+		if _, err := nat.Executor.Output("nft", "--version"); err == nil {
+			nat.Firewall = FirewallNftables
+		}
+	}
+	return nat, nil
+}
+
+// natSubnet returns the access point subnet of a configuration.
+func natSubnet(setupCfg *SetupCfg) (string, error) {
+	_, ipNet, err := apNetwork(setupCfg.HostApdCfg, setupCfg.DnsmasqCfg)
+	if err != nil {
+		return "", fmt.Errorf("host_apd_cfg.ip: %w", err)
+	}
+	return ipNet.String(), nil
+}
+
+// Up enables forwarding and installs the rules, replacing any left
+// behind by an earlier run.
+func (n *Nat) Up() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.up {
+		return nil
+	}
+
+	forward, err := ioutil.ReadFile(ipForwardFile)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(ipForwardFile, []byte("1\n"), 0644); err != nil {
+		return err
+	}
+	n.forward = strings.TrimSpace(string(forward))
+
+	if err := n.installRules(); err != nil {
+		n.restoreForward()
+		return err
+	}
+
+	log.Infof("sharing %s with %s (%s) through %s", n.Uplink, n.Ap, n.Subnet, n.Firewall)
+	n.up = true
+	return nil
+}
+
+// SetSubnet changes the masqueraded subnet once the access point address
+// changed, and re-installs the rules when they are installed.
+func (n *Nat) SetSubnet(subnet string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if subnet == n.Subnet {
+		return nil
+	}
+	if !n.up {
+		n.Subnet = subnet
+		return nil
+	}
+
+	// the iptables rules are removed by their subnet
+	n.removeRules()
+	n.Subnet = subnet
+	if err := n.installRules(); err != nil {
+		n.up = false
+		n.restoreForward()
+		return err
+	}
+	log.Infof("sharing %s with %s (%s) through %s", n.Uplink, n.Ap, n.Subnet, n.Firewall)
+	return nil
+}
+
+// Down removes the rules and restores forwarding as it was before Up.
+func (n *Nat) Down() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.up {
+		return nil
+	}
+
+	n.removeRules()
+	n.up = false
+	log.Infof("stopped sharing %s with %s", n.Uplink, n.Ap)
+	return n.restoreForward()
+}
+
+// Active reports whether the rules are installed.
+func (n *Nat) Active() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.up
+}
+
+func (n *Nat) restoreForward() error {
+	if n.forward == "" || n.forward == "1" {
+		return nil
+	}
+	return ioutil.WriteFile(ipForwardFile, []byte(n.forward+"\n"), 0644)
+}
+
+func (n *Nat) command() string {
+	if n.Firewall == FirewallNftables {
+		return "nft"
+	}
+	return "iptables"
+}
+
+// rules returns the commands that install the rules: masquerading
+// outgoing traffic and forwarding replies only.
+func (n *Nat) rules() [][]string {
+	if n.Firewall == FirewallNftables {
+		return [][]string{
+			{"add", "table", "ip", natTable},
+			{"add", "chain", "ip", natTable, "forward", "{ type filter hook forward priority 0 ; policy accept ; }"},
+			{"add", "rule", "ip", natTable, "forward", "iifname", n.Ap, "oifname", n.Uplink, "accept"},
+			{"add", "rule", "ip", natTable, "forward", "iifname", n.Uplink, "oifname", n.Ap, "ct", "state", "related,established", "accept"},
+			{"add", "rule", "ip", natTable, "forward", "iifname", n.Uplink, "oifname", n.Ap, "drop"},
+			{"add", "chain", "ip", natTable, "postrouting", "{ type nat hook postrouting priority 100 ; policy accept ; }"},
+			{"add", "rule", "ip", natTable, "postrouting", "ip", "saddr", n.Subnet, "oifname", n.Uplink, "masquerade"},
+		}
+	}
+
+	// -I puts a rule first in its chain, so they are inserted last to
+	// first
+	var rules [][]string
+	ipt := n.iptablesRules()
+	for i := len(ipt) - 1; i >= 0; i-- {
+		rules = append(rules, ipt[i].args("-I"))
+	}
+	return rules
+}
+
+// iptablesRule is an iptables rule of a chain in a table.
+type iptablesRule struct {
+	table string
+	chain string
+	spec  []string
+}
+
+// args returns the iptables arguments to insert (-I) or delete (-D) the
+// rule.
+func (r iptablesRule) args(op string) []string {
+	return append([]string{"-t", r.table, op, r.chain}, r.spec...)
+}
+
+// iptablesRules returns the rules in chain order, marked with a
+// comment. They match the nftables rules.
+func (n *Nat) iptablesRules() []iptablesRule {
+	return []iptablesRule{
+		{"filter", "FORWARD", []string{"-i", n.Ap, "-o", n.Uplink,
+			"-m", "comment", "--comment", natTable, "-j", "ACCEPT"}},
+		{"filter", "FORWARD", []string{"-i", n.Uplink, "-o", n.Ap, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED",
+			"-m", "comment", "--comment", natTable, "-j", "ACCEPT"}},
+		{"filter", "FORWARD", []string{"-i", n.Uplink, "-o", n.Ap,
+			"-m", "comment", "--comment", natTable, "-j", "DROP"}},
+		{"nat", "POSTROUTING", []string{"-s", n.Subnet, "-o", n.Uplink,
+			"-m", "comment", "--comment", natTable, "-j", "MASQUERADE"}},
+	}
+}
+
+// installRules replaces the rules, removing them all when one fails.
+func (n *Nat) installRules() error {
+	n.removeRules()
+	for _, rule := range n.rules() {
+		if _, err := n.Executor.Output(n.command(), rule...); err != nil {
+			n.removeRules()
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRules removes the rules, ignoring those that are not installed.
+func (n *Nat) removeRules() {
+	if n.Firewall == FirewallNftables {
+		n.Executor.Output("nft", "delete", "table", "ip", natTable)
+		return
+	}
+	for _, rule := range n.iptablesRules() {
+		n.Executor.Output("iptables", rule.args("-D")...)
+	}
+}
+
+// MonitorNat shares the uplink while the client connection is up and the
+// access point is running, and stops sharing it when either goes down
+// and when ctx is done. The rules follow a reloaded access point address.
+func MonitorNat(ctx context.Context, manager *ConnManager, wpa *WpaCtrl, apd *ApdCtrl, nat *Nat) {
+	events := wpa.Events(ctx)
+	reloads, unsubscribe := manager.Events.Subscribe()
+	defer unsubscribe()
+	check := time.NewTicker(10 * time.Second)
+	defer check.Stop()
+
+	evaluate := func() {
+		wpaState, err := wpa.State()
+		connected := err == nil && wpaState == "COMPLETED" && manager.State() == StateClient && apd.Running()
+		if connected {
+			if err := nat.Up(); err != nil {
+				log.Errorf("unable to share the uplink: %s", err)
+			}
+			return
+		}
+		if err := nat.Down(); err != nil {
+			log.Errorf("unable to stop sharing the uplink: %s", err)
+		}
+	}
+
+	evaluate()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := nat.Down(); err != nil {
+				log.Errorf("unable to stop sharing the uplink: %s", err)
+			}
+			return
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			evaluate()
+		case ev, ok := <-reloads:
+			if !ok {
+				reloads = nil
+				continue
+			}
+			if reload, isReload := ev.Data.(CfgReload); isReload && reload.Changes.ApIp {
+				cfg := manager.Config()
+				subnet, err := natSubnet(&cfg)
+				if err == nil {
+					err = nat.SetSubnet(subnet)
+				}
+				if err != nil {
+					log.Errorf("unable to share the uplink with the new access point address: %s", err)
+				}
+			}
+		case <-check.C:
+			evaluate()
+		}
+	}
+}
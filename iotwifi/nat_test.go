@@ -0,0 +1,270 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeIpForward points ipForwardFile at a temporary file holding value.
+func fakeIpForward(t *testing.T, value string) string {
+	file := filepath.Join(t.TempDir(), "ip_forward")
+	ioutil.WriteFile(file, []byte(value+"\n"), 0644)
+
+	old := ipForwardFile
+	ipForwardFile = file
+	t.Cleanup(func() { ipForwardFile = old })
+	return file
+}
+
+func readIpForward(t *testing.T, file string) string {
+	data, _ := ioutil.ReadFile(file)
+	return strings.TrimSpace(string(data))
+}
+
+func newNat(t *testing.T, cfg *SetupCfg) *Nat {
+	t.Helper()
+	nat, err := NewNat(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nat
+}
+
+// withPrefix returns the calls starting with prefix.
+func withPrefix(calls []string, prefix string) []string {
+	var out []string
+	for _, c := range calls {
+		if strings.HasPrefix(c, prefix) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func TestNatIptables(t *testing.T) {
+	forward := fakeIpForward(t, "0")
+	r := newFakeRadio(t)
+	r.cfg.Routing = RoutingCfg{Enabled: true, Firewall: FirewallIptables}
+
+	nat := newNat(t, r.cfg)
+	if nat.Subnet != "192.168.27.0/24" || nat.Ap != "uap0" || nat.Uplink != "wlan0" {
+		t.Fatalf("unexpected nat %+v", nat)
+	}
+
+	if err := nat.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readIpForward(t, forward); got != "1" {
+		t.Errorf("ip_forward %s", got)
+	}
+	assertOrder(t, r.exec.Calls(), "iptables -t nat -D POSTROUTING -s 192.168.27.0/24 -o wlan0", "iptables -t nat -I")
+	// inserted last to first, each one first in its chain
+	if got := withPrefix(r.exec.Calls(), "iptables -t"); !reflect.DeepEqual(got[len(got)-4:], []string{
+		"iptables -t nat -I POSTROUTING -s 192.168.27.0/24 -o wlan0 -m comment --comment txwifi -j MASQUERADE",
+		"iptables -t filter -I FORWARD -i wlan0 -o uap0 -m comment --comment txwifi -j DROP",
+		"iptables -t filter -I FORWARD -i wlan0 -o uap0 -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment txwifi -j ACCEPT",
+		"iptables -t filter -I FORWARD -i uap0 -o wlan0 -m comment --comment txwifi -j ACCEPT",
+	}) {
+		t.Errorf("unexpected rules %q", got)
+	}
+
+	// a second Up changes nothing
+	calls := len(r.exec.Calls())
+	nat.Up()
+	if len(r.exec.Calls()) != calls || !nat.Active() {
+		t.Errorf("Up is not idempotent: %q", r.exec.Calls()[calls:])
+	}
+
+	if err := nat.Down(); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, r.exec.Calls()[calls:],
+		"iptables -t filter -D FORWARD -i uap0 -o wlan0",
+		"iptables -t filter -D FORWARD -i wlan0 -o uap0 -m conntrack",
+		"iptables -t filter -D FORWARD -i wlan0 -o uap0 -m comment --comment txwifi -j DROP",
+		"iptables -t nat -D POSTROUTING",
+	)
+	if got := readIpForward(t, forward); got != "0" || nat.Active() {
+		t.Errorf("ip_forward %s, active %t after Down", got, nat.Active())
+	}
+}
+
+func TestNatNftables(t *testing.T) {
+	forward := fakeIpForward(t, "1")
+	r := newFakeRadio(t)
+	r.cfg.HostApdCfg.Ip = "10.1.0.1/16"
+	r.cfg.DnsmasqCfg.DhcpRange = "10.1.1.1,10.1.1.200,1h"
+	r.cfg.Routing = RoutingCfg{Enabled: true, Firewall: FirewallNftables}
+
+	nat := newNat(t, r.cfg)
+	if err := nat.Up(); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, r.exec.Calls(), "nft delete table ip txwifi", "nft add table ip txwifi")
+	if got := withPrefix(r.exec.Calls(), "nft add"); !reflect.DeepEqual(got, []string{
+		"nft add table ip txwifi",
+		"nft add chain ip txwifi forward { type filter hook forward priority 0 ; policy accept ; }",
+		"nft add rule ip txwifi forward iifname uap0 oifname wlan0 accept",
+		"nft add rule ip txwifi forward iifname wlan0 oifname uap0 ct state related,established accept",
+		"nft add rule ip txwifi forward iifname wlan0 oifname uap0 drop",
+		"nft add chain ip txwifi postrouting { type nat hook postrouting priority 100 ; policy accept ; }",
+		"nft add rule ip txwifi postrouting ip saddr 10.1.0.0/16 oifname wlan0 masquerade",
+	}) {
+		t.Errorf("unexpected rules %q", got)
+	}
+
+	calls := len(r.exec.Calls())
+	nat.Down()
+	if got := r.exec.Calls()[calls:]; len(got) != 1 || got[0] != "nft delete table ip txwifi" {
+		t.Errorf("unexpected calls %q", got)
+	}
+	// forwarding was on before, so it stays on
+	if got := readIpForward(t, forward); got != "1" {
+		t.Errorf("ip_forward %s", got)
+	}
+}
+
+func TestNatSubnet(t *testing.T) {
+	fakeIpForward(t, "0")
+	r := newFakeRadio(t)
+	r.cfg.Routing = RoutingCfg{Enabled: true, Firewall: FirewallIptables}
+
+	// no subnet, no rules
+	r.cfg.HostApdCfg.Ip = ""
+	if _, err := NewNat(r.cfg); err == nil {
+		t.Error("expected an error without an access point address")
+	}
+
+	r.cfg.HostApdCfg.Ip = "192.168.27.1"
+	nat := newNat(t, r.cfg)
+	if err := nat.Up(); err != nil {
+		t.Fatal(err)
+	}
+	calls := len(r.exec.Calls())
+	if err := nat.SetSubnet("10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, r.exec.Calls()[calls:],
+		"iptables -t nat -D POSTROUTING -s 192.168.27.0/24 -o wlan0",
+		"iptables -t nat -I POSTROUTING -s 10.1.0.0/16 -o wlan0",
+	)
+	if !nat.Active() {
+		t.Error("not sharing after the subnet changed")
+	}
+
+	// a subnet set while not sharing is used by the next Up
+	nat.Down()
+	calls = len(r.exec.Calls())
+	nat.SetSubnet("10.2.0.0/16")
+	if got := r.exec.Calls()[calls:]; len(got) != 0 {
+		t.Errorf("unexpected calls %q", got)
+	}
+	nat.Up()
+	assertOrder(t, r.exec.Calls()[calls:], "iptables -t nat -I POSTROUTING -s 10.2.0.0/16 -o wlan0")
+}
+
+func TestNatFirewall(t *testing.T) {
+	r := newFakeRadio(t)
+	r.cfg.Routing = RoutingCfg{Enabled: true}
+
+	// nftables when the executor runs nft
+	if nat := newNat(t, r.cfg); nat.Firewall != FirewallNftables || !r.exec.called("nft --version") {
+		t.Errorf("firewall %s, calls %q", nat.Firewall, r.exec.Calls())
+	}
+	r.exec.errs["nft --version"] = errors.New("executable file not found")
+	if nat := newNat(t, r.cfg); nat.Firewall != FirewallIptables {
+		t.Errorf("firewall %s without nft", nat.Firewall)
+	}
+
+	// a configured firewall is used as it is
+	r.cfg.Routing.Firewall = FirewallNftables
+	calls := len(r.exec.Calls())
+	if nat := newNat(t, r.cfg); nat.Firewall != FirewallNftables || len(r.exec.Calls()) != calls {
+		t.Errorf("firewall %s, calls %q", nat.Firewall, r.exec.Calls()[calls:])
+	}
+}
+
+func TestRoutedClient(t *testing.T) {
+	fakeIpForward(t, "0")
+	r := newFakeRadio(t)
+	r.cfg.Routing = RoutingCfg{Enabled: true, Firewall: FirewallIptables}
+
+	m := r.start()
+	m.Request(ModeAP, "test")
+	waitState(t, m, StateAP)
+	waitFor(t, "dnsmasq", func() bool { return r.exec.called("dnsmasq") })
+
+	before := len(r.exec.Calls())
+	m.Request(ModeClient, "test")
+	waitState(t, m, StateClient)
+
+	// the access point stays up next to the client, dnsmasq is only
+	// restarted to forward to the name servers of the station
+	waitFor(t, "dnsmasq restart", func() bool { return countPrefix(r.exec, "dnsmasq ") == 2 })
+	calls := r.exec.Calls()[before:]
+	for _, c := range calls {
+		if strings.HasPrefix(c, "hostapd") || strings.HasPrefix(c, "iw dev uap0 del") {
+			t.Errorf("unexpected call %q", c)
+		}
+	}
+	assertOrder(t, calls, "wpa_supplicant", "dnsmasq")
+	if conf, _ := ioutil.ReadFile(r.cfg.DnsmasqCfg.CfgFile); strings.Contains(string(conf), "no-resolv") {
+		t.Errorf("dnsmasq does not read resolv.conf:\n%s", conf)
+	}
+	r.mu.Lock()
+	if r.apd == nil {
+		t.Error("hostapd stopped in routed client mode")
+	}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	nat := newNat(t, r.cfg)
+	done := make(chan struct{})
+	go func() {
+		MonitorNat(ctx, m, NewWpaCtrl(r.cfg.WpaSupplicantCfg.CtrlInterface, "wlan0"),
+			NewApdCtrl(r.cfg.HostApdCfg.CtrlInterface, "uap0"), nat)
+		close(done)
+	}()
+
+	r.mu.Lock()
+	wpa := r.wpa
+	r.mu.Unlock()
+	wpa.waitAttached(t)
+	if nat.Active() {
+		t.Fatal("sharing before the client is connected")
+	}
+
+	wpa.SetReply("STATUS", "wpa_state=COMPLETED\n")
+	wpa.Emit("<3>CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed")
+	waitFor(t, "nat up", nat.Active)
+
+	wpa.SetReply("STATUS", "wpa_state=DISCONNECTED\n")
+	wpa.Emit("<3>CTRL-EVENT-DISCONNECTED bssid=00:11:22:33:44:55 reason=3")
+	waitFor(t, "nat down", func() bool { return !nat.Active() })
+
+	// shutting down removes the rules
+	wpa.SetReply("STATUS", "wpa_state=COMPLETED\n")
+	wpa.Emit("<3>CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed")
+	waitFor(t, "nat up", nat.Active)
+
+	// a new access point address moves the rules along
+	next := *r.cfg
+	next.HostApdCfg.Ip = "192.168.28.1"
+	next.DnsmasqCfg.DhcpRange = "192.168.28.100,192.168.28.150,1h"
+	m.Reload(&next, "new address")
+	waitFor(t, "new subnet", func() bool { return r.exec.called("iptables -t nat -I POSTROUTING -s 192.168.28.0/24") })
+	if !nat.Active() {
+		t.Error("not sharing after the address changed")
+	}
+
+	cancel()
+	<-done
+	if nat.Active() {
+		t.Error("still sharing after shutdown")
+	}
+}
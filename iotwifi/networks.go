@@ -0,0 +1,330 @@
+package iotwifi
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoSuchNetwork is returned for a network id wpa_supplicant does not know.
+var ErrNoSuchNetwork = errors.New("no such network")
+
+// WpaSavedNetwork is a network stored in the wpa_supplicant configuration.
+type WpaSavedNetwork struct {
+	Id       string `json:"id"`
+	Ssid     string `json:"ssid"`
+	Bssid    string `json:"bssid"`
+	Flags    string `json:"flags"`
+	Priority int    `json:"priority"`
+	Current  bool   `json:"current"`
+	Disabled bool   `json:"disabled"`
+}
+
+// WpaNetworkUpdate changes a saved network. Fields left nil are not
+// touched.
+type WpaNetworkUpdate struct {
+	Ssid     *string `json:"ssid"`
+	Psk      *string `json:"psk"`
+	Priority *int    `json:"priority"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// ListNetworks returns the saved networks along with their priorities.
+func (wpa *WpaCfg) ListNetworks() ([]WpaSavedNetwork, error) {
+	networks, err := wpa.Ctrl.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, n := range networks {
+		p, err := wpa.Ctrl.GetNetwork(n.Id, "priority")
+		if err != nil {
+			continue
+		}
+		networks[i].Priority, _ = strconv.Atoi(p)
+	}
+
+	return networks, nil
+}
+
+// GetNetwork returns a saved network by id.
+func (wpa *WpaCfg) GetNetwork(id string) (WpaSavedNetwork, error) {
+	networks, err := wpa.ListNetworks()
+	if err != nil {
+		return WpaSavedNetwork{}, err
+	}
+
+	for _, n := range networks {
+		if n.Id == id {
+			return n, nil
+		}
+	}
+
+	return WpaSavedNetwork{}, fmt.Errorf("%w: %s", ErrNoSuchNetwork, id)
+}
+
+// AddNetwork saves a network without connecting to it. wpa_supplicant
+// picks it up by priority whenever it is in range.
+func (wpa *WpaCfg) AddNetwork(creds WpaCredentials) (WpaSavedNetwork, error) {
+	id, err := wpa.Ctrl.AddNetwork()
+	if err != nil {
+		return WpaSavedNetwork{}, err
+	}
+	log.Infof("WPA add network got: %s", id)
+
+	if err := wpa.setCredentials(id, creds); err != nil {
+		wpa.Ctrl.RemoveNetwork(id)
+		return WpaSavedNetwork{}, err
+	}
+
+	if err := wpa.Ctrl.EnableNetwork(id); err != nil {
+		wpa.Ctrl.RemoveNetwork(id)
+		return WpaSavedNetwork{}, err
+	}
+
+	if err := wpa.Ctrl.SaveConfig(); err != nil {
+		return WpaSavedNetwork{}, err
+	}
+
+	return wpa.GetNetwork(id)
+}
+
+// UpdateNetwork changes the credentials, priority or enabled state of a
+// saved network. New credentials are validated like those of
+// AddNetwork.
+func (wpa *WpaCfg) UpdateNetwork(id string, update WpaNetworkUpdate) (WpaSavedNetwork, error) {
+	network, err := wpa.GetNetwork(id)
+	if err != nil {
+		return WpaSavedNetwork{}, err
+	}
+
+	if update.Ssid != nil || update.Psk != nil {
+		creds, err := wpa.updatedCredentials(id, network, update)
+		if err != nil {
+			return WpaSavedNetwork{}, err
+		}
+		if update.Ssid != nil {
+			if err := wpa.Ctrl.SetNetwork(id, "ssid", "\""+creds.Ssid+"\""); err != nil {
+				return WpaSavedNetwork{}, err
+			}
+		}
+		if update.Psk != nil {
+			// WPA3-only networks keep their password in sae_password
+			name, value := "psk", quotePsk(creds.Psk)
+			if creds.KeyMgmt == SecurityWpa3 {
+				name, value = "sae_password", "\""+creds.Psk+"\""
+			}
+			if err := wpa.Ctrl.SetNetwork(id, name, value); err != nil {
+				return WpaSavedNetwork{}, err
+			}
+		}
+	}
+	if update.Priority != nil {
+		if err := wpa.Ctrl.SetNetwork(id, "priority", strconv.Itoa(*update.Priority)); err != nil {
+			return WpaSavedNetwork{}, err
+		}
+	}
+	if update.Disabled != nil {
+		toggle := wpa.Ctrl.EnableNetwork
+		if *update.Disabled {
+			toggle = wpa.Ctrl.DisableNetwork
+		}
+		if err := toggle(id); err != nil {
+			return WpaSavedNetwork{}, err
+		}
+	}
+
+	if err := wpa.Ctrl.SaveConfig(); err != nil {
+		return WpaSavedNetwork{}, err
+	}
+
+	return wpa.GetNetwork(id)
+}
+
+// pskKeyMgmt maps the key_mgmt of a saved network to the security mode
+// of its passphrase.
+var pskKeyMgmt = map[string]string{
+	"WPA-PSK":     SecurityWpa2,
+	"SAE":         SecurityWpa3,
+	"WPA-PSK SAE": SecurityTransition,
+}
+
+// updatedCredentials returns the credentials of a saved network with an
+// update applied, once they pass WpaCredentials.Validate.
+func (wpa *WpaCfg) updatedCredentials(id string, network WpaSavedNetwork, update WpaNetworkUpdate) (WpaCredentials, error) {
+	creds := WpaCredentials{Ssid: network.Ssid}
+	if update.Ssid != nil {
+		creds.Ssid = *update.Ssid
+	}
+	if update.Psk != nil {
+		keyMgmt, _ := wpa.Ctrl.GetNetwork(id, "key_mgmt")
+		mode, ok := pskKeyMgmt[keyMgmt]
+		if !ok {
+			v := &validator{}
+			v.add("psk", "only applies to WPA-PSK and SAE networks, key_mgmt is %s", keyMgmt)
+			return creds, v.credentialsErr()
+		}
+		creds.Psk, creds.KeyMgmt = *update.Psk, mode
+	}
+
+	return creds, creds.Validate()
+}
+
+// Enterprise key management of WpaCredentials.KeyMgmt.
+const (
+	KeyMgmtWpa2Eap = "wpa2-eap" // WPA-EAP
+	KeyMgmtWpa3Eap = "wpa3-eap" // WPA-EAP-SHA256 with PMF
+)
+
+// EAP methods of EapCredentials.Method.
+const (
+	EapPeap = "PEAP"
+	EapTtls = "TTLS"
+	EapTls  = "TLS"
+)
+
+// keyMgmt returns the key management of the credentials, see KeyMgmt.
+func (c WpaCredentials) keyMgmt() string {
+	if c.KeyMgmt == "" && c.Eap != nil {
+		return KeyMgmtWpa2Eap
+	}
+	return securityMode(c.KeyMgmt, c.Psk)
+}
+
+// setCredentials sets the ssid, security and priority of a network.
+func (wpa *WpaCfg) setCredentials(id string, creds WpaCredentials) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	if err := wpa.checkCerts(creds); err != nil {
+		return err
+	}
+
+	for _, kv := range creds.networkSettings(wpa.Certs.Dir) {
+		if err := wpa.Ctrl.SetNetwork(id, kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCerts checks that the certificates and keys of enterprise
+// credentials were uploaded.
+func (wpa *WpaCfg) checkCerts(creds WpaCredentials) error {
+	if creds.Eap == nil {
+		return nil
+	}
+
+	v := &validator{}
+	for _, f := range []struct{ field, name string }{
+		{"eap.ca_cert", creds.Eap.CaCert},
+		{"eap.client_cert", creds.Eap.ClientCert},
+		{"eap.private_key", creds.Eap.PrivateKey},
+	} {
+		if f.name == "" {
+			continue
+		}
+		if _, err := wpa.Certs.Path(f.name); err != nil {
+			v.add(f.field, "%s was not uploaded", f.name)
+		}
+	}
+	return v.credentialsErr()
+}
+
+// networkSettings returns the wpa_supplicant network settings of the
+// credentials in the order they are set. Certificates are in certDir.
+func (c WpaCredentials) networkSettings(certDir string) [][2]string {
+	settings := [][2]string{{"ssid", "\"" + c.Ssid + "\""}}
+	if c.Bssid != "" {
+		settings = append(settings, [2]string{"bssid", c.Bssid})
+	}
+	if c.Hidden {
+		settings = append(settings, [2]string{"scan_ssid", "1"})
+	}
+
+	mode := c.keyMgmt()
+	switch mode {
+	case SecurityOpen:
+		settings = append(settings, [2]string{"key_mgmt", "NONE"})
+	case SecurityOwe:
+		settings = append(settings, [2]string{"key_mgmt", "OWE"})
+	case SecurityWpa2:
+		settings = append(settings, [2]string{"key_mgmt", "WPA-PSK"}, [2]string{"psk", quotePsk(c.Psk)})
+	case SecurityWpa3:
+		settings = append(settings, [2]string{"key_mgmt", "SAE"}, [2]string{"sae_password", "\"" + c.Psk + "\""})
+	case SecurityTransition:
+		// wpa_supplicant uses the psk for SAE too
+		settings = append(settings, [2]string{"key_mgmt", "WPA-PSK SAE"}, [2]string{"psk", quotePsk(c.Psk)})
+	case KeyMgmtWpa2Eap:
+		settings = append(settings, [2]string{"key_mgmt", "WPA-EAP"})
+		settings = append(settings, c.Eap.networkSettings(certDir)...)
+	case KeyMgmtWpa3Eap:
+		settings = append(settings, [2]string{"key_mgmt", "WPA-EAP-SHA256"})
+		settings = append(settings, c.Eap.networkSettings(certDir)...)
+	}
+
+	// the global pmf setting of wpa_supplicant applies unless one is
+	// set or the security mode requires one
+	if pmf := pmfMode(c.Pmf, mode); c.Pmf != "" || pmf != PmfDisabled {
+		level := map[string]string{PmfDisabled: "0", PmfOptional: "1", PmfRequired: "2"}[pmf]
+		settings = append(settings, [2]string{"ieee80211w", level})
+	}
+
+	if c.Priority != 0 {
+		settings = append(settings, [2]string{"priority", strconv.Itoa(c.Priority)})
+	}
+	return settings
+}
+
+// networkSettings returns the wpa_supplicant settings of 802.1X
+// credentials. PEAP and TTLS default to MSCHAPV2.
+func (c EapCredentials) networkSettings(certDir string) [][2]string {
+	quote := func(s string) string { return "\"" + s + "\"" }
+
+	method := strings.ToUpper(c.Method)
+	settings := [][2]string{
+		{"eap", method},
+		{"identity", quote(c.Identity)},
+	}
+	if c.AnonymousIdentity != "" {
+		settings = append(settings, [2]string{"anonymous_identity", quote(c.AnonymousIdentity)})
+	}
+	if method != EapTls {
+		phase2 := strings.ToUpper(c.Phase2)
+		if phase2 == "" {
+			phase2 = "MSCHAPV2"
+		}
+		settings = append(settings,
+			[2]string{"password", quote(c.Password)},
+			[2]string{"phase2", quote("auth=" + phase2)},
+		)
+	}
+
+	settings = append(settings, [2]string{"ca_cert", quote(filepath.Join(certDir, c.CaCert))})
+	if c.DomainSuffixMatch != "" {
+		settings = append(settings, [2]string{"domain_suffix_match", quote(c.DomainSuffixMatch)})
+	}
+	if c.ClientCert != "" {
+		settings = append(settings, [2]string{"client_cert", quote(filepath.Join(certDir, c.ClientCert))})
+	}
+	if c.PrivateKey != "" {
+		settings = append(settings, [2]string{"private_key", quote(filepath.Join(certDir, c.PrivateKey))})
+	}
+	if c.PrivateKeyPasswd != "" {
+		settings = append(settings, [2]string{"private_key_passwd", quote(c.PrivateKeyPasswd)})
+	}
+	return settings
+}
+
+// quotePsk quotes a passphrase for wpa_supplicant, leaving 64 digit hex
+// keys as they are.
+func quotePsk(psk string) string {
+	if hexKey.MatchString(psk) {
+		return psk
+	}
+	return "\"" + psk + "\""
+}
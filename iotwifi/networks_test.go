@@ -0,0 +1,308 @@
+package iotwifi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const listNetworks = "network id / ssid / bssid / flags\n" +
+	"0\twarehouse\tany\t[CURRENT]\n" +
+	"1\tshop floor\t00:11:22:33:44:55\t[DISABLED]\n"
+
+func TestParseListNetworks(t *testing.T) {
+	networks := parseListNetworks(listNetworks)
+	if len(networks) != 2 {
+		t.Fatalf("got %d networks, want 2: %+v", len(networks), networks)
+	}
+
+	if n := networks[0]; n.Id != "0" || n.Ssid != "warehouse" || !n.Current || n.Disabled {
+		t.Errorf("unexpected network %+v", n)
+	}
+	if n := networks[1]; n.Id != "1" || n.Ssid != "shop floor" || n.Bssid != "00:11:22:33:44:55" || n.Current || !n.Disabled {
+		t.Errorf("unexpected network %+v", n)
+	}
+
+	if n := parseListNetworks("network id / ssid / bssid / flags\n"); len(n) != 0 {
+		t.Errorf("unexpected networks %+v", n)
+	}
+}
+
+// newNetworksHandler returns a handler backed by a fake wpa_supplicant
+// with two saved networks.
+func newNetworksHandler(t *testing.T) (*HttpHandler, *fakeDaemon) {
+	r := newFakeRadio(t)
+	d := startFakeDaemon(t, filepath.Join(r.cfg.WpaSupplicantCfg.CtrlInterface, "wlan0"), map[string]string{
+		"LIST_NETWORKS":          listNetworks,
+		"GET_NETWORK":            "FAIL\n",
+		"GET_NETWORK 0 priority": "5\n",
+		"GET_NETWORK 1 key_mgmt": "WPA-PSK\n",
+		"ADD_NETWORK":            "1\n",
+		"SET_NETWORK":            "OK\n",
+		"ENABLE_NETWORK":         "OK\n",
+		"DISABLE_NETWORK":        "OK\n",
+		"REMOVE_NETWORK":         "OK\n",
+		"SAVE_CONFIG":            "OK\n",
+	})
+	return &HttpHandler{wpacfg: NewWpaCfg(r.cfg)}, d
+}
+
+func serveApi(t *testing.T, handler http.HandlerFunc, method string, url string, body string) ApiReturn {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+
+	var ret ApiReturn
+	if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+		t.Fatalf("%s %s: %s: %q", method, url, err, w.Body.String())
+	}
+	return ret
+}
+
+func TestNetworksHandler(t *testing.T) {
+	h, _ := newNetworksHandler(t)
+
+	ret := serveApi(t, h.NetworksHandler, "GET", "/networks", "")
+	networks, _ := ret.Payload.([]interface{})
+	if ret.Status != "OK" || len(networks) != 2 {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	if first := networks[0].(map[string]interface{}); first["priority"] != 5.0 || first["ssid"] != "warehouse" {
+		t.Errorf("unexpected network %v", first)
+	}
+}
+
+func TestAddNetworkHandler(t *testing.T) {
+	h, d := newNetworksHandler(t)
+
+	ret := serveApi(t, h.AddNetworkHandler, "POST", "/networks", `{"ssid":"shop floor","psk":"secret123","priority":3}`)
+	if ret.Status != "OK" || ret.Message != "Added network 1" {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+
+	assertOrder(t, d.Requests(),
+		"ADD_NETWORK",
+		`SET_NETWORK 1 ssid "shop floor"`,
+		`SET_NETWORK 1 psk "secret123"`,
+		"SET_NETWORK 1 priority 3",
+		"ENABLE_NETWORK 1",
+		"SAVE_CONFIG",
+	)
+	for _, req := range d.Requests() {
+		if strings.HasPrefix(req, "REMOVE_NETWORK") || strings.HasPrefix(req, "SELECT_NETWORK") {
+			t.Errorf("unexpected request %q", req)
+		}
+	}
+}
+
+func TestUpdateNetworkHandler(t *testing.T) {
+	h, d := newNetworksHandler(t)
+
+	ret := serveApi(t, h.UpdateNetworkHandler, "PUT", "/networks/1", `{"psk":"newpass123","priority":7,"disabled":false}`)
+	if ret.Status != "OK" {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+
+	requests := d.Requests()
+	assertOrder(t, requests,
+		`SET_NETWORK 1 psk "newpass123"`,
+		"SET_NETWORK 1 priority 7",
+		"ENABLE_NETWORK 1",
+		"SAVE_CONFIG",
+	)
+	for _, req := range requests {
+		if strings.HasPrefix(req, "SET_NETWORK 1 ssid") {
+			t.Errorf("unexpected request %q", req)
+		}
+	}
+
+	ret = serveApi(t, h.UpdateNetworkHandler, "PUT", "/networks/9", `{"priority":1}`)
+	if ret.Status != "FAIL" {
+		t.Errorf("unexpected return %+v", ret)
+	}
+}
+
+func TestUpdateNetworkInvalid(t *testing.T) {
+	h, d := newNetworksHandler(t)
+
+	for _, body := range []string{`{"psk":"abc"}`, `{"psk":"newpass\n123"}`, `{"ssid":""}`} {
+		w := httptest.NewRecorder()
+		h.UpdateNetworkHandler(w, httptest.NewRequest("PUT", "/networks/1", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"FAIL"`) {
+			t.Errorf("%s: status %d, %s", body, w.Code, w.Body.String())
+		}
+	}
+
+	// a psk can't be set on an open network
+	d.SetReply("GET_NETWORK 1 key_mgmt", "NONE\n")
+	if ret := serveApi(t, h.UpdateNetworkHandler, "PUT", "/networks/1", `{"psk":"newpass123"}`); ret.Status != "FAIL" {
+		t.Errorf("unexpected return %+v", ret)
+	}
+
+	for _, req := range d.Requests() {
+		if strings.HasPrefix(req, "SET_NETWORK") || req == "SAVE_CONFIG" {
+			t.Errorf("unexpected request %q", req)
+		}
+	}
+}
+
+func TestForgetNetworkHandler(t *testing.T) {
+	h, d := newNetworksHandler(t)
+
+	ret := serveApi(t, h.ForgetNetworkHandler, "DELETE", "/networks/1", "")
+	if ret.Status != "OK" {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	assertOrder(t, d.Requests(), "REMOVE_NETWORK 1", "SAVE_CONFIG")
+
+	if _, err := h.wpacfg.GetNetwork("9"); !errors.Is(err, ErrNoSuchNetwork) {
+		t.Errorf("err = %v", err)
+	}
+	ret = serveApi(t, h.ForgetNetworkHandler, "DELETE", "/networks/9", "")
+	if ret.Status != "FAIL" {
+		t.Errorf("unexpected return %+v", ret)
+	}
+}
+
+func TestNetworkSettings(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name  string
+		creds WpaCredentials
+		want  []string
+	}{
+		{"wpa2", WpaCredentials{Ssid: "home", Psk: "secret123"},
+			[]string{`ssid "home"`, "key_mgmt WPA-PSK", `psk "secret123"`}},
+		{"hex psk", WpaCredentials{Ssid: "home", Psk: hex},
+			[]string{`ssid "home"`, "key_mgmt WPA-PSK", "psk " + hex}},
+		{"open", WpaCredentials{Ssid: "cafe"},
+			[]string{`ssid "cafe"`, "key_mgmt NONE"}},
+		{"owe", WpaCredentials{Ssid: "cafe", KeyMgmt: SecurityOwe},
+			[]string{`ssid "cafe"`, "key_mgmt OWE", "ieee80211w 2"}},
+		{"wpa3", WpaCredentials{Ssid: "guest", Psk: "secret123", KeyMgmt: SecurityWpa3},
+			[]string{`ssid "guest"`, "key_mgmt SAE", `sae_password "secret123"`, "ieee80211w 2"}},
+		{"transition", WpaCredentials{Ssid: "guest", Psk: "secret123", KeyMgmt: SecurityTransition},
+			[]string{`ssid "guest"`, "key_mgmt WPA-PSK SAE", `psk "secret123"`, "ieee80211w 1"}},
+		{"hidden pinned", WpaCredentials{Ssid: "plant", Psk: "secret123", Hidden: true, Bssid: "00:11:22:33:44:55", Pmf: PmfOptional, Priority: 4},
+			[]string{`ssid "plant"`, "bssid 00:11:22:33:44:55", "scan_ssid 1", "key_mgmt WPA-PSK", `psk "secret123"`, "ieee80211w 1", "priority 4"}},
+		{"peap", WpaCredentials{Ssid: "campus", Eap: &EapCredentials{Method: "peap", Identity: "jo", AnonymousIdentity: "anon", Password: "pw", CaCert: "ca.pem", DomainSuffixMatch: "radius.example.com"}},
+			[]string{`ssid "campus"`, "key_mgmt WPA-EAP", "eap PEAP", `identity "jo"`, `anonymous_identity "anon"`, `password "pw"`,
+				`phase2 "auth=MSCHAPV2"`, `ca_cert "/certs/ca.pem"`, `domain_suffix_match "radius.example.com"`}},
+		{"tls wpa3", WpaCredentials{Ssid: "ward", KeyMgmt: KeyMgmtWpa3Eap, Eap: &EapCredentials{Method: EapTls, Identity: "dev1", CaCert: "ca.pem", ClientCert: "dev1.pem", PrivateKey: "dev1.key", PrivateKeyPasswd: "kp"}},
+			[]string{`ssid "ward"`, "key_mgmt WPA-EAP-SHA256", "eap TLS", `identity "dev1"`, `ca_cert "/certs/ca.pem"`,
+				`client_cert "/certs/dev1.pem"`, `private_key "/certs/dev1.key"`, `private_key_passwd "kp"`, "ieee80211w 2"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, kv := range tt.creds.networkSettings("/certs") {
+			got = append(got, kv[0]+" "+kv[1])
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	tests := []struct {
+		creds WpaCredentials
+		want  []string
+	}{
+		{WpaCredentials{Ssid: "home", Psk: "secret123"}, nil},
+		{WpaCredentials{Ssid: "cafe"}, nil},
+		{WpaCredentials{Ssid: "guest", Psk: "secret123", KeyMgmt: SecurityWpa3, Bssid: "00:11:22:33:44:55"}, nil},
+		{WpaCredentials{Ssid: "", Psk: "short"}, []string{"ssid", "psk"}},
+		{WpaCredentials{Ssid: "home\npsk=x", Psk: "secret123"}, []string{"ssid"}},
+		{WpaCredentials{Ssid: "home\t", Psk: "secret123"}, []string{"ssid"}},
+		{WpaCredentials{Ssid: "guest", KeyMgmt: SecurityWpa3}, []string{"psk"}},
+		{WpaCredentials{Ssid: "cafe", Psk: "secret123", KeyMgmt: SecurityOwe}, []string{"psk"}},
+		{WpaCredentials{Ssid: "guest", Psk: "secret123", KeyMgmt: "wep"}, []string{"key_mgmt"}},
+		{WpaCredentials{Ssid: "guest", Psk: "secret123", KeyMgmt: SecurityWpa3, Pmf: PmfOptional}, []string{"pmf"}},
+		{WpaCredentials{Ssid: "plant", Psk: "secret123", Bssid: "plant-ap"}, []string{"bssid"}},
+		{WpaCredentials{Ssid: "campus", Eap: &EapCredentials{Method: EapTtls, Identity: "jo", Password: "pw", Phase2: "pap", CaCert: "ca.pem"}}, nil},
+		{WpaCredentials{Ssid: "campus", KeyMgmt: KeyMgmtWpa2Eap}, []string{"eap"}},
+		{WpaCredentials{Ssid: "campus", Psk: "secret123", Eap: &EapCredentials{Method: EapPeap, Identity: "jo", Password: "pw", CaCert: "ca.pem"}}, []string{"psk"}},
+		{WpaCredentials{Ssid: "campus", KeyMgmt: SecurityWpa2, Psk: "secret123", Eap: &EapCredentials{}}, []string{"eap"}},
+		{WpaCredentials{Ssid: "campus", Eap: &EapCredentials{Method: "LEAP"}}, []string{"eap.method", "eap.identity", "eap.ca_cert"}},
+		{WpaCredentials{Ssid: "campus", Eap: &EapCredentials{Method: EapPeap, Identity: "jo", CaCert: "../ca.pem"}}, []string{"eap.password", "eap.ca_cert"}},
+		{WpaCredentials{Ssid: "ward", Eap: &EapCredentials{Method: EapTls, Identity: "dev1", Phase2: "PAP", CaCert: "ca.pem"}}, []string{"eap.private_key", "eap.phase2"}},
+		{WpaCredentials{Ssid: "ward", KeyMgmt: KeyMgmtWpa3Eap, Pmf: PmfOptional, Eap: &EapCredentials{Method: EapTls, Identity: "dev1", PrivateKey: "k.p12", CaCert: "ca.pem"}}, []string{"pmf"}},
+	}
+
+	for _, tt := range tests {
+		err := tt.creds.Validate()
+		if got := fields(t, err); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%+v: got %v, want %v", tt.creds, err, tt.want)
+		}
+	}
+}
+
+func TestAddNetworkHandlerInvalid(t *testing.T) {
+	h, d := newNetworksHandler(t)
+
+	ret := serveApi(t, h.AddNetworkHandler, "POST", "/networks", `{"ssid":"guest","key_mgmt":"wpa3"}`)
+	if errs, _ := ret.Payload.([]interface{}); ret.Status != "FAIL" || len(errs) != 1 {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	if !strings.HasPrefix(ret.Message, "invalid credentials: psk: ") {
+		t.Errorf("unexpected message %q", ret.Message)
+	}
+
+	// /connect rejects the credentials before a job is started
+	w := httptest.NewRecorder()
+	h.ConnectHandler(w, httptest.NewRequest("POST", "/connect", strings.NewReader(`{"ssid":"guest","psk":"abc"}`)))
+	var connect ApiReturn
+	if err := json.Unmarshal(w.Body.Bytes(), &connect); err != nil || w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, %s", w.Code, w.Body.String())
+	}
+	if connect.Message != "invalid credentials: psk: must be 8 to 63 characters, is 3" {
+		t.Errorf("unexpected message %q", connect.Message)
+	}
+	for _, req := range d.Requests() {
+		if strings.HasPrefix(req, "SET_NETWORK") {
+			t.Errorf("unexpected request %q", req)
+		}
+	}
+}
+
+func TestUpdateNetworkSae(t *testing.T) {
+	h, d := newNetworksHandler(t)
+	d.SetReply("GET_NETWORK 1 key_mgmt", "SAE\n")
+
+	ret := serveApi(t, h.UpdateNetworkHandler, "PUT", "/networks/1", `{"psk":"newpass123"}`)
+	if ret.Status != "OK" {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	assertOrder(t, d.Requests(), `SET_NETWORK 1 sae_password "newpass123"`, "SAVE_CONFIG")
+}
+
+func TestAddNetworkHandlerEap(t *testing.T) {
+	h, d := newNetworksHandler(t)
+	body := `{"ssid":"campus","eap":{"method":"PEAP","identity":"jo","password":"pw","ca_cert":"ca.pem"}}`
+
+	ret := serveApi(t, h.AddNetworkHandler, "POST", "/networks", body)
+	if errs, _ := ret.Payload.([]interface{}); ret.Status != "FAIL" || len(errs) != 1 {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+
+	cert, _ := testCertPem(t, "radius.example.com")
+	if _, err := h.wpacfg.Certs.Save("ca.pem", cert); err != nil {
+		t.Fatal(err)
+	}
+	ret = serveApi(t, h.AddNetworkHandler, "POST", "/networks", body)
+	if ret.Status != "OK" {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	assertOrder(t, d.Requests(),
+		"SET_NETWORK 1 key_mgmt WPA-EAP",
+		"SET_NETWORK 1 eap PEAP",
+		`SET_NETWORK 1 ca_cert "`+filepath.Join(h.wpacfg.Certs.Dir, "ca.pem")+`"`,
+		"SAVE_CONFIG",
+	)
+}
@@ -0,0 +1,217 @@
+package iotwifi
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCfgWatchInterval is how often a configuration file is checked
+// for changes.
+const DefaultCfgWatchInterval = 2 * time.Second
+
+// CfgDiff describes what a configuration change affects.
+type CfgDiff struct {
+	Hostapd         bool `json:"hostapd"`          // hostapd must be restarted
+	Dnsmasq         bool `json:"dnsmasq"`          // dnsmasq must be restarted
+	ApIp            bool `json:"ap_ip"`            // the AP interface address changed
+	RestartPolicies bool `json:"restart_policies"` // used from the next daemon start
+
+	// Ignored lists changed settings that only apply once the process
+	// is restarted.
+	Ignored []string `json:"ignored"`
+}
+
+// Changed reports whether the diff affects the access point.
+func (d CfgDiff) Changed() bool {
+	return d.Hostapd || d.Dnsmasq || d.ApIp
+}
+
+// CfgReload is published as an EventConfig when a changed configuration
+// is applied.
+type CfgReload struct {
+	Reason  string  `json:"reason"`
+	Changes CfgDiff `json:"changes"`
+}
+
+// DiffCfg compares two configurations with their interfaces discovered.
+func DiffCfg(old *SetupCfg, new *SetupCfg) CfgDiff {
+	d := CfgDiff{Ignored: make([]string, 0)}
+
+	ignore := func(field string, changed bool) {
+		if changed {
+			d.Ignored = append(d.Ignored, field)
+		}
+	}
+	ignore("host_apd_cfg.cfg_file", old.HostApdCfg.CfgFile != new.HostApdCfg.CfgFile)
+	ignore("host_apd_cfg.ctrl_interface", old.HostApdCfg.CtrlInterface != new.HostApdCfg.CtrlInterface)
+	ignore("wpa_supplicant_cfg", !reflect.DeepEqual(old.WpaSupplicantCfg, new.WpaSupplicantCfg))
+	ignore("interfaces", old.Interfaces != new.Interfaces)
+	ignore("dont_fallback_to_ap_mode", old.DontFallBackToApMode != new.DontFallBackToApMode)
+	ignore("allow_start_stop_mode", old.AllowStartStop != new.AllowStartStop)
+	ignore("routing", old.Routing != new.Routing)
+	ignore("pid_dir", old.PidDir != new.PidDir)
+
+	// everything else in HostApdCfg ends up in hostapd.conf
+	oldApd, newApd := old.HostApdCfg, new.HostApdCfg
+	oldApd.CfgFile, oldApd.CtrlInterface, oldApd.Ip = "", "", ""
+	newApd.CfgFile, newApd.CtrlInterface, newApd.Ip = "", "", ""
+	d.Hostapd = !reflect.DeepEqual(oldApd, newApd)
+
+	d.ApIp = old.HostApdCfg.Ip != new.HostApdCfg.Ip
+	d.Dnsmasq = d.ApIp || !reflect.DeepEqual(old.DnsmasqCfg, new.DnsmasqCfg)
+	d.RestartPolicies = !reflect.DeepEqual(old.RestartPolicies, new.RestartPolicies)
+
+	return d
+}
+
+// CfgWatcher reloads a configuration file when its content changes, or
+// when Reload is called, e.g. on SIGHUP.
+type CfgWatcher struct {
+	Path     string
+	Interval time.Duration
+
+	// OnChange is called by Run with every changed valid configuration.
+	OnChange func(*SetupCfg)
+
+	reload   chan struct{}
+	mu       sync.Mutex  // serializes checks with Write
+	last     cfgSnapshot // loaded or written last
+	rejected cfgSnapshot // failed to load last
+}
+
+// cfgSnapshot is the content of a configuration file and its signature.
+type cfgSnapshot struct {
+	cfg []byte
+	sig []byte
+}
+
+func (s cfgSnapshot) equal(o cfgSnapshot) bool {
+	return bytes.Equal(s.cfg, o.cfg) && bytes.Equal(s.sig, o.sig)
+}
+
+// NewCfgWatcher produces a CfgWatcher for a configuration file.
+func NewCfgWatcher(path string) *CfgWatcher {
+	w := &CfgWatcher{
+		Path:     path,
+		Interval: DefaultCfgWatchInterval,
+		reload:   make(chan struct{}, 1),
+	}
+	w.last, _ = w.read()
+	return w
+}
+
+// check loads the configuration if it or its signature changed since it
+// was last loaded or written.
+func (w *CfgWatcher) check(force bool) (*SetupCfg, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	snap, err := w.read()
+	if err != nil {
+		log.Warnf("Could not read configuration %s: %s", w.Path, err)
+		return nil, false
+	}
+	// a rejected file is tried again once it or its signature
+	// changes, e.g. when the signature is deployed after it
+	if !force && (snap.equal(w.last) || snap.equal(w.rejected)) {
+		return nil, false
+	}
+
+	// LoadCfg also checks the signature when keys are baked in
+	cfg, err := LoadCfg(w.Path)
+	if err != nil {
+		log.Errorf("Configuration %s not reloaded: %s", w.Path, err)
+		w.rejected = snap
+		return nil, false
+	}
+	w.last, w.rejected = snap, cfgSnapshot{}
+	return cfg, true
+}
+
+// Write replaces the configuration file with data, keeping perm. The
+// change is not reported by Run, the writer applies it.
+func (w *CfgWatcher) Write(data []byte, perm os.FileMode) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tmp := w.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	// WriteFile leaves the mode of an existing file and applies umask
+	if err := os.Chmod(tmp, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, w.Path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	snap, err := w.read()
+	if err != nil {
+		return err
+	}
+	w.last, w.rejected = snap, cfgSnapshot{}
+	return nil
+}
+
+// read returns the configuration and its signature, which may be
+// missing.
+func (w *CfgWatcher) read() (cfgSnapshot, error) {
+	cfg, err := ioutil.ReadFile(w.Path)
+	if err != nil {
+		return cfgSnapshot{}, err
+	}
+	sig, _ := ioutil.ReadFile(CfgSigLocation(w.Path))
+	return cfgSnapshot{cfg: cfg, sig: sig}, nil
+}
+
+// Reload asks Run to load the configuration now, even if the file looks
+// unchanged.
+func (w *CfgWatcher) Reload() {
+	select {
+	case w.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Run checks the file every Interval until ctx is done and calls
+// OnChange with changed configurations. Invalid configurations are
+// logged and skipped.
+func (w *CfgWatcher) Run(ctx context.Context) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultCfgWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.reload:
+			force = true
+		case <-ticker.C:
+		}
+
+		cfg, changed := w.check(force)
+		if !changed {
+			continue
+		}
+
+		log.Infof("Configuration %s changed", w.Path)
+		if w.OnChange != nil {
+			w.OnChange(cfg)
+		}
+	}
+}
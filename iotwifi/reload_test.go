@@ -0,0 +1,137 @@
+package iotwifi
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffCfg(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*SetupCfg)
+		want   CfgDiff
+	}{
+		{"unchanged", func(c *SetupCfg) {}, CfgDiff{}},
+		{"ssid", func(c *SetupCfg) { c.HostApdCfg.Ssid = "new" }, CfgDiff{Hostapd: true}},
+		{"channel", func(c *SetupCfg) { c.HostApdCfg.Channel = "11" }, CfgDiff{Hostapd: true}},
+		{"dhcp range", func(c *SetupCfg) { c.DnsmasqCfg.DhcpRange = "192.168.27.10,192.168.27.20,1h" }, CfgDiff{Dnsmasq: true}},
+		{"ap ip", func(c *SetupCfg) { c.HostApdCfg.Ip = "192.168.27.2" }, CfgDiff{ApIp: true, Dnsmasq: true}},
+		{"policies", func(c *SetupCfg) {
+			c.RestartPolicies = map[string]RestartPolicy{"dnsmasq": {Restart: RestartNever}}
+		}, CfgDiff{RestartPolicies: true}},
+		{"interfaces", func(c *SetupCfg) { c.Interfaces.Ap = "uap1" }, CfgDiff{Ignored: []string{"interfaces"}}},
+		{"routing", func(c *SetupCfg) { c.Routing.Enabled = true }, CfgDiff{Ignored: []string{"routing"}}},
+		{"pid dir", func(c *SetupCfg) { c.PidDir = "/run/txwifi" }, CfgDiff{Ignored: []string{"pid_dir"}}},
+		{"hostapd files", func(c *SetupCfg) {
+			c.HostApdCfg.CfgFile = "/tmp/hostapd.conf"
+			c.HostApdCfg.CtrlInterface = "/tmp/hostapd"
+		}, CfgDiff{Ignored: []string{"host_apd_cfg.cfg_file", "host_apd_cfg.ctrl_interface"}}},
+	}
+
+	for _, tt := range tests {
+		old := validCfg()
+		next := validCfg()
+		tt.modify(next)
+		got := DiffCfg(old, next)
+		if got.Hostapd != tt.want.Hostapd || got.Dnsmasq != tt.want.Dnsmasq || got.ApIp != tt.want.ApIp ||
+			got.RestartPolicies != tt.want.RestartPolicies || strings.Join(got.Ignored, ",") != strings.Join(tt.want.Ignored, ",") {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCfgWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wificfg.json")
+	ioutil.WriteFile(path, []byte(remoteCfgBody("first")), 0600)
+
+	w := NewCfgWatcher(path)
+	w.Interval = 20 * time.Millisecond
+	changes := make(chan *SetupCfg, 10)
+	w.OnChange = func(cfg *SetupCfg) { changes <- cfg }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	next := func() *SetupCfg {
+		t.Helper()
+		select {
+		case cfg := <-changes:
+			return cfg
+		case <-time.After(2 * time.Second):
+			t.Fatal("no change reported")
+			return nil
+		}
+	}
+
+	// an invalid configuration is skipped
+	ioutil.WriteFile(path, []byte(remoteCfgBody("")), 0600)
+	time.Sleep(100 * time.Millisecond)
+	ioutil.WriteFile(path, []byte(remoteCfgBody("second")), 0600)
+	if cfg := next(); cfg.HostApdCfg.Ssid != "second" {
+		t.Errorf("ssid %q", cfg.HostApdCfg.Ssid)
+	}
+
+	// Reload loads the unchanged file again
+	w.Reload()
+	if cfg := next(); cfg.HostApdCfg.Ssid != "second" {
+		t.Errorf("ssid %q", cfg.HostApdCfg.Ssid)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if len(changes) != 0 {
+		t.Errorf("%d unexpected changes", len(changes))
+	}
+}
+
+func TestCfgWatcherSignature(t *testing.T) {
+	pub, seed := testKey(t)
+	defer func(keys string) { CfgPublicKeys = keys }(CfgPublicKeys)
+	CfgPublicKeys = pub
+
+	path := filepath.Join(t.TempDir(), "wificfg.json")
+	w := NewCfgWatcher(path)
+	w.Interval = 20 * time.Millisecond
+	changes := make(chan *SetupCfg, 10)
+	w.OnChange = func(cfg *SetupCfg) { changes <- cfg }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// deployed first, the configuration is rejected for lack of a
+	// signature and loaded once the signature follows
+	doc := []byte(remoteCfgBody("signed"))
+	ioutil.WriteFile(path, doc, 0600)
+	time.Sleep(100 * time.Millisecond)
+	if len(changes) != 0 {
+		t.Fatal("unsigned configuration loaded")
+	}
+
+	sig, _ := SignCfg(doc, seed)
+	ioutil.WriteFile(path+".sig", sig, 0600)
+	select {
+	case cfg := <-changes:
+		if cfg.HostApdCfg.Ssid != "signed" {
+			t.Errorf("ssid %q", cfg.HostApdCfg.Ssid)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("signed configuration not loaded")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if len(changes) != 0 {
+		t.Errorf("%d unexpected changes", len(changes))
+	}
+}
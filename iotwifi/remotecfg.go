@@ -0,0 +1,300 @@
+package iotwifi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultCfgRefresh is how often a remote configuration is checked
+	// for changes.
+	DefaultCfgRefresh = 5 * time.Minute
+	// DefaultCfgCacheFile is where the last good remote configuration
+	// is kept for when the server cannot be reached.
+	DefaultCfgCacheFile = "/var/lib/txwifi/wificfg.json"
+)
+
+// IsCfgUrl reports whether a configuration location is a URL rather than
+// a file.
+func IsCfgUrl(cfgLocation string) bool {
+	return strings.Contains(cfgLocation, "://")
+}
+
+// RemoteCfg fetches a configuration from a URL and checks it for changes
+// with If-None-Match. The last valid configuration is cached in a file,
+// with its ETag and signature next to it in CacheFile.etag and
+// CacheFile.sig, and used when the server is down or serves an invalid
+// configuration.
+type RemoteCfg struct {
+	Url       string
+	CacheFile string        // empty disables the cache
+	Interval  time.Duration // refresh interval for Run
+	Timeout   time.Duration // bounds each request
+
+	// Verifier checks the signature at CfgSigLocation(Url) of every
+	// fetched and cached configuration. Load sets it from CfgPublicKeys
+	// if it is nil; it stays nil, accepting unsigned configurations,
+	// when no keys are baked in.
+	Verifier *CfgVerifier
+
+	// OnChange is called by Run with every changed valid configuration.
+	OnChange func(*SetupCfg)
+
+	reload chan struct{}
+
+	mu   sync.Mutex
+	etag string
+	body []byte
+	sig  []byte
+}
+
+// NewRemoteCfg produces a RemoteCfg with the default interval and
+// timeout.
+func NewRemoteCfg(url string, cacheFile string) *RemoteCfg {
+	return &RemoteCfg{
+		Url:       url,
+		CacheFile: cacheFile,
+		Interval:  DefaultCfgRefresh,
+		Timeout:   cfgFetchTimeout,
+		reload:    make(chan struct{}, 1),
+	}
+}
+
+// Reload asks Run to refresh the configuration now.
+func (r *RemoteCfg) Reload() {
+	select {
+	case r.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Load fetches the configuration, falling back to the cached copy when
+// the fetch fails or the fetched configuration is invalid.
+func (r *RemoteCfg) Load() (*SetupCfg, error) {
+	if r.Verifier == nil {
+		verifier, err := bakedCfgVerifier()
+		if err != nil {
+			return nil, err
+		}
+		r.Verifier = verifier
+	}
+
+	r.readCache()
+
+	cfg, _, err := r.Refresh()
+	if err == nil {
+		return cfg, nil
+	}
+
+	r.mu.Lock()
+	cached := r.body
+	r.mu.Unlock()
+	if cached == nil {
+		return nil, err
+	}
+
+	log.Warnf("Using cached configuration %s: %s", r.CacheFile, err)
+	return ParseCfg(cached)
+}
+
+// Refresh fetches the configuration unless the server reports it has
+// not changed since the last fetch. It returns the current configuration
+// and whether it changed. Invalid configurations are rejected and the
+// current one is kept, as are configurations rejected by the Verifier.
+func (r *RemoteCfg) Refresh() (*SetupCfg, bool, error) {
+	r.mu.Lock()
+	etag, current := r.etag, r.body
+	r.mu.Unlock()
+
+	body, newEtag, err := r.fetch(r.Url, etag)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// not modified
+	if body == nil {
+		cfg, err := ParseCfg(current)
+		return cfg, false, err
+	}
+
+	var sig []byte
+	if r.Verifier != nil {
+		sigUrl := CfgSigLocation(r.Url)
+		if sig, _, err = r.fetch(sigUrl, ""); err != nil {
+			return nil, false, fmt.Errorf("%w: no signature at %s: %s", ErrCfgSignature, sigUrl, err)
+		}
+		if err := r.Verifier.Verify(body, sig); err != nil {
+			return nil, false, err
+		}
+	}
+
+	cfg, err := ParseCfg(body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := !bytes.Equal(body, current)
+
+	r.mu.Lock()
+	r.etag, r.body, r.sig = newEtag, body, sig
+	r.mu.Unlock()
+
+	if changed || newEtag != etag {
+		r.writeCache(body, newEtag, sig)
+	}
+
+	return cfg, changed, nil
+}
+
+// Run refreshes the configuration every Interval, or when Reload is
+// called, until ctx is done, calling OnChange when it changed.
+func (r *RemoteCfg) Run(ctx context.Context) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DefaultCfgRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.reload:
+		case <-ticker.C:
+		}
+
+		cfg, changed, err := r.Refresh()
+		if err != nil {
+			log.Warnf("Configuration refresh from %s failed: %s", r.Url, err)
+			continue
+		}
+		if !changed {
+			log.Debugf("Configuration %s unchanged", r.Url)
+			continue
+		}
+
+		log.Infof("Configuration %s changed", r.Url)
+		if r.OnChange != nil {
+			r.OnChange(cfg)
+		}
+	}
+}
+
+// fetch gets a URL, sending etag as If-None-Match when there is a body
+// it applies to. A nil body means not modified.
+func (r *RemoteCfg) fetch(url string, etag string) ([]byte, string, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = cfgFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetching configuration: %w", err)
+	}
+	req = req.WithContext(ctx)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetching configuration: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if etag != "" {
+			return nil, etag, nil
+		}
+		fallthrough
+	default:
+		return nil, "", fmt.Errorf("fetching configuration: %s returned %s", url, res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetching configuration: %w", err)
+	}
+
+	return body, res.Header.Get("ETag"), nil
+}
+
+// readCache loads the cached configuration and its ETag, if any. A cached
+// configuration the Verifier rejects is ignored.
+func (r *RemoteCfg) readCache() {
+	if r.CacheFile == "" {
+		return
+	}
+
+	body, err := ioutil.ReadFile(r.CacheFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("Could not read cached configuration: %s", err)
+		}
+		return
+	}
+	etag, _ := ioutil.ReadFile(r.CacheFile + ".etag")
+	sig, _ := ioutil.ReadFile(r.CacheFile + ".sig")
+
+	if r.Verifier != nil {
+		if err := r.Verifier.Verify(body, sig); err != nil {
+			log.Warnf("Ignoring cached configuration %s: %s", r.CacheFile, err)
+			return
+		}
+	}
+
+	r.mu.Lock()
+	r.body, r.etag, r.sig = body, strings.TrimSpace(string(etag)), sig
+	r.mu.Unlock()
+}
+
+// writeCache replaces the cached configuration, its ETag and signature.
+func (r *RemoteCfg) writeCache(body []byte, etag string, sig []byte) {
+	if r.CacheFile == "" {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.CacheFile), 0755); err != nil {
+		log.Warnf("Could not cache configuration: %s", err)
+		return
+	}
+	if err := writeFileAtomic(r.CacheFile, body); err != nil {
+		log.Warnf("Could not cache configuration: %s", err)
+		return
+	}
+	if err := writeFileAtomic(r.CacheFile+".etag", []byte(etag)); err != nil {
+		log.Warnf("Could not cache configuration ETag: %s", err)
+	}
+	if sig == nil {
+		os.Remove(r.CacheFile + ".sig")
+	} else if err := writeFileAtomic(r.CacheFile+".sig", sig); err != nil {
+		log.Warnf("Could not cache configuration signature: %s", err)
+	}
+}
+
+// writeFileAtomic writes a file through a temporary file and a rename, so
+// a power cut leaves either the old or the new content.
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
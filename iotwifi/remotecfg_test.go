@@ -0,0 +1,189 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const remoteCfgJson = `{"host_apd_cfg":{"ip":"192.168.27.1","ssid":"%s","channel":"6"},
+	"dnsmasq_cfg":{"dhcp_range":"192.168.27.100,192.168.27.150,1h"},
+	"wpa_supplicant_cfg":{"cfg_file":"/etc/wpa_supplicant/wpa_supplicant.conf"}}`
+
+// cfgServer serves a configuration with an ETag, answering 304 when the
+// client has it.
+type cfgServer struct {
+	mu       sync.Mutex
+	body     string
+	etag     string
+	status   int
+	requests []string // If-None-Match of every request
+}
+
+func (s *cfgServer) set(body string, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.etag, s.status = body, etag, 0
+}
+
+func (s *cfgServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Header.Get("If-None-Match"))
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	if r.Header.Get("If-None-Match") == s.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Write([]byte(s.body))
+}
+
+func newCfgServer(t *testing.T, ssid string) (*cfgServer, *httptest.Server) {
+	s := &cfgServer{}
+	s.set(remoteCfgBody(ssid), `"v1"`)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func remoteCfgBody(ssid string) string {
+	return fmt.Sprintf(remoteCfgJson, ssid)
+}
+
+func TestRemoteCfgRefresh(t *testing.T) {
+	s, srv := newCfgServer(t, "first")
+	cache := filepath.Join(t.TempDir(), "cache", "wificfg.json")
+	remote := NewRemoteCfg(srv.URL, cache)
+
+	cfg, err := remote.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HostApdCfg.Ssid != "first" {
+		t.Errorf("ssid %q", cfg.HostApdCfg.Ssid)
+	}
+	if etag, _ := ioutil.ReadFile(cache + ".etag"); string(etag) != `"v1"` {
+		t.Errorf("cached etag %q", etag)
+	}
+
+	// not modified
+	cfg, changed, err := remote.Refresh()
+	if err != nil || changed || cfg.HostApdCfg.Ssid != "first" {
+		t.Errorf("refresh: %+v %v %v", cfg, changed, err)
+	}
+
+	// an invalid configuration is rejected
+	s.set(remoteCfgBody(""), `"v2"`)
+	if _, _, err := remote.Refresh(); err == nil {
+		t.Error("expected invalid configuration to be rejected")
+	}
+
+	s.set(remoteCfgBody("second"), `"v3"`)
+	cfg, changed, err = remote.Refresh()
+	if err != nil || !changed || cfg.HostApdCfg.Ssid != "second" {
+		t.Errorf("refresh: %+v %v %v", cfg, changed, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want := []string{"", `"v1"`, `"v1"`, `"v1"`}
+	if len(s.requests) != len(want) {
+		t.Fatalf("requests %q, want %q", s.requests, want)
+	}
+	for i := range want {
+		if s.requests[i] != want[i] {
+			t.Errorf("request %d If-None-Match %q, want %q", i, s.requests[i], want[i])
+		}
+	}
+}
+
+func TestRemoteCfgOffline(t *testing.T) {
+	s, srv := newCfgServer(t, "cached")
+	cache := filepath.Join(t.TempDir(), "wificfg.json")
+
+	if _, err := NewRemoteCfg(srv.URL, cache).Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server is down on the next boot
+	s.mu.Lock()
+	s.status = http.StatusBadGateway
+	s.mu.Unlock()
+
+	remote := NewRemoteCfg(srv.URL, cache)
+	cfg, err := remote.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HostApdCfg.Ssid != "cached" {
+		t.Errorf("ssid %q, want the cached one", cfg.HostApdCfg.Ssid)
+	}
+
+	// without a cache the error is returned
+	if _, err := NewRemoteCfg(srv.URL, "").Load(); err == nil {
+		t.Error("expected an error without a cache")
+	}
+}
+
+func TestRemoteCfgTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer srv.Close()
+
+	remote := NewRemoteCfg(srv.URL, "")
+	remote.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	if _, err := remote.Load(); err == nil {
+		t.Error("expected a timeout")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("took %s", time.Since(start))
+	}
+}
+
+func TestRemoteCfgRun(t *testing.T) {
+	s, srv := newCfgServer(t, "first")
+	remote := NewRemoteCfg(srv.URL, "")
+	remote.Interval = 20 * time.Millisecond
+	if _, err := remote.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan *SetupCfg, 10)
+	remote.OnChange = func(cfg *SetupCfg) { changes <- cfg }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		remote.Run(ctx)
+		close(done)
+	}()
+
+	s.set(remoteCfgBody("second"), `"v2"`)
+	select {
+	case cfg := <-changes:
+		if cfg.HostApdCfg.Ssid != "second" {
+			t.Errorf("ssid %q", cfg.HostApdCfg.Ssid)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change reported")
+	}
+
+	cancel()
+	<-done
+	if len(changes) != 0 {
+		t.Errorf("%d unexpected changes", len(changes))
+	}
+}
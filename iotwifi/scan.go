@@ -0,0 +1,276 @@
+package iotwifi
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrScanFailed is returned when wpa_supplicant reports a failed scan.
+var ErrScanFailed = errors.New("scan failed")
+
+// WpaSecurity is the security advertised by a BSS, decoded from the
+// wpa_supplicant flags such as [WPA2-PSK+SAE-CCMP][ESS][WPS].
+type WpaSecurity struct {
+	Open       bool     `json:"open"`
+	Wep        bool     `json:"wep"`
+	Wpa        bool     `json:"wpa"`
+	Wpa2       bool     `json:"wpa2"`
+	Wpa3       bool     `json:"wpa3"`
+	Owe        bool     `json:"owe"`
+	Enterprise bool     `json:"enterprise"`
+	Wps        bool     `json:"wps"`
+	KeyMgmt    []string `json:"key_mgmt"`
+	Ciphers    []string `json:"ciphers"`
+}
+
+// knownCiphers are the pairwise cipher names used in scan flags.
+var knownCiphers = map[string]bool{
+	"CCMP":     true,
+	"CCMP-256": true,
+	"GCMP":     true,
+	"GCMP-256": true,
+	"TKIP":     true,
+	"WEP40":    true,
+	"WEP104":   true,
+	"NONE":     true,
+}
+
+// Scan asks wpa_supplicant for a scan and returns every BSS once the
+// results are in. When no result event arrives within timeout the BSSs
+// wpa_supplicant knows about so far are returned.
+func (w *WpaCtrl) Scan(timeout time.Duration) ([]WpaNetwork, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// a scan finishing before ATTACH would leave us waiting for timeout
+	events, attached := w.AttachedEvents(ctx)
+	select {
+	case <-attached:
+	case <-ctx.Done():
+	}
+
+	reply, err := w.Request("SCAN")
+	if err != nil {
+		return nil, err
+	}
+	// FAIL-BUSY means a scan is already running, wait for that one
+	if r := strings.TrimSpace(reply); r != "OK" && r != "FAIL-BUSY" {
+		return nil, fmt.Errorf("%w: SCAN: unexpected reply %q", ErrCtrlFail, r)
+	}
+
+wait:
+	for ev := range events {
+		switch ev.Name {
+		case "CTRL-EVENT-SCAN-RESULTS":
+			break wait
+		case "CTRL-EVENT-SCAN-FAILED":
+			return nil, fmt.Errorf("%w: %s", ErrScanFailed, ev.Message)
+		}
+	}
+
+	return w.BssList()
+}
+
+// BssList returns every BSS in the wpa_supplicant scan results, the
+// strongest signal first.
+func (w *WpaCtrl) BssList() ([]WpaNetwork, error) {
+	networks := make([]WpaNetwork, 0)
+
+	reply, err := w.Request("BSS FIRST")
+	for err == nil && strings.TrimSpace(reply) != "" {
+		bss := cfgMapper([]byte(reply))
+		networks = append(networks, parseBss(bss))
+
+		reply, err = w.Request("BSS NEXT-" + bss["id"])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(networks, func(i, j int) bool {
+		return networks[i].SignalLevel > networks[j].SignalLevel
+	})
+
+	return networks, nil
+}
+
+// parseBss builds a WpaNetwork from the key/value pairs of a BSS reply.
+func parseBss(bss map[string]string) WpaNetwork {
+	n := WpaNetwork{
+		Bssid:    bss["bssid"],
+		Flags:    bss["flags"],
+		Security: parseSecurity(bss["flags"]),
+	}
+	n.Frequency, _ = strconv.Atoi(bss["freq"])
+	n.SignalLevel, _ = strconv.Atoi(bss["level"])
+
+	// the SSID element holds the raw bytes, the ssid line is escaped
+	ssid, ok := ieSsid(bss["ie"])
+	if !ok {
+		ssid = unescapeSsid(bss["ssid"])
+	}
+
+	n.SsidHex = hex.EncodeToString(ssid)
+	n.Hidden = strings.Trim(string(ssid), "\x00") == ""
+	if utf8.Valid(ssid) && !n.Hidden {
+		n.Ssid = string(ssid)
+	}
+
+	return n
+}
+
+// ieSsid returns the SSID element of hex encoded information elements.
+func ieSsid(ie string) ([]byte, bool) {
+	raw, err := hex.DecodeString(ie)
+	if err != nil {
+		return nil, false
+	}
+
+	for len(raw) >= 2 {
+		id, n := raw[0], int(raw[1])
+		if len(raw) < 2+n {
+			return nil, false
+		}
+		if id == 0 {
+			return raw[2 : 2+n], true
+		}
+		raw = raw[2+n:]
+	}
+
+	return nil, false
+}
+
+// unescapeSsid reverses the printf style escaping wpa_supplicant uses
+// for SSIDs: \\, \", \e, \n, \r, \t and \xNN.
+func unescapeSsid(s string) []byte {
+	out := make([]byte, 0, len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'e':
+			out = append(out, 0x1b)
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'x':
+			if i+2 < len(s) {
+				if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					out = append(out, byte(b))
+					i += 2
+					continue
+				}
+			}
+			out = append(out, '\\', 'x')
+		default:
+			out = append(out, s[i])
+		}
+	}
+
+	return out
+}
+
+// parseSecurity decodes scan flags like [WPA-PSK-CCMP+TKIP][WPA2-PSK-CCMP][ESS].
+func parseSecurity(flags string) WpaSecurity {
+	sec := WpaSecurity{
+		KeyMgmt: make([]string, 0),
+		Ciphers: make([]string, 0),
+	}
+
+	for _, tok := range strings.Split(flags, "]") {
+		tok = strings.TrimPrefix(tok, "[")
+		if tok == "" {
+			continue
+		}
+
+		switch {
+		case tok == "WEP":
+			sec.Wep = true
+			continue
+		case tok == "WPS" || strings.HasPrefix(tok, "WPS-"):
+			sec.Wps = true
+			continue
+		}
+
+		dash := strings.Index(tok, "-")
+		if dash < 0 {
+			continue
+		}
+		proto, rest := tok[:dash], strings.TrimSuffix(tok[dash+1:], "-preauth")
+		switch proto {
+		case "WPA":
+			sec.Wpa = true
+		case "WPA2", "RSN":
+			sec.Wpa2 = true
+		case "OSEN":
+			sec.Enterprise = true
+		default:
+			// ESS, IBSS, OWE-TRANS and friends
+			continue
+		}
+
+		keyMgmt, ciphers := splitKeyMgmt(rest)
+		for _, k := range keyMgmt {
+			switch {
+			case k == "SAE" || k == "FT/SAE" || strings.HasPrefix(k, "EAP-SUITE-B"):
+				sec.Wpa3 = true
+			case k == "OWE":
+				sec.Owe = true
+			}
+			if strings.Contains(k, "EAP") || strings.Contains(k, "FILS") {
+				sec.Enterprise = true
+			}
+			sec.KeyMgmt = appendUnique(sec.KeyMgmt, k)
+		}
+		for _, c := range ciphers {
+			sec.Ciphers = appendUnique(sec.Ciphers, c)
+		}
+	}
+
+	sec.Open = !sec.Wep && !sec.Wpa && !sec.Wpa2 && !sec.Enterprise
+
+	return sec
+}
+
+// splitKeyMgmt splits KEYMGMT-CIPHERS where both parts are lists joined
+// with + and names may themselves contain dashes, e.g.
+// EAP-SUITE-B-192-GCMP-256 or PSK+PSK-SHA256-CCMP.
+func splitKeyMgmt(s string) ([]string, []string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '-' {
+			continue
+		}
+		ciphers := strings.Split(s[i+1:], "+")
+		valid := true
+		for _, c := range ciphers {
+			valid = valid && knownCiphers[c]
+		}
+		if valid {
+			return strings.Split(s[:i], "+"), ciphers
+		}
+	}
+	return strings.Split(s, "+"), nil
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -0,0 +1,172 @@
+package iotwifi
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bssReplies are the BSS replies of wpa_supplicant with three results.
+var bssReplies = map[string]string{
+	"SCAN": "OK\n",
+	"BSS FIRST": "id=3\nbssid=00:11:22:33:44:55\nfreq=2437\nlevel=-70\n" +
+		"flags=[WPA2-PSK-CCMP][ESS]\nssid=home\n",
+	"BSS NEXT-3": "id=4\nbssid=00:11:22:33:44:56\nfreq=5180\nlevel=-41\n" +
+		"flags=[WPA2-PSK+SAE-CCMP][ESS]\n" +
+		// SSID element "home", then a supported rates element
+		"ie=0004686f6d65010882848b960c121824\nssid=home\n",
+	"BSS NEXT-4": "id=7\nbssid=66:77:88:99:aa:bb\nfreq=2412\nlevel=-60\n" +
+		"flags=[ESS]\nssid=caf\\xc3\\xa9 \\\"bar\\\"\n",
+	"BSS NEXT-7": "",
+}
+
+func TestScanNetworks(t *testing.T) {
+	r := newFakeRadio(t)
+	d := startFakeDaemon(t, filepath.Join(r.cfg.WpaSupplicantCfg.CtrlInterface, "wlan0"), bssReplies)
+
+	go func() {
+		d.waitAttached(t)
+		d.Emit("<2>CTRL-EVENT-SCAN-RESULTS ")
+	}()
+
+	wpa := NewWpaCfg(r.cfg)
+	networks, err := wpa.ScanNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(networks) != 3 {
+		t.Fatalf("got %d networks, want 3: %+v", len(networks), networks)
+	}
+
+	// the two BSSs of home are kept apart, strongest first
+	if n := networks[0]; n.Bssid != "00:11:22:33:44:56" || n.Ssid != "home" || n.Frequency != 5180 || n.SignalLevel != -41 || !n.Security.Wpa3 {
+		t.Errorf("unexpected network %+v", n)
+	}
+	if n := networks[1]; n.Ssid != `café "bar"` || !n.Security.Open {
+		t.Errorf("unexpected network %+v", n)
+	}
+	if n := networks[2]; n.Bssid != "00:11:22:33:44:55" || n.Ssid != "home" || n.SsidHex != "686f6d65" {
+		t.Errorf("unexpected network %+v", n)
+	}
+
+	assertOrder(t, d.Requests(), "SCAN", "BSS FIRST", "BSS NEXT-3", "BSS NEXT-4", "BSS NEXT-7")
+	if r.exec.called("iwlist") || r.exec.called("wpa_supplicant") {
+		t.Errorf("unexpected calls %v", r.exec.Calls())
+	}
+}
+
+func TestScanAttachesFirst(t *testing.T) {
+	dir := t.TempDir()
+	d := startFakeDaemon(t, filepath.Join(dir, "wlan0"), bssReplies)
+	// the results are in before SCAN is even answered
+	d.EmitOn("SCAN", "<2>CTRL-EVENT-SCAN-RESULTS ")
+
+	start := time.Now()
+	networks, err := NewWpaCtrl(dir, "wlan0").Scan(5 * time.Second)
+	if err != nil || len(networks) != 3 {
+		t.Fatalf("Scan() = %d networks, %v", len(networks), err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("missed the results event, took %s", elapsed)
+	}
+	assertOrder(t, d.Requests(), "ATTACH", "SCAN")
+}
+
+func TestScanNetworksFailed(t *testing.T) {
+	r := newFakeRadio(t)
+	d := startFakeDaemon(t, filepath.Join(r.cfg.WpaSupplicantCfg.CtrlInterface, "wlan0"), bssReplies)
+
+	go func() {
+		d.waitAttached(t)
+		d.Emit("<3>CTRL-EVENT-SCAN-FAILED ret=-16")
+	}()
+
+	if _, err := NewWpaCfg(r.cfg).ScanNetworks(); err == nil || !strings.Contains(err.Error(), "ret=-16") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestScanNetworksStandalone(t *testing.T) {
+	timeout := scanTimeout
+	scanTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { scanTimeout = timeout })
+
+	r := newFakeRadio(t)
+	var ctrlDir string
+	r.exec.hooks["wpa_supplicant"] = func(arg []string) {
+		for _, a := range arg {
+			if strings.HasPrefix(a, "-C") {
+				ctrlDir = strings.TrimPrefix(a, "-C")
+			}
+		}
+		startFakeDaemon(t, filepath.Join(ctrlDir, "wlan0"), bssReplies)
+	}
+
+	networks, err := NewWpaCfg(r.cfg).ScanNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 3 {
+		t.Errorf("got %d networks, want 3", len(networks))
+	}
+
+	assertOrder(t, r.exec.Calls(), "wpa_supplicant -Dnl80211 -iwlan0 -C")
+	if strings.HasPrefix(ctrlDir, r.cfg.WpaSupplicantCfg.CtrlInterface) {
+		t.Errorf("scan-only wpa_supplicant uses the shared ctrl dir %s", ctrlDir)
+	}
+
+	r.exec.mu.Lock()
+	procs := r.exec.running["wpa_supplicant"]
+	r.exec.mu.Unlock()
+	select {
+	case <-procs[0].done:
+	default:
+		t.Error("scan-only wpa_supplicant still running")
+	}
+}
+
+func TestParseSecurity(t *testing.T) {
+	tests := []struct {
+		flags string
+		want  WpaSecurity
+	}{
+		{"[ESS]", WpaSecurity{Open: true, KeyMgmt: []string{}, Ciphers: []string{}}},
+		{"[WEP][ESS]", WpaSecurity{Wep: true, KeyMgmt: []string{}, Ciphers: []string{}}},
+		{"[WPA-PSK-CCMP+TKIP][WPA2-PSK-CCMP+TKIP-preauth][ESS][WPS]", WpaSecurity{
+			Wpa: true, Wpa2: true, Wps: true, KeyMgmt: []string{"PSK"}, Ciphers: []string{"CCMP", "TKIP"},
+		}},
+		{"[WPA2-PSK+SAE-CCMP][ESS]", WpaSecurity{
+			Wpa2: true, Wpa3: true, KeyMgmt: []string{"PSK", "SAE"}, Ciphers: []string{"CCMP"},
+		}},
+		{"[WPA2-EAP-SUITE-B-192-GCMP-256][ESS]", WpaSecurity{
+			Wpa2: true, Wpa3: true, Enterprise: true, KeyMgmt: []string{"EAP-SUITE-B-192"}, Ciphers: []string{"GCMP-256"},
+		}},
+		{"[WPA2-PSK+PSK-SHA256-CCMP][ESS]", WpaSecurity{
+			Wpa2: true, KeyMgmt: []string{"PSK", "PSK-SHA256"}, Ciphers: []string{"CCMP"},
+		}},
+		{"[WPA2-OWE-CCMP][ESS]", WpaSecurity{
+			Wpa2: true, Owe: true, KeyMgmt: []string{"OWE"}, Ciphers: []string{"CCMP"},
+		}},
+	}
+
+	for _, tt := range tests {
+		if got := parseSecurity(tt.flags); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestParseBssHidden(t *testing.T) {
+	n := parseBss(map[string]string{"bssid": "00:11:22:33:44:55", "ie": "0003000000", "ssid": `\x00\x00\x00`})
+	if !n.Hidden || n.Ssid != "" || n.SsidHex != "000000" {
+		t.Errorf("unexpected network %+v", n)
+	}
+
+	n = parseBss(map[string]string{"ssid": `\xff\xfe`})
+	if n.Hidden || n.Ssid != "" || n.SsidHex != "fffe" {
+		t.Errorf("unexpected network %+v", n)
+	}
+}
@@ -0,0 +1,122 @@
+package iotwifi
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// CfgPublicKeys are the base64 Ed25519 public keys trusted to sign
+// configurations, separated by commas. Bake them into the binary with
+//
+//	go build -ldflags "-X github.com/txn2/txwifi/iotwifi.CfgPublicKeys=<key>"
+//
+// Configurations are only accepted with a valid signature once a key is
+// set.
+var CfgPublicKeys = ""
+
+// ErrCfgSignature is wrapped by every rejection of a configuration
+// signature.
+var ErrCfgSignature = errors.New("configuration signature rejected")
+
+// CfgVerifier checks detached Ed25519 signatures on configuration
+// documents. A signature is the base64 encoded signature of the exact
+// document bytes, kept next to the document with a .sig suffix.
+type CfgVerifier struct {
+	keys []ed25519.PublicKey
+}
+
+// NewCfgVerifier produces a CfgVerifier trusting the comma separated
+// base64 public keys. More than one key allows keys to be rotated.
+func NewCfgVerifier(keys string) (*CfgVerifier, error) {
+	v := &CfgVerifier{}
+	for _, k := range strings.Split(keys, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("public key %q is not base64: %w", k, err)
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("public key %q is %d bytes, want %d", k, len(raw), ed25519.PublicKeySize)
+		}
+		v.keys = append(v.keys, ed25519.PublicKey(raw))
+	}
+	if len(v.keys) == 0 {
+		return nil, errors.New("no public keys")
+	}
+	return v, nil
+}
+
+// bakedCfgVerifier returns a verifier for CfgPublicKeys, or nil when no
+// keys are baked in.
+func bakedCfgVerifier() (*CfgVerifier, error) {
+	if strings.TrimSpace(CfgPublicKeys) == "" {
+		return nil, nil
+	}
+	v, err := NewCfgVerifier(CfgPublicKeys)
+	if err != nil {
+		return nil, fmt.Errorf("CfgPublicKeys: %w", err)
+	}
+	return v, nil
+}
+
+// Verify checks that sig is a signature of doc by one of the trusted
+// keys. Errors wrap ErrCfgSignature.
+func (v *CfgVerifier) Verify(doc []byte, sig []byte) error {
+	s := strings.TrimSpace(string(sig))
+	if s == "" {
+		return fmt.Errorf("%w: empty signature", ErrCfgSignature)
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("%w: signature is not base64", ErrCfgSignature)
+	}
+	if len(raw) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: signature is %d bytes, want %d", ErrCfgSignature, len(raw), ed25519.SignatureSize)
+	}
+
+	for _, key := range v.keys {
+		if ed25519.Verify(key, doc, raw) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: not signed by a trusted key", ErrCfgSignature)
+}
+
+// SignCfg returns the detached signature of a configuration document for
+// a base64 Ed25519 private key seed.
+func SignCfg(doc []byte, seed string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(seed))
+	if err != nil {
+		return nil, fmt.Errorf("private key is not base64: %w", err)
+	}
+	if len(raw) != ed25519.SeedSize {
+		return nil, fmt.Errorf("private key is %d bytes, want %d", len(raw), ed25519.SeedSize)
+	}
+
+	sig := ed25519.Sign(ed25519.NewKeyFromSeed(raw), doc)
+	return []byte(base64.StdEncoding.EncodeToString(sig) + "\n"), nil
+}
+
+// CfgSigLocation returns where the signature of a configuration is: the
+// file or URL path with a .sig suffix.
+func CfgSigLocation(cfgLocation string) string {
+	if !IsCfgUrl(cfgLocation) {
+		return cfgLocation + ".sig"
+	}
+	u, err := url.Parse(cfgLocation)
+	if err != nil {
+		return cfgLocation + ".sig"
+	}
+	u.Path += ".sig"
+	if u.RawPath != "" {
+		u.RawPath += ".sig"
+	}
+	return u.String()
+}
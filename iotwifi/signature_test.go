@@ -0,0 +1,170 @@
+package iotwifi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKey returns a base64 public key and private key seed.
+func testKey(t *testing.T) (string, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv.Seed())
+}
+
+func TestCfgVerifier(t *testing.T) {
+	pub, seed := testKey(t)
+	otherPub, otherSeed := testKey(t)
+	doc := []byte(`{"host_apd_cfg":{"ssid":"iot"}}`)
+
+	sig, err := SignCfg(doc, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSig, _ := SignCfg(doc, otherSeed)
+
+	v, err := NewCfgVerifier(pub + ", " + otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(doc, sig); err != nil {
+		t.Errorf("valid signature: %s", err)
+	}
+	if err := v.Verify(doc, otherSig); err != nil {
+		t.Errorf("signature of the second key: %s", err)
+	}
+
+	single, _ := NewCfgVerifier(pub)
+	tests := []struct {
+		name string
+		doc  []byte
+		sig  []byte
+		want string
+	}{
+		{"tampered", []byte(`{"host_apd_cfg":{"ssid":"evil"}}`), sig, "not signed by a trusted key"},
+		{"untrusted key", doc, otherSig, "not signed by a trusted key"},
+		{"empty", doc, nil, "empty signature"},
+		{"not base64", doc, []byte("not a signature!"), "not base64"},
+		{"short", doc, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), "5 bytes"},
+	}
+	for _, tt := range tests {
+		err := single.Verify(tt.doc, tt.sig)
+		if !errors.Is(err, ErrCfgSignature) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	for _, keys := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := NewCfgVerifier(keys); err == nil {
+			t.Errorf("expected an error for keys %q", keys)
+		}
+	}
+}
+
+func TestCfgSigLocation(t *testing.T) {
+	tests := map[string]string{
+		"/cfg/wificfg.json":                         "/cfg/wificfg.json.sig",
+		"https://example.com/wificfg.json":          "https://example.com/wificfg.json.sig",
+		"https://example.com/wificfg.json?device=7": "https://example.com/wificfg.json.sig?device=7",
+	}
+	for in, want := range tests {
+		if got := CfgSigLocation(in); got != want {
+			t.Errorf("%s: got %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestLoadSignedCfg(t *testing.T) {
+	pub, seed := testKey(t)
+	v, _ := NewCfgVerifier(pub)
+
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "wificfg.json")
+	doc := []byte(remoteCfgBody("signed"))
+	ioutil.WriteFile(cfgFile, doc, 0600)
+
+	if _, err := LoadSignedCfg(cfgFile, v); !errors.Is(err, ErrCfgSignature) {
+		t.Errorf("unsigned: got %v", err)
+	}
+
+	sig, _ := SignCfg(doc, seed)
+	ioutil.WriteFile(cfgFile+".sig", sig, 0600)
+	cfg, err := LoadSignedCfg(cfgFile, v)
+	if err != nil || cfg.HostApdCfg.Ssid != "signed" {
+		t.Errorf("signed: %+v %v", cfg, err)
+	}
+
+	// baked in keys apply to LoadCfg
+	defer func(keys string) { CfgPublicKeys = keys }(CfgPublicKeys)
+	_, otherSeed := testKey(t)
+	otherSig, _ := SignCfg(doc, otherSeed)
+	ioutil.WriteFile(cfgFile+".sig", otherSig, 0600)
+	CfgPublicKeys = pub
+	if _, err := LoadCfg(cfgFile); !errors.Is(err, ErrCfgSignature) {
+		t.Errorf("wrong key: got %v", err)
+	}
+}
+
+func TestRemoteCfgSigned(t *testing.T) {
+	pub, seed := testKey(t)
+	v, _ := NewCfgVerifier(pub)
+
+	s := &cfgServer{}
+	s.set(remoteCfgBody("signed"), `"v1"`)
+	sig, _ := SignCfg([]byte(remoteCfgBody("signed")), seed)
+	signed := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".sig") {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !signed {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(sig)
+			return
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	cache := filepath.Join(t.TempDir(), "wificfg.json")
+	remote := NewRemoteCfg(srv.URL+"/wificfg.json", cache)
+	remote.Verifier = v
+	if _, err := remote.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := ioutil.ReadFile(cache + ".sig"); string(cached) != string(sig) {
+		t.Errorf("cached signature %q", cached)
+	}
+
+	// a spoofed configuration is rejected and the signed one kept
+	s.set(remoteCfgBody("spoofed"), `"v2"`)
+	if _, _, err := remote.Refresh(); !errors.Is(err, ErrCfgSignature) {
+		t.Errorf("spoofed: got %v", err)
+	}
+	s.mu.Lock()
+	signed = false
+	s.mu.Unlock()
+	if _, _, err := remote.Refresh(); !errors.Is(err, ErrCfgSignature) {
+		t.Errorf("unsigned: got %v", err)
+	}
+
+	// a tampered cache is ignored
+	ioutil.WriteFile(cache, []byte(remoteCfgBody("tampered")), 0600)
+	offline := NewRemoteCfg("http://127.0.0.1:1/wificfg.json", cache)
+	offline.Verifier = v
+	if _, err := offline.Load(); err == nil {
+		t.Error("expected the tampered cache to be ignored")
+	}
+}
@@ -0,0 +1,190 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MAC address access control policies of HostApdCfg.MacAcl, which are
+// also the names of the two lists.
+const (
+	MacAclDeny   = "deny"   // every station but those denied, macaddr_acl=0
+	MacAclAccept = "accept" // only the accepted stations, macaddr_acl=1
+)
+
+// Default files of the deny and accept lists.
+const (
+	DefaultDenyMacFile   = "/var/lib/txwifi/hostapd.deny"
+	DefaultAcceptMacFile = "/var/lib/txwifi/hostapd.accept"
+)
+
+// ErrInvalidMac is returned for a station that is not a MAC address.
+var ErrInvalidMac = errors.New("invalid MAC address")
+
+// ApStation is a station associated with the access point, with the
+// DHCP lease dnsmasq handed out to it. Info holds everything hostapd
+// reports and is only set for a single station.
+type ApStation struct {
+	Mac           string            `json:"mac"`
+	Ip            string            `json:"ip,omitempty"`
+	Hostname      string            `json:"hostname,omitempty"`
+	Signal        int               `json:"signal"`         // dBm
+	ConnectedTime int               `json:"connected_time"` // seconds
+	InactiveMsec  int               `json:"inactive_msec"`
+	RxBytes       uint64            `json:"rx_bytes"`
+	TxBytes       uint64            `json:"tx_bytes"`
+	Info          map[string]string `json:"info,omitempty"`
+}
+
+// newApStation combines what hostapd reports about a station with its
+// lease, if any.
+func newApStation(sta ApdStation, leases map[string]DhcpLease) ApStation {
+	st := ApStation{Mac: sta.Mac}
+	st.Signal, _ = strconv.Atoi(sta.Info["signal"])
+	st.ConnectedTime, _ = strconv.Atoi(sta.Info["connected_time"])
+	st.InactiveMsec, _ = strconv.Atoi(sta.Info["inactive_msec"])
+	st.RxBytes, _ = strconv.ParseUint(sta.Info["rx_bytes"], 10, 64)
+	st.TxBytes, _ = strconv.ParseUint(sta.Info["tx_bytes"], 10, 64)
+
+	if lease, ok := leases[strings.ToLower(sta.Mac)]; ok {
+		st.Ip = lease.Ip
+		st.Hostname = lease.Hostname
+	}
+	return st
+}
+
+// ApAcl is the MAC address access control of the access point.
+type ApAcl struct {
+	Policy string   `json:"policy"` // deny or accept
+	Deny   []string `json:"deny"`
+	Accept []string `json:"accept"`
+}
+
+// macAcl returns the configured policy, deny when empty.
+func (c HostApdCfg) macAcl() string {
+	if c.MacAcl == "" {
+		return MacAclDeny
+	}
+	return c.MacAcl
+}
+
+// macFile returns the file of the deny or accept list, the default when
+// not configured.
+func (c HostApdCfg) macFile(list string) string {
+	if list == MacAclAccept {
+		if c.AcceptMacFile == "" {
+			return DefaultAcceptMacFile
+		}
+		return c.AcceptMacFile
+	}
+	if c.DenyMacFile == "" {
+		return DefaultDenyMacFile
+	}
+	return c.DenyMacFile
+}
+
+// readAcl reads the policy and both lists.
+func (c HostApdCfg) readAcl() (ApAcl, error) {
+	acl := ApAcl{Policy: c.macAcl()}
+
+	var err error
+	if acl.Deny, err = readMacFile(c.macFile(MacAclDeny)); err != nil {
+		return acl, err
+	}
+	acl.Accept, err = readMacFile(c.macFile(MacAclAccept))
+	return acl, err
+}
+
+// parseMac returns the canonical form of a station MAC address.
+func parseMac(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("%w: %q", ErrInvalidMac, mac)
+	}
+	return hw.String(), nil
+}
+
+// readMacFile reads a hostapd MAC list, one address per line. Comments
+// and lines that are not a MAC address are skipped; a missing file is
+// an empty list.
+func readMacFile(file string) ([]string, error) {
+	macs := make([]string, 0)
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return macs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if mac, err := parseMac(fields[0]); err == nil {
+			macs = append(macs, mac)
+		}
+	}
+	return macs, nil
+}
+
+// editMacFile adds a MAC address to or removes it from a hostapd MAC
+// list, keeping it sorted. It reports whether the list changed.
+func editMacFile(file string, mac string, add bool) (bool, error) {
+	macs, err := readMacFile(file)
+	if err != nil {
+		return false, err
+	}
+
+	next := make([]string, 0, len(macs)+1)
+	found := false
+	for _, m := range macs {
+		if m == mac {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		next = append(next, m)
+	}
+	if found == add {
+		return false, nil
+	}
+	if add {
+		next = append(next, mac)
+	}
+	sort.Strings(next)
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return false, err
+	}
+	var b strings.Builder
+	for _, m := range next {
+		b.WriteString(m + "\n")
+	}
+	return true, writeFileAtomic(file, []byte(b.String()))
+}
+
+// ensureMacFile creates an empty MAC list when there is none, hostapd
+// does not start without it.
+func ensureMacFile(file string) error {
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, nil, 0600)
+}
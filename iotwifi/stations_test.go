@@ -0,0 +1,220 @@
+package iotwifi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testLeases = `1700000000 aa:bb:cc:dd:ee:01 192.168.27.101 sensor-1 01:aa:bb:cc:dd:ee:01
+0 AA:BB:CC:DD:EE:02 192.168.27.102 * *
+duid 00:01:00:01:2c:1f:00:00:aa:bb:cc:dd:ee:ff
+1700000000 1234abcd fd00::10 phone 00:01:00:01
+`
+
+func TestReadLeases(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	ioutil.WriteFile(file, []byte(testLeases), 0644)
+
+	leases, err := ReadLeases(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("expected 2 leases, got %+v", leases)
+	}
+	if l := leases[0]; l.Mac != "aa:bb:cc:dd:ee:01" || l.Ip != "192.168.27.101" || l.Hostname != "sensor-1" ||
+		l.Expires == nil || l.Expires.Unix() != 1700000000 {
+		t.Errorf("unexpected lease %+v", l)
+	}
+	if l := leases[1]; l.Mac != "aa:bb:cc:dd:ee:02" || l.Hostname != "" || l.ClientId != "" || l.Expires != nil {
+		t.Errorf("unexpected lease %+v", l)
+	}
+
+	if leases, err := ReadLeases(filepath.Join(t.TempDir(), "missing")); err != nil || len(leases) != 0 {
+		t.Errorf("missing file: %v %v", leases, err)
+	}
+}
+
+func TestEditMacFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl", "hostapd.deny")
+
+	for _, tt := range []struct {
+		mac     string
+		add     bool
+		changed bool
+		want    []string
+	}{
+		{"aa:bb:cc:dd:ee:02", true, true, []string{"aa:bb:cc:dd:ee:02"}},
+		{"aa:bb:cc:dd:ee:01", true, true, []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"}},
+		{"aa:bb:cc:dd:ee:01", true, false, []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"}},
+		{"aa:bb:cc:dd:ee:02", false, true, []string{"aa:bb:cc:dd:ee:01"}},
+		{"aa:bb:cc:dd:ee:02", false, false, []string{"aa:bb:cc:dd:ee:01"}},
+	} {
+		changed, err := editMacFile(file, tt.mac, tt.add)
+		if err != nil || changed != tt.changed {
+			t.Errorf("%s %t: changed %t, %v", tt.mac, tt.add, changed, err)
+		}
+		if macs, _ := readMacFile(file); !reflect.DeepEqual(macs, tt.want) {
+			t.Errorf("%s %t: list %v, expected %v", tt.mac, tt.add, macs, tt.want)
+		}
+	}
+
+	// hostapd comments and lines with a VLAN ID are read too
+	ioutil.WriteFile(file, []byte("# denied\nAA:BB:CC:DD:EE:03 2\nnot-a-mac\n"), 0600)
+	if macs, _ := readMacFile(file); !reflect.DeepEqual(macs, []string{"aa:bb:cc:dd:ee:03"}) {
+		t.Errorf("unexpected list %v", macs)
+	}
+}
+
+func TestLeasesHandler(t *testing.T) {
+	h, _, cfg := newStationsHandler(t)
+
+	ret := serveApi(t, h.LeasesHandler, "GET", "/ap/leases", "")
+	leases, _ := ret.Payload.([]interface{})
+	if ret.Status != "OK" || len(leases) != 2 {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	if lease := leases[0].(map[string]interface{}); lease["mac"] != "aa:bb:cc:dd:ee:01" || lease["ip"] != "192.168.27.101" ||
+		lease["hostname"] != "sensor-1" || lease["expires"] != "2023-11-14T22:13:20Z" {
+		t.Errorf("unexpected lease %v", lease)
+	}
+
+	os.Remove(cfg.DnsmasqCfg.LeaseFile)
+	ret = serveApi(t, h.LeasesHandler, "GET", "/ap/leases", "")
+	if leases, _ := ret.Payload.([]interface{}); ret.Status != "OK" || len(leases) != 0 {
+		t.Errorf("no lease file: %+v", ret)
+	}
+}
+
+// newStationsHandler returns an HttpHandler with a fake hostapd that has
+// two stations, one of them with a lease.
+func newStationsHandler(t *testing.T) (*HttpHandler, *fakeDaemon, *SetupCfg) {
+	r := newFakeRadio(t)
+	ioutil.WriteFile(r.cfg.DnsmasqCfg.LeaseFile, []byte(testLeases), 0644)
+
+	d := startFakeDaemon(t, filepath.Join(r.cfg.HostApdCfg.CtrlInterface, "uap0"), map[string]string{
+		"STA-FIRST":                  "aa:bb:cc:dd:ee:01\nsignal=-52\nconnected_time=120\ninactive_msec=300\nrx_bytes=1000\ntx_bytes=2000\n",
+		"STA-NEXT aa:bb:cc:dd:ee:01": "aa:bb:cc:dd:ee:09\nsignal=-70\n",
+		"STA-NEXT aa:bb:cc:dd:ee:09": "",
+		"STA aa:bb:cc:dd:ee:01":      "aa:bb:cc:dd:ee:01\nsignal=-52\nflags=[AUTH][ASSOC][AUTHORIZED]\n",
+		"STA":                        "FAIL\n",
+		"DEAUTHENTICATE":             "OK\n",
+		"DENY_ACL":                   "OK\n",
+		"ACCEPT_ACL":                 "OK\n",
+	})
+
+	h := &HttpHandler{
+		manager: NewConnManager(make(chan CmdMessage, 1), r.cfg),
+		apd:     NewApdCtrl(r.cfg.HostApdCfg.CtrlInterface, "uap0"),
+	}
+	return h, d, r.cfg
+}
+
+func TestStationsHandler(t *testing.T) {
+	h, d, _ := newStationsHandler(t)
+
+	ret := serveApi(t, h.StationsHandler, "GET", "/ap/stations", "")
+	stations, _ := ret.Payload.([]interface{})
+	if ret.Status != "OK" || len(stations) != 2 {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	first := stations[0].(map[string]interface{})
+	if first["mac"] != "aa:bb:cc:dd:ee:01" || first["hostname"] != "sensor-1" || first["ip"] != "192.168.27.101" ||
+		first["signal"] != -52.0 || first["connected_time"] != 120.0 || first["rx_bytes"] != 1000.0 ||
+		first["tx_bytes"] != 2000.0 || first["info"] != nil {
+		t.Errorf("unexpected station %v", first)
+	}
+	if second := stations[1].(map[string]interface{}); second["hostname"] != nil || second["signal"] != -70.0 {
+		t.Errorf("unexpected station %v", second)
+	}
+
+	// a station that leaves during the walk ends it early
+	d.SetReply("STA-NEXT aa:bb:cc:dd:ee:01", "FAIL\n")
+	ret = serveApi(t, h.StationsHandler, "GET", "/ap/stations", "")
+	if stations, _ := ret.Payload.([]interface{}); ret.Status != "OK" || len(stations) != 1 {
+		t.Errorf("unexpected return %+v", ret)
+	}
+
+	ret = serveApi(t, h.StationHandler, "GET", "/ap/stations/AA:BB:CC:DD:EE:01", "")
+	station, _ := ret.Payload.(map[string]interface{})
+	if info, _ := station["info"].(map[string]interface{}); ret.Status != "OK" || info["flags"] != "[AUTH][ASSOC][AUTHORIZED]" {
+		t.Errorf("unexpected return %+v", ret)
+	}
+
+	if ret = serveApi(t, h.StationHandler, "GET", "/ap/stations/aa:bb:cc:dd:ee:05", ""); ret.Status != "FAIL" {
+		t.Errorf("unknown station: %+v", ret)
+	}
+	if ret = serveApi(t, h.KickStationHandler, "DELETE", "/ap/stations/nope", ""); ret.Status != "FAIL" ||
+		!strings.Contains(ret.Message, ErrInvalidMac.Error()) {
+		t.Errorf("invalid MAC: %+v", ret)
+	}
+
+	if ret = serveApi(t, h.KickStationHandler, "DELETE", "/ap/stations/aa:bb:cc:dd:ee:01", ""); ret.Status != "OK" {
+		t.Errorf("unexpected return %+v", ret)
+	}
+	assertOrder(t, d.Requests(), "DEAUTHENTICATE aa:bb:cc:dd:ee:01")
+}
+
+func TestAclHandlers(t *testing.T) {
+	h, d, cfg := newStationsHandler(t)
+
+	ret := serveApi(t, h.AddDenyMacHandler, "PUT", "/ap/acl/deny/AA-BB-CC-DD-EE-01", "")
+	acl, _ := ret.Payload.(map[string]interface{})
+	if ret.Status != "OK" || acl["policy"] != MacAclDeny || !reflect.DeepEqual(acl["deny"], []interface{}{"aa:bb:cc:dd:ee:01"}) {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	assertOrder(t, d.Requests(), "DENY_ACL ADD_MAC aa:bb:cc:dd:ee:01", "DEAUTHENTICATE aa:bb:cc:dd:ee:01")
+	if macs, _ := readMacFile(cfg.HostApdCfg.DenyMacFile); len(macs) != 1 {
+		t.Errorf("deny list not saved: %v", macs)
+	}
+
+	// the list persists while hostapd is down
+	d.Stop()
+	ret = serveApi(t, h.AddAcceptMacHandler, "PUT", "/ap/acl/accept/aa:bb:cc:dd:ee:02", "")
+	if ret.Status != "OK" {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+	ret = serveApi(t, h.RemoveDenyMacHandler, "DELETE", "/ap/acl/deny/aa:bb:cc:dd:ee:01", "")
+	if ret.Status != "OK" {
+		t.Fatalf("unexpected return %+v", ret)
+	}
+
+	ret = serveApi(t, h.AclHandler, "GET", "/ap/acl", "")
+	acl, _ = ret.Payload.(map[string]interface{})
+	if !reflect.DeepEqual(acl["deny"], []interface{}{}) || !reflect.DeepEqual(acl["accept"], []interface{}{"aa:bb:cc:dd:ee:02"}) {
+		t.Errorf("unexpected acl %v", acl)
+	}
+
+	if ret = serveApi(t, h.AddDenyMacHandler, "PUT", "/ap/acl/deny/all", ""); ret.Status != "FAIL" {
+		t.Errorf("invalid MAC: %+v", ret)
+	}
+}
+
+func TestAclCfg(t *testing.T) {
+	conf := renderHostApd(HostApdCfg{Ssid: "iot", Channel: "6", MacAcl: MacAclAccept,
+		AcceptMacFile: "/data/accept"}, "uap0", DefaultApdCtrlDir)
+	for _, want := range []string{"macaddr_acl=1\n", "accept_mac_file=/data/accept\n", "deny_mac_file=" + DefaultDenyMacFile + "\n"} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("missing %q in\n%s", want, conf)
+		}
+	}
+
+	cfg := validCfg()
+	cfg.HostApdCfg.MacAcl = "allow"
+	cfg.HostApdCfg.DenyMacFile = "hostapd.deny"
+	if got := fields(t, cfg.Validate()); !reflect.DeepEqual(got, []string{"host_apd_cfg.mac_acl", "host_apd_cfg.deny_mac_file"}) {
+		t.Errorf("unexpected fields %v", got)
+	}
+
+	// the lists are kept in files hostapd is started with
+	err := UpdateApCfg(validCfg(), []byte(`{"mac_acl":"accept","accept_mac_file":"/tmp/accept"}`))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Field != "host_apd_cfg.accept_mac_file" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,454 @@
+package iotwifi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Restart modes of a RestartPolicy.
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+
+	// crashLoopThreshold is the number of consecutive short runs after
+	// which a daemon is reported as crash looping.
+	crashLoopThreshold = 5
+)
+
+var (
+	// daemonStableRun is how long a daemon has to run for its backoff
+	// to be reset.
+	daemonStableRun = 30 * time.Second
+	// daemonKillTimeout bounds the wait for a daemon to exit after
+	// SIGTERM before it is killed.
+	daemonKillTimeout = 5 * time.Second
+)
+
+// DefaultPidDir holds the pid files of the daemons unless SetupCfg.PidDir
+// is set.
+const DefaultPidDir = "/var/run/txwifi"
+
+// pidDir returns the configured pid directory, DefaultPidDir when empty.
+func (s *SetupCfg) pidDir() string {
+	if s.PidDir == "" {
+		return DefaultPidDir
+	}
+	return s.PidDir
+}
+
+// DaemonStatus describes a supervised daemon.
+type DaemonStatus struct {
+	Name                string    `json:"name"`
+	Restart             string    `json:"restart"`
+	Running             bool      `json:"running"`
+	Pid                 int       `json:"pid"`
+	Started             time.Time `json:"started"`
+	Exited              time.Time `json:"exited"`
+	ExitCode            int       `json:"exit_code"`
+	Error               string    `json:"error,omitempty"`
+	Restarts            int       `json:"restarts"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	CrashLoop           bool      `json:"crash_loop"`
+	NextRestart         time.Time `json:"next_restart"`
+}
+
+// daemon is a supervised command.
+type daemon struct {
+	name   string
+	arg    []string
+	policy RestartPolicy
+	min    time.Duration
+	max    time.Duration
+
+	status DaemonStatus  // guarded by Supervisor.mu
+	proc   Process       // guarded by Supervisor.mu
+	stop   chan struct{} // closed to stop supervising
+	done   chan struct{} // closed when supervision ends
+}
+
+// Supervisor starts daemons through a CmdRunner and restarts them when
+// they exit, with exponential backoff according to the restart policy
+// of each daemon.
+type Supervisor struct {
+	runner   *CmdRunner
+	policies map[string]RestartPolicy
+
+	// PidDir, when set, holds a <name>.pid file for every running
+	// daemon, so KillStale can stop those left behind by an earlier run
+	// without touching copies started by anyone else.
+	PidDir string
+
+	// OnChange is called with the status of a daemon whenever it
+	// starts, exits or is scheduled for a restart.
+	OnChange func(DaemonStatus)
+
+	mu      sync.Mutex
+	daemons map[string]*daemon
+	closed  bool
+}
+
+// NewSupervisor produces a Supervisor. Daemons without a policy are
+// always restarted.
+func NewSupervisor(runner *CmdRunner, policies map[string]RestartPolicy) *Supervisor {
+	return &Supervisor{
+		runner:   runner,
+		policies: policies,
+		daemons:  make(map[string]*daemon),
+	}
+}
+
+// Start starts a daemon and supervises it under its program name. A
+// daemon of the same name that is already supervised is stopped first.
+func (s *Supervisor) Start(name string, arg ...string) {
+	s.Stop(name)
+
+	s.mu.Lock()
+	policy := s.policies[name]
+	s.mu.Unlock()
+	if policy.Restart == "" {
+		policy.Restart = RestartAlways
+	}
+	d := &daemon{
+		name:   name,
+		arg:    arg,
+		policy: policy,
+		min:    parseBackoff(policy.MinBackoff, defaultMinBackoff),
+		max:    parseBackoff(policy.MaxBackoff, defaultMaxBackoff),
+		status: DaemonStatus{Name: name, Restart: policy.Restart},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.daemons[name] = d
+	s.mu.Unlock()
+
+	go s.supervise(d)
+}
+
+// SetPolicies replaces the restart policies. They apply to daemons
+// started from then on.
+func (s *Supervisor) SetPolicies(policies map[string]RestartPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies = policies
+}
+
+// Stop stops supervising a daemon and terminates it, killing it if it
+// does not exit within daemonKillTimeout. It returns once the daemon
+// has exited.
+func (s *Supervisor) Stop(name string) {
+	s.mu.Lock()
+	d, ok := s.daemons[name]
+	if ok {
+		delete(s.daemons, name)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	close(d.stop)
+	s.signal(d, syscall.SIGTERM)
+
+	select {
+	case <-d.done:
+		return
+	case <-time.After(daemonKillTimeout):
+	}
+
+	log.Warnf("%s did not exit, killing it", name)
+	s.signal(d, syscall.SIGKILL)
+	<-d.done
+}
+
+// KillStale terminates the daemon recorded in the pid file of name, left
+// running by an earlier run that did not shut down. Nothing is done
+// while name is supervised, or when the pid no longer runs name.
+func (s *Supervisor) KillStale(name string) {
+	s.mu.Lock()
+	_, supervised := s.daemons[name]
+	s.mu.Unlock()
+	if s.PidDir == "" || supervised {
+		return
+	}
+
+	pid, err := readPid(s.pidFile(name))
+	if err != nil {
+		return
+	}
+	os.Remove(s.pidFile(name))
+	if !pidRuns(pid, name) {
+		return
+	}
+
+	log.Warnf("stopping %s (pid %d) left running by an earlier run", name, pid)
+	syscall.Kill(pid, syscall.SIGTERM)
+
+	deadline := time.Now().Add(daemonKillTimeout)
+	for pidRuns(pid, name) {
+		if time.Now().After(deadline) {
+			log.Warnf("%s (pid %d) did not exit, killing it", name, pid)
+			syscall.Kill(pid, syscall.SIGKILL)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (s *Supervisor) pidFile(name string) string {
+	return filepath.Join(s.PidDir, name+".pid")
+}
+
+// writePid records the pid of a started daemon.
+func (s *Supervisor) writePid(name string, pid int) {
+	if s.PidDir == "" {
+		return
+	}
+	if err := os.MkdirAll(s.PidDir, 0755); err != nil {
+		log.Warnf("unable to record the pid of %s: %s", name, err)
+		return
+	}
+	if err := ioutil.WriteFile(s.pidFile(name), []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		log.Warnf("unable to record the pid of %s: %s", name, err)
+	}
+}
+
+// removePid forgets the pid of a daemon that exited.
+func (s *Supervisor) removePid(name string) {
+	if s.PidDir != "" {
+		os.Remove(s.pidFile(name))
+	}
+}
+
+func readPid(file string) (int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("%s: invalid pid %q", file, data)
+	}
+	return pid, nil
+}
+
+// pidRuns reports whether pid is a running process of the program name,
+// guarding against the pid having been reused since it was recorded.
+func pidRuns(pid int, name string) bool {
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return false
+	}
+	// the kernel truncates comm to 15 bytes
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return strings.TrimSpace(string(comm)) == name
+}
+
+// Close stops supervising every daemon without signalling them, leaving
+// their termination to CmdRunner.Terminate. No daemons are started once
+// Close has been called.
+func (s *Supervisor) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for name, d := range s.daemons {
+		close(d.stop)
+		delete(s.daemons, name)
+	}
+}
+
+// Status returns the status of the supervised daemons, sorted by name.
+func (s *Supervisor) Status() []DaemonStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := make([]DaemonStatus, 0, len(s.daemons))
+	for _, d := range s.daemons {
+		status = append(status, d.status)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+
+	return status
+}
+
+func (s *Supervisor) signal(d *daemon, sig syscall.Signal) {
+	s.mu.Lock()
+	proc := d.proc
+	s.mu.Unlock()
+	if proc != nil {
+		proc.Signal(sig)
+	}
+}
+
+// update changes the status of a daemon and reports it.
+func (s *Supervisor) update(d *daemon, fn func(*DaemonStatus)) {
+	s.mu.Lock()
+	fn(&d.status)
+	status := d.status
+	s.mu.Unlock()
+
+	if s.OnChange != nil {
+		s.OnChange(status)
+	}
+}
+
+// supervise runs a daemon until it is stopped or its policy says it
+// should stay down.
+func (s *Supervisor) supervise(d *daemon) {
+	defer close(d.done)
+
+	for {
+		proc, wait, err := s.runner.StartCmd(d.name, d.name, d.arg...)
+		if err == ErrRunnerClosed {
+			return
+		}
+
+		started := time.Now()
+		if err != nil {
+			log.Errorf("%s failed to start: %s", d.name, err)
+			s.update(d, func(st *DaemonStatus) {
+				st.Running = false
+				st.Pid = 0
+				st.Exited = started
+				st.ExitCode = -1
+				st.Error = err.Error()
+			})
+		} else {
+			s.mu.Lock()
+			d.proc = proc
+			s.mu.Unlock()
+			select {
+			case <-d.stop:
+				// Stop ran before the process was recorded
+				proc.Signal(syscall.SIGTERM)
+			default:
+			}
+			s.writePid(d.name, proc.Pid())
+			s.update(d, func(st *DaemonStatus) {
+				st.Running = true
+				st.Pid = proc.Pid()
+				st.Started = started
+				st.NextRestart = time.Time{}
+			})
+
+			err = wait()
+
+			s.removePid(d.name)
+			s.mu.Lock()
+			d.proc = nil
+			s.mu.Unlock()
+			code := exitCode(err)
+			s.update(d, func(st *DaemonStatus) {
+				st.Running = false
+				st.Exited = time.Now()
+				st.ExitCode = code
+				st.Error = ""
+				if err != nil {
+					st.Error = err.Error()
+				}
+			})
+		}
+
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		s.mu.Lock()
+		status := d.status
+		s.mu.Unlock()
+
+		if d.policy.Restart == RestartNever || (d.policy.Restart == RestartOnFailure && status.ExitCode == 0) {
+			log.Warnf("%s exited with code %d, not restarting (%s)", d.name, status.ExitCode, d.policy.Restart)
+			return
+		}
+
+		failures := status.ConsecutiveFailures + 1
+		if time.Since(started) >= daemonStableRun {
+			failures = 1
+		}
+		backoff := backoffFor(failures, d.min, d.max)
+
+		s.update(d, func(st *DaemonStatus) {
+			st.ConsecutiveFailures = failures
+			st.CrashLoop = failures >= crashLoopThreshold
+			st.NextRestart = time.Now().Add(backoff)
+		})
+		if failures >= crashLoopThreshold {
+			log.Errorf("%s is crash looping, %d failures in a row, restarting in %s", d.name, failures, backoff)
+		} else {
+			log.Warnf("%s exited with code %d, restarting in %s", d.name, status.ExitCode, backoff)
+		}
+
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		s.update(d, func(st *DaemonStatus) {
+			st.Restarts++
+		})
+	}
+}
+
+// backoffFor doubles min for every failure after the first, up to max.
+func backoffFor(failures int, min time.Duration, max time.Duration) time.Duration {
+	backoff := min
+	for i := 1; i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// parseBackoff parses a duration like "500ms" or "1m", returning def if
+// it is empty or invalid.
+func parseBackoff(s string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
+// exitCode returns the exit code of a Process.Wait error, -1 when the
+// process did not exit normally.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(interface{ ExitCode() int }); ok {
+		return e.ExitCode()
+	}
+	return -1
+}
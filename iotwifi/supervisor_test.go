@@ -0,0 +1,232 @@
+package iotwifi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestSupervisor returns a supervisor on a fake executor with fast
+// backoff for every daemon.
+func newTestSupervisor(t *testing.T, restart string) (*Supervisor, *fakeExecutor) {
+	f := newFakeExecutor()
+	messages := make(chan CmdMessage, 1)
+	go HandleLog(messages)
+
+	runner := &CmdRunner{
+		Messages: messages,
+		Handlers: make(map[string]func(CmdMessage)),
+		Commands: make(map[string]Process),
+		Executor: f,
+	}
+	policy := RestartPolicy{Restart: restart, MinBackoff: "5ms", MaxBackoff: "20ms"}
+	s := NewSupervisor(runner, map[string]RestartPolicy{
+		"dnsmasq": policy,
+		"crasher": policy,
+	})
+	t.Cleanup(s.Close)
+
+	return s, f
+}
+
+func countCalls(f *fakeExecutor, line string) int {
+	n := 0
+	for _, c := range f.Calls() {
+		if c == line {
+			n++
+		}
+	}
+	return n
+}
+
+func daemonStatus(s *Supervisor, name string) DaemonStatus {
+	for _, st := range s.Status() {
+		if st.Name == name {
+			return st
+		}
+	}
+	return DaemonStatus{}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	s, f := newTestSupervisor(t, RestartAlways)
+
+	s.Start("dnsmasq", "--port=0")
+	waitFor(t, "dnsmasq running", func() bool { return daemonStatus(s, "dnsmasq").Running })
+
+	// dnsmasq dies
+	f.mu.Lock()
+	f.running["dnsmasq"][0].exit()
+	f.mu.Unlock()
+
+	waitFor(t, "dnsmasq restart", func() bool {
+		st := daemonStatus(s, "dnsmasq")
+		return st.Running && st.Restarts == 1
+	})
+	if n := countCalls(f, "dnsmasq --port=0"); n != 2 {
+		t.Errorf("dnsmasq started %d times, want 2", n)
+	}
+	if st := daemonStatus(s, "dnsmasq"); st.Pid != 4242 || st.CrashLoop {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
+
+func TestSupervisorCrashLoop(t *testing.T) {
+	s, f := newTestSupervisor(t, RestartAlways)
+
+	var reported []DaemonStatus
+	done := make(chan struct{})
+	s.OnChange = func(st DaemonStatus) {
+		if st.CrashLoop && len(reported) == 0 {
+			reported = append(reported, st)
+			close(done)
+		}
+	}
+
+	// not a fake daemon, so every run exits right away
+	s.Start("crasher")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("crash loop not reported")
+	}
+	s.Stop("crasher")
+
+	if reported[0].ConsecutiveFailures < crashLoopThreshold {
+		t.Errorf("unexpected status %+v", reported[0])
+	}
+	if n := countCalls(f, "crasher"); n < crashLoopThreshold {
+		t.Errorf("crasher started %d times", n)
+	}
+}
+
+func TestSupervisorPolicies(t *testing.T) {
+	for _, restart := range []string{RestartNever, RestartOnFailure} {
+		s, f := newTestSupervisor(t, restart)
+
+		// a clean exit is not restarted by either policy
+		s.Start("crasher")
+		waitFor(t, "crasher exit", func() bool {
+			st := daemonStatus(s, "crasher")
+			return !st.Started.IsZero() && !st.Running
+		})
+		time.Sleep(50 * time.Millisecond)
+
+		if n := countCalls(f, "crasher"); n != 1 {
+			t.Errorf("%s: crasher started %d times, want 1", restart, n)
+		}
+		if st := daemonStatus(s, "crasher"); st.Restarts != 0 || st.ExitCode != 0 {
+			t.Errorf("%s: unexpected status %+v", restart, st)
+		}
+	}
+}
+
+func TestSupervisorStop(t *testing.T) {
+	s, f := newTestSupervisor(t, RestartAlways)
+
+	s.Start("dnsmasq")
+	waitFor(t, "dnsmasq running", func() bool { return daemonStatus(s, "dnsmasq").Running })
+
+	s.Stop("dnsmasq")
+	time.Sleep(50 * time.Millisecond)
+
+	if n := countCalls(f, "dnsmasq"); n != 1 {
+		t.Errorf("dnsmasq started %d times, want 1", n)
+	}
+	if len(s.Status()) != 0 {
+		t.Errorf("unexpected status %+v", s.Status())
+	}
+}
+
+func TestSupervisorPidFiles(t *testing.T) {
+	s, _ := newTestSupervisor(t, RestartAlways)
+	s.PidDir = filepath.Join(t.TempDir(), "run")
+	pidFile := filepath.Join(s.PidDir, "dnsmasq.pid")
+
+	s.Start("dnsmasq")
+	waitFor(t, "dnsmasq running", func() bool { return daemonStatus(s, "dnsmasq").Running })
+	if pid, err := readPid(pidFile); err != nil || pid != 4242 {
+		t.Fatalf("pid %d, %v", pid, err)
+	}
+
+	// the pid of a supervised daemon is left alone
+	s.KillStale("dnsmasq")
+	if _, err := os.Stat(pidFile); err != nil {
+		t.Error(err)
+	}
+
+	s.Stop("dnsmasq")
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("pid file left after Stop: %v", err)
+	}
+}
+
+func TestSupervisorKillStale(t *testing.T) {
+	s, _ := newTestSupervisor(t, RestartAlways)
+	s.PidDir = t.TempDir()
+
+	// a copy left by an earlier run, and one started by someone else
+	stale := exec.Command("sleep", "60")
+	other := exec.Command("sleep", "60")
+	for _, cmd := range []*exec.Cmd{stale, other} {
+		if err := cmd.Start(); err != nil {
+			t.Skip(err)
+		}
+		defer cmd.Process.Kill()
+	}
+	exited := make(chan struct{})
+	go func() {
+		stale.Wait()
+		close(exited)
+	}()
+
+	// a pid that no longer runs the daemon is not signaled
+	ioutil.WriteFile(filepath.Join(s.PidDir, "hostapd.pid"), []byte(strconv.Itoa(other.Process.Pid)), 0644)
+	s.KillStale("hostapd")
+
+	ioutil.WriteFile(filepath.Join(s.PidDir, "sleep.pid"), []byte(strconv.Itoa(stale.Process.Pid)+"\n"), 0644)
+	s.KillStale("sleep")
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stale process still running")
+	}
+	if !pidRuns(other.Process.Pid, "sleep") {
+		t.Error("process not started by us was killed")
+	}
+	if _, err := os.Stat(filepath.Join(s.PidDir, "sleep.pid")); !os.IsNotExist(err) {
+		t.Errorf("stale pid file left: %v", err)
+	}
+}
+
+type exitErr int
+
+func (e exitErr) Error() string { return "exit status" }
+func (e exitErr) ExitCode() int { return int(e) }
+
+func TestBackoff(t *testing.T) {
+	for failures, want := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		4: 8 * time.Second,
+		9: time.Minute,
+	} {
+		if got := backoffFor(failures, time.Second, time.Minute); got != want {
+			t.Errorf("backoffFor(%d) = %s, want %s", failures, got, want)
+		}
+	}
+
+	if parseBackoff("250ms", time.Second) != 250*time.Millisecond || parseBackoff("soon", time.Second) != time.Second {
+		t.Error("parseBackoff")
+	}
+
+	if exitCode(nil) != 0 || exitCode(exitErr(3)) != 3 || exitCode(errors.New("killed")) != -1 {
+		t.Error("exitCode")
+	}
+}
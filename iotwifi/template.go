@@ -0,0 +1,181 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sysClassNetDir holds the network devices with their MAC addresses.
+var sysClassNetDir = "/sys/class/net"
+
+// serialFiles are read in order for the device serial number, the device
+// tree first and /proc/cpuinfo on a Raspberry Pi.
+var serialFiles = []string{
+	"/sys/firmware/devicetree/base/serial-number",
+	"/proc/cpuinfo",
+}
+
+// DeviceInfo identifies a device in the templates of HostApdCfg.Ssid and
+// HostApdCfg.WpaPassphrase, e.g. "iot-{{.MacSuffix}}". Values that can
+// not be read are empty.
+type DeviceInfo struct {
+	Mac       string // b8:27:eb:fe:c8:ab, of the station interface
+	MacSuffix string // FEC8AB, the last three bytes of Mac
+	Hostname  string
+	Serial    string // 00000000fec8ab12
+}
+
+// ReadDeviceInfo reads the device information, using the MAC address of
+// the given interface.
+func ReadDeviceInfo(iface string) DeviceInfo {
+	dev := DeviceInfo{Serial: readSerial(serialFiles)}
+
+	if mac, err := ioutil.ReadFile(filepath.Join(sysClassNetDir, iface, "address")); err != nil {
+		log.Warnf("unable to read the MAC address of %s: %s", iface, err)
+	} else {
+		dev.setMac(strings.TrimSpace(string(mac)))
+	}
+
+	if host, err := os.Hostname(); err == nil {
+		dev.Hostname = host
+	}
+
+	return dev
+}
+
+// setMac sets Mac and MacSuffix from a MAC address.
+func (d *DeviceInfo) setMac(mac string) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) < 3 {
+		log.Warnf("unable to parse MAC address %q", mac)
+		return
+	}
+	d.Mac = hw.String()
+	d.MacSuffix = fmt.Sprintf("%X", []byte(hw[len(hw)-3:]))
+}
+
+// readSerial returns the serial number from the first file that has
+// one, either as the whole content or as a "Serial : ..." line.
+func readSerial(files []string) string {
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		if !bytes.Contains(data, []byte(":")) {
+			if s := strings.TrimSpace(strings.Trim(string(data), "\x00")); s != "" {
+				return s
+			}
+			continue
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			kv := strings.SplitN(scanner.Text(), ":", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "Serial" {
+				return strings.TrimSpace(kv[1])
+			}
+		}
+	}
+	return ""
+}
+
+// DerivePassphrase returns the WPA passphrase of a device: 16 lower case
+// base32 characters of the HMAC-SHA256 of its MAC address keyed with the
+// secret. Anyone with the secret, e.g. a label printer, can compute it
+// from the MAC address; nobody else can.
+func DerivePassphrase(secret string, mac string) (string, error) {
+	if secret == "" {
+		return "", errors.New("empty passphrase secret")
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", fmt.Errorf("deriving passphrase: %w", err)
+	}
+
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(hw.String()))
+	sum := h.Sum(nil)
+
+	return strings.ToLower(base32.StdEncoding.EncodeToString(sum[:10])), nil
+}
+
+// sampleDevice is used to validate templates away from the device.
+var sampleDevice = DeviceInfo{
+	Mac:       "b8:27:eb:fe:c8:ab",
+	MacSuffix: "FEC8AB",
+	Hostname:  "raspberrypi",
+	Serial:    "00000000fec8ab12",
+}
+
+// isTemplate reports whether a setting is a template.
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// expandTemplate executes a setting as a template for a device. The
+// passphrase function derives a passphrase, {{passphrase "secret"}}.
+func expandTemplate(name string, text string, dev DeviceInfo) (string, error) {
+	if !isTemplate(text) {
+		return text, nil
+	}
+
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		"passphrase": func(secret string) (string, error) {
+			if dev.Mac == "" {
+				return "", errors.New("no MAC address to derive the passphrase from")
+			}
+			return DerivePassphrase(secret, dev.Mac)
+		},
+	}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, dev); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Expand returns the configuration with the Ssid and WpaPassphrase
+// templates executed for a device, and validated.
+func (c HostApdCfg) Expand(dev DeviceInfo) (HostApdCfg, error) {
+	v := &validator{}
+
+	ssid, err := expandTemplate("ssid", c.Ssid, dev)
+	if err != nil {
+		v.add("host_apd_cfg.ssid", "%s", err)
+	} else if isTemplate(c.Ssid) {
+		validateSsid(v, "host_apd_cfg.ssid", ssid)
+	}
+
+	passphrase, err := expandTemplate("wpa_passphrase", c.WpaPassphrase, dev)
+	if err != nil {
+		v.add("host_apd_cfg.wpa_passphrase", "%s", err)
+	} else if isTemplate(c.WpaPassphrase) && passphrase != "" {
+		validatePassphrase(v, "host_apd_cfg.wpa_passphrase", passphrase)
+	}
+
+	if err := v.err(); err != nil {
+		return c, err
+	}
+
+	c.Ssid, c.WpaPassphrase = ssid, passphrase
+	return c, nil
+}
@@ -0,0 +1,126 @@
+package iotwifi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadDeviceInfo(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "net", "wlan0"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "net", "wlan0", "address"), []byte("B8:27:EB:FE:C8:AB\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cpuinfo"), []byte("Hardware\t: BCM2835\nSerial\t\t: 00000000fec8ab12\nModel\t\t: Raspberry Pi 3\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "serial-number"), []byte("10000000abcdef\x00"), 0644)
+
+	defer func(net string, serial []string) {
+		sysClassNetDir, serialFiles = net, serial
+	}(sysClassNetDir, serialFiles)
+	sysClassNetDir = filepath.Join(dir, "net")
+	serialFiles = []string{filepath.Join(dir, "missing"), filepath.Join(dir, "cpuinfo")}
+
+	dev := ReadDeviceInfo("wlan0")
+	if dev.Mac != "b8:27:eb:fe:c8:ab" || dev.MacSuffix != "FEC8AB" || dev.Serial != "00000000fec8ab12" || dev.Hostname == "" {
+		t.Errorf("unexpected device info %+v", dev)
+	}
+
+	serialFiles = []string{filepath.Join(dir, "serial-number"), filepath.Join(dir, "cpuinfo")}
+	if dev := ReadDeviceInfo("wlan1"); dev.Mac != "" || dev.MacSuffix != "" || dev.Serial != "10000000abcdef" {
+		t.Errorf("unexpected device info %+v", dev)
+	}
+}
+
+func TestDerivePassphrase(t *testing.T) {
+	p, err := DerivePassphrase("s3cret", "b8:27:eb:fe:c8:ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != 16 || strings.ToLower(p) != p {
+		t.Errorf("unexpected passphrase %q", p)
+	}
+
+	// the MAC address format does not matter
+	if same, _ := DerivePassphrase("s3cret", "B8-27-EB-FE-C8-AB"); same != p {
+		t.Errorf("got %q, want %q", same, p)
+	}
+	if other, _ := DerivePassphrase("s3cret", "b8:27:eb:fe:c8:ac"); other == p {
+		t.Error("same passphrase for another device")
+	}
+	if other, _ := DerivePassphrase("other", "b8:27:eb:fe:c8:ab"); other == p {
+		t.Error("same passphrase for another secret")
+	}
+
+	if _, err := DerivePassphrase("", "b8:27:eb:fe:c8:ab"); err == nil {
+		t.Error("expected an error for an empty secret")
+	}
+	if _, err := DerivePassphrase("s3cret", "wlan0"); err == nil {
+		t.Error("expected an error for an invalid MAC address")
+	}
+}
+
+func TestHostApdCfgExpand(t *testing.T) {
+	derived, _ := DerivePassphrase("s3cret", sampleDevice.Mac)
+
+	tests := []struct {
+		ssid       string
+		passphrase string
+		want       HostApdCfg
+		errs       []string
+	}{
+		{"iot-{{.MacSuffix}}", "iotwifipass", HostApdCfg{Ssid: "iot-FEC8AB", WpaPassphrase: "iotwifipass"}, nil},
+		{"{{.Hostname}}-{{.Serial}}", `{{passphrase "s3cret"}}`, HostApdCfg{Ssid: "raspberrypi-00000000fec8ab12", WpaPassphrase: derived}, nil},
+		{"plain", "", HostApdCfg{Ssid: "plain"}, nil},
+		{"iot-{{.Mac", "{{.Nope}}", HostApdCfg{}, []string{"host_apd_cfg.ssid", "host_apd_cfg.wpa_passphrase"}},
+		{"a-very-long-ssid-for-{{.Hostname}}-{{.Serial}}", "{{.MacSuffix}}", HostApdCfg{}, []string{"host_apd_cfg.ssid", "host_apd_cfg.wpa_passphrase"}},
+	}
+
+	for _, tt := range tests {
+		got, err := HostApdCfg{Ssid: tt.ssid, WpaPassphrase: tt.passphrase}.Expand(sampleDevice)
+		if errs := fields(t, err); strings.Join(errs, ",") != strings.Join(tt.errs, ",") {
+			t.Errorf("%s: got errors %v, want %v", tt.ssid, err, tt.errs)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.ssid, got, tt.want)
+		}
+	}
+
+	// the passphrase can not be derived without the MAC address
+	if _, err := (HostApdCfg{Ssid: "iot", WpaPassphrase: `{{passphrase "s3cret"}}`}).Expand(DeviceInfo{}); err == nil {
+		t.Error("expected an error without a MAC address")
+	}
+}
+
+func TestHostAPdConfigTemplate(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "wlan0"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "wlan0", "address"), []byte("b8:27:eb:fe:c8:ab\n"), 0644)
+
+	defer func(net string) { sysClassNetDir = net }(sysClassNetDir)
+	sysClassNetDir = dir
+
+	cfg := validCfg()
+	cfg.Interfaces.Station = "wlan0"
+	cfg.HostApdCfg.Ssid = "iot-{{.MacSuffix}}"
+	cfg.HostApdCfg.WpaPassphrase = `{{passphrase "s3cret"}}`
+	cfg.HostApdCfg.CfgFile = filepath.Join(dir, "hostapd.conf")
+	cfg.HostApdCfg.DenyMacFile = filepath.Join(dir, "hostapd.deny")
+	cfg.HostApdCfg.AcceptMacFile = filepath.Join(dir, "hostapd.accept")
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hostAPdConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	derived, _ := DerivePassphrase("s3cret", "b8:27:eb:fe:c8:ab")
+	conf, _ := ioutil.ReadFile(cfg.HostApdCfg.CfgFile)
+	for _, want := range []string{"ssid=iot-FEC8AB\n", "wpa_passphrase=" + derived + "\n"} {
+		if !strings.Contains(string(conf), want) {
+			t.Errorf("hostapd.conf does not contain %q:\n%s", want, conf)
+		}
+	}
+}
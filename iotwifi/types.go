@@ -7,13 +7,86 @@ type SetupCfg struct {
 	WpaSupplicantCfg     WpaSupplicantCfg `json:"wpa_supplicant_cfg"`
 	DontFallBackToApMode bool             `json:"dont_fallback_to_ap_mode"`
 	AllowStartStop       bool             `json:"allow_start_stop_mode"`
+	Interfaces           InterfaceCfg     `json:"interfaces"`
+
+	// Routing shares the station uplink with the access point clients.
+	Routing RoutingCfg `json:"routing"`
+
+	// RestartPolicies configures the supervisor per daemon, keyed by
+	// hostapd, dnsmasq or wpa_supplicant.
+	RestartPolicies map[string]RestartPolicy `json:"restart_policies"`
+
+	// PidDir holds the pids of the running daemons, so that those left
+	// by an earlier run can be stopped. Defaults to DefaultPidDir.
+	PidDir string `json:"pid_dir,omitempty"`
+
+	// Executor runs external commands, defaults to OsExecutor.
+	Executor Executor `json:"-"`
+}
+
+// InterfaceCfg names the wireless devices. Empty names are discovered
+// through /sys/class/ieee80211, see DiscoverInterfaces.
+type InterfaceCfg struct {
+	Phy     string `json:"phy"`     // phy0
+	Station string `json:"station"` // wlan0
+	Ap      string `json:"ap"`      // uap0
+}
+
+// RoutingCfg configures sharing the station connection with the clients
+// of the access point, which stays up while the station is connected.
+type RoutingCfg struct {
+	Enabled  bool   `json:"enabled"`
+	Firewall string `json:"firewall,omitempty"` // nftables or iptables, nftables when nft is installed
+}
+
+// RestartPolicy controls how a daemon is restarted when it exits.
+type RestartPolicy struct {
+	Restart    string `json:"restart"`     // always, on-failure or never
+	MinBackoff string `json:"min_backoff"` // 1s
+	MaxBackoff string `json:"max_backoff"` // 1m
 }
 
 // DnsmasqCfg configures dnsmasq and is used by SetupCfg.
 type DnsmasqCfg struct {
-	Address     string `json:"address"`      // --address=/#/192.168.27.1",
-	DhcpRange   string `json:"dhcp_range"`   // "--dhcp-range=192.168.27.100,192.168.27.150,1h",
-	VendorClass string `json:"vendor_class"` // "--dhcp-vendorclass=set:device,IoT",
+	Address     string `json:"address"`      // address=/#/192.168.27.1, answers every name
+	DhcpRange   string `json:"dhcp_range"`   // dhcp-range=192.168.27.100,192.168.27.150,1h
+	VendorClass string `json:"vendor_class"` // dhcp-vendorclass=set:device,IoT
+
+	LeaseFile string `json:"lease_file,omitempty"` // dhcp-leasefile=/var/lib/misc/dnsmasq.leases
+	CfgFile   string `json:"cfg_file,omitempty"`   // /etc/txwifi/dnsmasq.conf, generated
+
+	// Hosts reserves addresses for known stations.
+	Hosts []DhcpHost `json:"hosts,omitempty"`
+
+	// DHCP options, Router is none to advertise no gateway.
+	Router     string   `json:"router,omitempty"`       // dhcp-option=option:router,192.168.27.1
+	DnsServers []string `json:"dns_servers,omitempty"`  // dhcp-option=option:dns-server,192.168.27.1
+	LeaseTime  string   `json:"lease_time,omitempty"`   // 12h, unless dhcp_range has one
+	Options    []string `json:"dhcp_options,omitempty"` // dhcp-option=option:ntp-server,192.168.27.1
+
+	// DNS is only served when one of these or Address is set, or in the
+	// CLIENT state of the routing mode. Servers are reached through the
+	// station uplink, so they are only written then; without them the
+	// name servers of the station are used.
+	Addresses []string    `json:"addresses,omitempty"` // address=/setup.example.com/192.168.27.1
+	Records   []DnsRecord `json:"records,omitempty"`   // host-record=setup.local,192.168.27.1
+	Servers   []string    `json:"servers,omitempty"`   // server=1.1.1.1 or server=/corp/10.0.0.1
+
+	Extra []string `json:"extra,omitempty"` // raw dnsmasq.conf lines
+}
+
+// DnsRecord is a local DNS name answered by dnsmasq.
+type DnsRecord struct {
+	Name string `json:"name"` // setup.local
+	Ip   string `json:"ip"`   // 192.168.27.1
+}
+
+// DhcpHost is a static DHCP reservation, a dnsmasq --dhcp-host.
+type DhcpHost struct {
+	Mac      string `json:"mac"`                // b8:27:eb:12:34:56
+	Ip       string `json:"ip"`                 // 192.168.27.20, in the access point subnet
+	Hostname string `json:"hostname,omitempty"` // sensor-1
+	Lease    string `json:"lease,omitempty"`    // 12h or infinite, the dhcp_range lease when empty
 }
 
 // HostApdCfg configures hostapd and is used by SetupCfg.
@@ -22,9 +95,38 @@ type HostApdCfg struct {
 	WpaPassphrase string `json:"wpa_passphrase"` // wpa_passphrase=iotwifipass
 	Channel       string `json:"channel"`        //  channel=6
 	Ip            string `json:"ip"`             // 192.168.27.1
+	CfgFile       string `json:"cfg_file"`       // /etc/hostapd/hostapd.conf
+	CtrlInterface string `json:"ctrl_interface"` // /var/run/hostapd
+
+	// Security defaults to wpa2 with a passphrase and open without.
+	Security string `json:"security,omitempty"` // wpa2, wpa3, wpa2-wpa3, owe or open
+	Pmf      string `json:"pmf,omitempty"`      // ieee80211w: disabled, optional or required
+
+	Band        string `json:"band,omitempty"`         // 2.4GHz (hw_mode=g) or 5GHz (hw_mode=a)
+	CountryCode string `json:"country_code,omitempty"` // country_code=DE with ieee80211d=1
+
+	Ieee80211n        bool   `json:"ieee80211n,omitempty"`                   // ieee80211n=1
+	HtCapab           string `json:"ht_capab,omitempty"`                     // ht_capab=[HT40+][SHORT-GI-20]
+	Ieee80211ac       bool   `json:"ieee80211ac,omitempty"`                  // ieee80211ac=1, 5GHz only
+	VhtCapab          string `json:"vht_capab,omitempty"`                    // vht_capab=[SHORT-GI-80]
+	VhtOperChwidth    int    `json:"vht_oper_chwidth,omitempty"`             // 1 for 80MHz
+	VhtCenterFreqSeg0 int    `json:"vht_oper_centr_freq_seg0_idx,omitempty"` // 42, derived for 80MHz
+
+	Hidden         bool `json:"hidden,omitempty"`      // ignore_broadcast_ssid=1
+	MaxStations    int  `json:"max_num_sta,omitempty"` // max_num_sta=10
+	BeaconInterval int  `json:"beacon_int,omitempty"`  // beacon_int=100, in TUs
+	ApIsolate      bool `json:"ap_isolate,omitempty"`  // ap_isolate=1, stations can't reach each other
+
+	// MacAcl defaults to deny, admitting every station but those in
+	// DenyMacFile; accept admits only the stations in AcceptMacFile.
+	MacAcl        string `json:"mac_acl,omitempty"`         // macaddr_acl: deny (0) or accept (1)
+	DenyMacFile   string `json:"deny_mac_file,omitempty"`   // /var/lib/txwifi/hostapd.deny
+	AcceptMacFile string `json:"accept_mac_file,omitempty"` // /var/lib/txwifi/hostapd.accept
 }
 
 // WpaSupplicantCfg configures wpa_supplicant and is used by SetupCfg
 type WpaSupplicantCfg struct {
-	CfgFile string `json:"cfg_file"` // /etc/wpa_supplicant/wpa_supplicant.conf
+	CfgFile       string `json:"cfg_file"`       // /etc/wpa_supplicant/wpa_supplicant.conf
+	CtrlInterface string `json:"ctrl_interface"` // /var/run/wpa_supplicant
+	CertDir       string `json:"cert_dir"`       // /var/lib/txwifi/certs
 }
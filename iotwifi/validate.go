@@ -0,0 +1,779 @@
+package iotwifi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ValidationError is a problem with a single configuration field.
+type ValidationError struct {
+	Field   string `json:"field"` // e.g. host_apd_cfg.wpa_passphrase
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors is every problem found in a configuration.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	return "invalid configuration: " + e.list()
+}
+
+func (e ValidationErrors) list() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// CredentialsErrors is every problem found in WpaCredentials. It
+// unwraps to the ValidationErrors.
+type CredentialsErrors struct {
+	ValidationErrors
+}
+
+func (e CredentialsErrors) Error() string {
+	return "invalid credentials: " + e.list()
+}
+
+func (e CredentialsErrors) Unwrap() error {
+	return e.ValidationErrors
+}
+
+// validator collects validation errors.
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) add(field string, format string, args ...interface{}) {
+	v.errs = append(v.errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// credentialsErr is err for WpaCredentials.
+func (v *validator) credentialsErr() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return CredentialsErrors{v.errs}
+}
+
+// Validate checks the configuration and returns ValidationErrors listing
+// every problem found, or nil. Paths are checked for form only, so a
+// configuration can be validated on another machine than the device.
+func (s *SetupCfg) Validate() error {
+	v := &validator{}
+
+	s.HostApdCfg.validate(v)
+	s.DnsmasqCfg.validate(v)
+	s.WpaSupplicantCfg.validate(v)
+	s.Interfaces.validate(v)
+	validateRestartPolicies(v, s.RestartPolicies)
+	if f := s.Routing.Firewall; f != "" && f != FirewallNftables && f != FirewallIptables {
+		v.add("routing.firewall", "%q is not %s or %s", f, FirewallNftables, FirewallIptables)
+	}
+	validateApSubnet(v, s.HostApdCfg, s.DnsmasqCfg)
+
+	return v.err()
+}
+
+// Validate checks the hostapd configuration.
+func (c HostApdCfg) Validate() error {
+	v := &validator{}
+	c.validate(v)
+	return v.err()
+}
+
+// Validate checks the dnsmasq configuration.
+func (c DnsmasqCfg) Validate() error {
+	v := &validator{}
+	c.validate(v)
+	return v.err()
+}
+
+// Validate checks the wpa_supplicant configuration.
+func (c WpaSupplicantCfg) Validate() error {
+	v := &validator{}
+	c.validate(v)
+	return v.err()
+}
+
+var hexKey = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+func (c HostApdCfg) validate(v *validator) {
+	// templates are checked with a sample device, the device checks
+	// its own result again, see Expand
+	if _, err := c.Expand(sampleDevice); err != nil {
+		var errs ValidationErrors
+		if errors.As(err, &errs) {
+			v.errs = append(v.errs, errs...)
+		} else {
+			v.add("host_apd_cfg", "%s", err)
+		}
+	}
+
+	if !isTemplate(c.Ssid) {
+		validateSsid(v, "host_apd_cfg.ssid", c.Ssid)
+	}
+
+	if p := c.WpaPassphrase; p != "" && !isTemplate(p) {
+		validatePassphrase(v, "host_apd_cfg.wpa_passphrase", p)
+	}
+
+	validateSecurity(v, securityFields{"host_apd_cfg.security", "host_apd_cfg.wpa_passphrase", "host_apd_cfg.pmf"},
+		c.Security, c.WpaPassphrase, c.Pmf)
+	c.validateRadio(v)
+
+	if _, _, err := parseApIp(c.Ip); err != nil {
+		v.add("host_apd_cfg.ip", "%s", err)
+	}
+
+	validatePath(v, "host_apd_cfg.cfg_file", c.CfgFile, false)
+	validatePath(v, "host_apd_cfg.ctrl_interface", c.CtrlInterface, false)
+
+	if c.MacAcl != "" && c.MacAcl != MacAclDeny && c.MacAcl != MacAclAccept {
+		v.add("host_apd_cfg.mac_acl", "%q is not %s or %s", c.MacAcl, MacAclDeny, MacAclAccept)
+	}
+	validatePath(v, "host_apd_cfg.deny_mac_file", c.DenyMacFile, false)
+	validatePath(v, "host_apd_cfg.accept_mac_file", c.AcceptMacFile, false)
+}
+
+// securityFields names the settings checked by validateSecurity.
+type securityFields struct {
+	security   string
+	passphrase string
+	pmf        string
+}
+
+// validateSecurity checks a security mode against its passphrase and
+// protected management frame setting, as given, with the defaults of
+// securityMode and pmfMode.
+func validateSecurity(v *validator, f securityFields, security string, passphrase string, pmf string) {
+	mode := securityMode(security, passphrase)
+	switch mode {
+	case SecurityOpen, SecurityOwe:
+		if passphrase != "" {
+			v.add(f.passphrase, "must be empty for security %s", mode)
+		}
+	case SecurityWpa2:
+		if passphrase == "" {
+			v.add(f.passphrase, "is required for security %s", mode)
+		}
+	case SecurityWpa3, SecurityTransition:
+		if passphrase == "" {
+			v.add(f.passphrase, "is required for security %s", mode)
+		} else if hexKey.MatchString(passphrase) {
+			v.add(f.passphrase, "a 64 digit hex key can't be used with WPA3-SAE")
+		}
+	default:
+		v.add(f.security, "%q is not %s, %s, %s, %s or %s", security,
+			SecurityWpa2, SecurityWpa3, SecurityTransition, SecurityOwe, SecurityOpen)
+		return
+	}
+
+	switch p := pmfMode(pmf, mode); {
+	case p != PmfDisabled && p != PmfOptional && p != PmfRequired:
+		v.add(f.pmf, "%q is not %s, %s or %s", pmf, PmfDisabled, PmfOptional, PmfRequired)
+	case mode == SecurityOpen && p != PmfDisabled:
+		v.add(f.pmf, "requires encryption, security is %s", mode)
+	case (mode == SecurityWpa3 || mode == SecurityOwe) && p != PmfRequired:
+		v.add(f.pmf, "must be %s for security %s", PmfRequired, mode)
+	case mode == SecurityTransition && p == PmfDisabled:
+		v.add(f.pmf, "must be %s or %s for security %s", PmfOptional, PmfRequired, mode)
+	}
+}
+
+// Validate checks the credentials before they are given to
+// wpa_supplicant.
+func (c WpaCredentials) Validate() error {
+	v := &validator{}
+
+	validateSsid(v, "ssid", c.Ssid)
+
+	switch mode := c.keyMgmt(); mode {
+	case KeyMgmtWpa2Eap, KeyMgmtWpa3Eap:
+		if c.Psk != "" {
+			v.add("psk", "must be empty for key_mgmt %s", mode)
+		}
+		if c.Eap == nil {
+			v.add("eap", "is required for key_mgmt %s", mode)
+		} else {
+			c.Eap.validate(v)
+		}
+		switch pmf := pmfMode(c.Pmf, mode); {
+		case pmf != PmfDisabled && pmf != PmfOptional && pmf != PmfRequired:
+			v.add("pmf", "%q is not %s, %s or %s", c.Pmf, PmfDisabled, PmfOptional, PmfRequired)
+		case mode == KeyMgmtWpa3Eap && pmf != PmfRequired:
+			v.add("pmf", "must be %s for key_mgmt %s", PmfRequired, mode)
+		}
+	default:
+		if c.Eap != nil {
+			v.add("eap", "requires key_mgmt %s or %s", KeyMgmtWpa2Eap, KeyMgmtWpa3Eap)
+		}
+		validateSecurity(v, securityFields{"key_mgmt", "psk", "pmf"}, c.KeyMgmt, c.Psk, c.Pmf)
+		if c.Psk != "" && (mode == SecurityWpa2 || mode == SecurityTransition) {
+			validatePassphrase(v, "psk", c.Psk)
+		}
+	}
+
+	if c.Bssid != "" {
+		if hw, err := net.ParseMAC(c.Bssid); err != nil || len(hw) != 6 {
+			v.add("bssid", "%q is not a MAC address", c.Bssid)
+		}
+	}
+
+	return v.credentialsErr()
+}
+
+var phase2Methods = map[string]bool{"MSCHAPV2": true, "MSCHAP": true, "PAP": true, "CHAP": true, "GTC": true}
+
+func (c EapCredentials) validate(v *validator) {
+	method := strings.ToUpper(c.Method)
+	switch method {
+	case EapPeap, EapTtls:
+		if c.Password == "" {
+			v.add("eap.password", "is required for %s", method)
+		}
+		if c.Phase2 != "" && !phase2Methods[strings.ToUpper(c.Phase2)] {
+			v.add("eap.phase2", "%q is not MSCHAPV2, MSCHAP, PAP, CHAP or GTC", c.Phase2)
+		}
+	case EapTls:
+		if c.PrivateKey == "" {
+			v.add("eap.private_key", "is required for %s", method)
+		}
+		if c.Phase2 != "" {
+			v.add("eap.phase2", "only applies to %s and %s", EapPeap, EapTtls)
+		}
+	default:
+		v.add("eap.method", "%q is not %s, %s or %s", c.Method, EapPeap, EapTtls, EapTls)
+	}
+
+	if c.Identity == "" {
+		v.add("eap.identity", "is required")
+	}
+
+	// the server must be verified, or the password goes to anyone
+	// pretending to be the network
+	if c.CaCert == "" {
+		v.add("eap.ca_cert", "is required to verify the server")
+	}
+	for _, f := range []struct{ field, name string }{
+		{"eap.ca_cert", c.CaCert},
+		{"eap.client_cert", c.ClientCert},
+		{"eap.private_key", c.PrivateKey},
+	} {
+		if f.name != "" && !certName.MatchString(f.name) {
+			v.add(f.field, "%q is not a certificate name", f.name)
+		}
+	}
+}
+
+var (
+	countryCode = regexp.MustCompile(`^[A-Z]{2}$`)
+	capabFlags  = regexp.MustCompile(`^(\[[A-Z0-9+_-]+\])+$`)
+)
+
+// validateRadio checks the band, channel and 802.11n/ac settings and
+// that they can be combined.
+func (c HostApdCfg) validateRadio(v *validator) {
+	band := c.band()
+	if band != Band2GHz && band != Band5GHz {
+		v.add("host_apd_cfg.band", "%q is not %s or %s", c.Band, Band2GHz, Band5GHz)
+		return
+	}
+
+	ch := c.channel()
+	switch {
+	case !isChannel(band, ch) && band == Band2GHz:
+		v.add("host_apd_cfg.channel", "%q is not a 2.4GHz channel (1-14)", c.Channel)
+	case !isChannel(band, ch):
+		v.add("host_apd_cfg.channel", "%q is not a 5GHz channel", c.Channel)
+	case ch == 14 && (c.Ieee80211n || c.Ieee80211ac):
+		v.add("host_apd_cfg.channel", "14 only supports 802.11b, not 802.11n")
+	}
+
+	if c.CountryCode != "" && !countryCode.MatchString(c.CountryCode) {
+		v.add("host_apd_cfg.country_code", "%q is not a two letter ISO 3166-1 code such as DE", c.CountryCode)
+	}
+	if band == Band5GHz && c.CountryCode == "" {
+		v.add("host_apd_cfg.country_code", "is required for 5GHz")
+	}
+
+	if c.HtCapab != "" {
+		switch {
+		case !c.Ieee80211n && !c.Ieee80211ac:
+			v.add("host_apd_cfg.ht_capab", "requires ieee80211n")
+		case !capabFlags.MatchString(c.HtCapab):
+			v.add("host_apd_cfg.ht_capab", "%q is not a list of flags such as [HT40+][SHORT-GI-20]", c.HtCapab)
+		case isChannel(band, ch):
+			if strings.Contains(c.HtCapab, "[HT40+]") && !ht40Allowed(band, ch, true) {
+				v.add("host_apd_cfg.ht_capab", "[HT40+] is not possible on channel %d", ch)
+			}
+			if strings.Contains(c.HtCapab, "[HT40-]") && !ht40Allowed(band, ch, false) {
+				v.add("host_apd_cfg.ht_capab", "[HT40-] is not possible on channel %d", ch)
+			}
+		}
+	}
+
+	if c.Ieee80211ac {
+		if band != Band5GHz {
+			v.add("host_apd_cfg.ieee80211ac", "requires band %s", Band5GHz)
+		}
+		if !c.Ieee80211n {
+			v.add("host_apd_cfg.ieee80211ac", "requires ieee80211n")
+		}
+	}
+	if c.VhtCapab != "" {
+		switch {
+		case !c.Ieee80211ac:
+			v.add("host_apd_cfg.vht_capab", "requires ieee80211ac")
+		case !capabFlags.MatchString(c.VhtCapab):
+			v.add("host_apd_cfg.vht_capab", "%q is not a list of flags such as [SHORT-GI-80]", c.VhtCapab)
+		}
+	}
+	switch w := c.VhtOperChwidth; {
+	case w < 0 || w > 3:
+		v.add("host_apd_cfg.vht_oper_chwidth", "%d is not 0 (20/40MHz), 1 (80MHz), 2 (160MHz) or 3 (80+80MHz)", w)
+	case w > 0 && !c.Ieee80211ac:
+		v.add("host_apd_cfg.vht_oper_chwidth", "requires ieee80211ac")
+	case w == 1 && c.VhtCenterFreqSeg0 == 0 && isChannel(band, ch) && vhtCenter80(ch) == 0:
+		v.add("host_apd_cfg.vht_oper_chwidth", "channel %d has no 80MHz channel", ch)
+	case w > 1 && c.VhtCenterFreqSeg0 == 0:
+		v.add("host_apd_cfg.vht_oper_centr_freq_seg0_idx", "is required for vht_oper_chwidth %d", w)
+	}
+	if c.VhtCenterFreqSeg0 != 0 && c.VhtOperChwidth == 0 {
+		v.add("host_apd_cfg.vht_oper_centr_freq_seg0_idx", "requires vht_oper_chwidth")
+	}
+
+	// 0 leaves the limit to hostapd
+	if n := c.MaxStations; n != 0 && (n < 1 || n > 2007) {
+		v.add("host_apd_cfg.max_num_sta", "%d is not between 1 and 2007", n)
+	}
+	if b := c.BeaconInterval; b != 0 && (b < 15 || b > 65535) {
+		v.add("host_apd_cfg.beacon_int", "%d is not between 15 and 65535", b)
+	}
+}
+
+// validateSsid checks an SSID: 1 to 32 bytes of printable UTF-8. Control
+// characters would end the line the SSID is written on in hostapd.conf
+// or wpa_supplicant.conf.
+func validateSsid(v *validator, field string, ssid string) {
+	switch n := len(ssid); {
+	case n == 0:
+		v.add(field, "is required")
+	case n > 32:
+		v.add(field, "is %d bytes, at most 32 are allowed", n)
+	}
+
+	if !utf8.ValidString(ssid) {
+		v.add(field, "must be UTF-8 text")
+		return
+	}
+	for _, r := range ssid {
+		if !unicode.IsPrint(r) {
+			v.add(field, "must be printable, %q is not", r)
+			return
+		}
+	}
+}
+
+// validatePassphrase checks a WPA passphrase: 8 to 63 printable ASCII
+// characters, or a 64 digit hex key.
+func validatePassphrase(v *validator, field string, p string) {
+	if hexKey.MatchString(p) {
+		return
+	}
+	if len(p) < 8 || len(p) > 63 {
+		v.add(field, "must be 8 to 63 characters, is %d", len(p))
+	}
+	for _, r := range p {
+		if r < 32 || r > 126 {
+			v.add(field, "must be printable ASCII")
+			break
+		}
+	}
+}
+
+func (c DnsmasqCfg) validate(v *validator) {
+	if _, err := parseDhcpRange(c.DhcpRange); err != nil {
+		v.add("dnsmasq_cfg.dhcp_range", "%s", err)
+	}
+
+	if c.Address != "" {
+		validateAddress(v, "dnsmasq_cfg.address", c.Address)
+	}
+	for i, addr := range c.Addresses {
+		validateAddress(v, fmt.Sprintf("dnsmasq_cfg.addresses[%d]", i), addr)
+	}
+	for i, rec := range c.Records {
+		field := fmt.Sprintf("dnsmasq_cfg.records[%d]", i)
+		if !validDomain(rec.Name) {
+			v.add(field+".name", "%q is not a domain name", rec.Name)
+		}
+		if net.ParseIP(rec.Ip) == nil {
+			v.add(field+".ip", "%q is not an IP address", rec.Ip)
+		}
+	}
+	for i, server := range c.Servers {
+		validateServer(v, fmt.Sprintf("dnsmasq_cfg.servers[%d]", i), server)
+	}
+
+	if c.Router != "" && c.Router != RouterNone && net.ParseIP(c.Router).To4() == nil {
+		v.add("dnsmasq_cfg.router", "%q is not an IPv4 address or %s", c.Router, RouterNone)
+	}
+	for i, ip := range c.DnsServers {
+		if net.ParseIP(ip).To4() == nil {
+			v.add(fmt.Sprintf("dnsmasq_cfg.dns_servers[%d]", i), "%q is not an IPv4 address", ip)
+		}
+	}
+	if c.LeaseTime != "" {
+		if !validLease(c.LeaseTime) {
+			v.add("dnsmasq_cfg.lease_time", "lease time %q is not valid, use e.g. 1h, 30m or infinite", c.LeaseTime)
+		} else if r, err := parseDhcpRange(c.DhcpRange); err == nil && r.Lease != "" {
+			v.add("dnsmasq_cfg.lease_time", "dhcp_range already has the lease time %s", r.Lease)
+		}
+	}
+	for i, opt := range c.Options {
+		validateLine(v, fmt.Sprintf("dnsmasq_cfg.dhcp_options[%d]", i), opt)
+	}
+	for i, line := range c.Extra {
+		validateLine(v, fmt.Sprintf("dnsmasq_cfg.extra[%d]", i), line)
+	}
+
+	validatePath(v, "dnsmasq_cfg.lease_file", c.LeaseFile, false)
+	validatePath(v, "dnsmasq_cfg.cfg_file", c.CfgFile, false)
+
+	macs := make(map[string]bool)
+	ips := make(map[string]bool)
+	for i, h := range c.Hosts {
+		field := fmt.Sprintf("dnsmasq_cfg.hosts[%d]", i)
+
+		if mac, err := parseMac(h.Mac); err != nil {
+			v.add(field+".mac", "%q is not a MAC address", h.Mac)
+		} else if macs[mac] {
+			v.add(field+".mac", "%s is reserved more than once", mac)
+		} else {
+			macs[mac] = true
+		}
+
+		if ip := net.ParseIP(h.Ip).To4(); ip == nil {
+			v.add(field+".ip", "%q is not an IPv4 address", h.Ip)
+		} else if ips[ip.String()] {
+			v.add(field+".ip", "%s is reserved more than once", ip)
+		} else {
+			ips[ip.String()] = true
+		}
+
+		if h.Hostname != "" && !validHostname(h.Hostname) {
+			v.add(field+".hostname", "%q is not a host name", h.Hostname)
+		}
+		if h.Lease != "" && !validLease(h.Lease) {
+			v.add(field+".lease", "lease time %q is not valid, use e.g. 1h, 30m or infinite", h.Lease)
+		}
+	}
+}
+
+// validateAddress checks a dnsmasq address of the form /domain/.../ip.
+func validateAddress(v *validator, field string, addr string) {
+	parts := strings.Split(addr, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		v.add(field, "%q is not of the form /domain/ip", addr)
+	} else if ip := parts[len(parts)-1]; ip != "" && net.ParseIP(ip) == nil {
+		v.add(field, "%q is not an IP address", ip)
+	}
+}
+
+// validateServer checks a dnsmasq upstream server, an IP address with
+// an optional #port, for some domains only as in /domain/.../ip.
+func validateServer(v *validator, field string, server string) {
+	ip := server
+	if strings.HasPrefix(server, "/") {
+		parts := strings.Split(server, "/")
+		if len(parts) < 3 {
+			v.add(field, "%q is not of the form ip or /domain/ip", server)
+			return
+		}
+		ip = parts[len(parts)-1]
+	}
+	if i := strings.LastIndex(ip, "#"); i >= 0 {
+		if port, err := strconv.Atoi(ip[i+1:]); err != nil || port < 1 || port > 65535 {
+			v.add(field, "%q is not a port", ip[i+1:])
+			return
+		}
+		ip = ip[:i]
+	}
+	if net.ParseIP(ip) == nil {
+		v.add(field, "%q is not an IP address", ip)
+	}
+}
+
+// validateLine checks a raw dnsmasq.conf line.
+func validateLine(v *validator, field string, line string) {
+	if strings.TrimSpace(line) == "" {
+		v.add(field, "is empty")
+	} else if strings.ContainsAny(line, "\r\n") {
+		v.add(field, "must be a single line")
+	}
+}
+
+// validDomain reports whether s is a domain name such as setup.local.
+func validDomain(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if !dnsLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+var dnsLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// validHostname reports whether s is a single DNS label, which dnsmasq
+// takes for a lease time when it is just a number.
+func validHostname(s string) bool {
+	_, err := strconv.Atoi(s)
+	return dnsLabel.MatchString(s) && err != nil
+}
+
+func (c WpaSupplicantCfg) validate(v *validator) {
+	validatePath(v, "wpa_supplicant_cfg.cfg_file", c.CfgFile, true)
+	validatePath(v, "wpa_supplicant_cfg.ctrl_interface", c.CtrlInterface, false)
+	validatePath(v, "wpa_supplicant_cfg.cert_dir", c.CertDir, false)
+}
+
+var ifaceName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+func (c InterfaceCfg) validate(v *validator) {
+	for _, f := range []struct{ field, name string }{
+		{"interfaces.phy", c.Phy},
+		{"interfaces.station", c.Station},
+		{"interfaces.ap", c.Ap},
+	} {
+		if f.name != "" && !ifaceName.MatchString(f.name) {
+			v.add(f.field, "%q is not a valid interface name", f.name)
+		}
+	}
+	if c.Station != "" && c.Station == c.Ap {
+		v.add("interfaces.ap", "must differ from the station interface %s", c.Station)
+	}
+}
+
+func validateRestartPolicies(v *validator, policies map[string]RestartPolicy) {
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := policies[name]
+		field := "restart_policies." + name
+		switch name {
+		case "hostapd", "dnsmasq", "wpa_supplicant":
+		default:
+			v.add(field, "unknown daemon, expected hostapd, dnsmasq or wpa_supplicant")
+		}
+
+		switch p.Restart {
+		case "", RestartAlways, RestartOnFailure, RestartNever:
+		default:
+			v.add(field+".restart", "%q is not one of always, on-failure or never", p.Restart)
+		}
+
+		var min, max time.Duration
+		for _, b := range []struct {
+			field string
+			value string
+			d     *time.Duration
+		}{
+			{field + ".min_backoff", p.MinBackoff, &min},
+			{field + ".max_backoff", p.MaxBackoff, &max},
+		} {
+			if b.value == "" {
+				continue
+			}
+			d, err := time.ParseDuration(b.value)
+			if err != nil || d <= 0 {
+				v.add(b.field, "%q is not a positive duration like 1s or 2m", b.value)
+				continue
+			}
+			*b.d = d
+		}
+		if min > 0 && max > 0 && min > max {
+			v.add(field+".max_backoff", "is shorter than min_backoff")
+		}
+	}
+}
+
+// validateApSubnet checks that the DHCP range and reservations lie in the
+// subnet of the access point address and do not contain the address
+// itself.
+func validateApSubnet(v *validator, apd HostApdCfg, dnsmasq DnsmasqCfg) {
+	ip, ipNet, err := apNetwork(apd, dnsmasq)
+	if err != nil {
+		return
+	}
+	r, err := parseDhcpRange(dnsmasq.DhcpRange)
+	if err != nil {
+		return
+	}
+
+	if !ipNet.Contains(r.Start) || !ipNet.Contains(r.End) {
+		v.add("dnsmasq_cfg.dhcp_range", "%s-%s is outside the access point subnet %s", r.Start, r.End, ipNet)
+	}
+	if ipInRange(ip, r.Start, r.End) {
+		v.add("dnsmasq_cfg.dhcp_range", "contains the access point address %s", ip)
+	}
+
+	// dnsmasq only hands out reserved addresses of a dhcp_range subnet
+	for i, h := range dnsmasq.Hosts {
+		hostIp := net.ParseIP(h.Ip).To4()
+		switch {
+		case hostIp == nil:
+		case hostIp.Equal(ip):
+			v.add(fmt.Sprintf("dnsmasq_cfg.hosts[%d].ip", i), "is the access point address")
+		case !ipNet.Contains(hostIp):
+			v.add(fmt.Sprintf("dnsmasq_cfg.hosts[%d].ip", i), "%s is outside the access point subnet %s", hostIp, ipNet)
+		}
+	}
+}
+
+// apNetwork returns the access point address and subnet, from its
+// prefix length or else the netmask of the DHCP range, /24 by default.
+func apNetwork(apd HostApdCfg, dnsmasq DnsmasqCfg) (net.IP, *net.IPNet, error) {
+	ip, ipNet, err := parseApIp(apd.Ip)
+	if err != nil || ipNet != nil {
+		return ip, ipNet, err
+	}
+
+	mask := net.CIDRMask(24, 32)
+	if r, err := parseDhcpRange(dnsmasq.DhcpRange); err == nil && r.Mask != nil {
+		mask = r.Mask
+	}
+	return ip, &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// parseApIp parses the access point address, an IPv4 address with an
+// optional prefix length as in 192.168.27.1/24.
+func parseApIp(s string) (net.IP, *net.IPNet, error) {
+	if s == "" {
+		return nil, nil, fmt.Errorf("is required")
+	}
+	if strings.Contains(s, "/") {
+		ip, ipNet, err := net.ParseCIDR(s)
+		if err != nil || ip.To4() == nil {
+			return nil, nil, fmt.Errorf("%q is not an IPv4 address or CIDR", s)
+		}
+		return ip.To4(), ipNet, nil
+	}
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, nil, fmt.Errorf("%q is not an IPv4 address", s)
+	}
+	return ip, nil, nil
+}
+
+// dhcpRange is a parsed dnsmasq --dhcp-range.
+type dhcpRange struct {
+	Start net.IP
+	End   net.IP
+	Mask  net.IPMask
+	Lease string
+}
+
+// parseDhcpRange parses start,end[,netmask][,lease], ignoring leading
+// set: and tag: fields.
+func parseDhcpRange(s string) (dhcpRange, error) {
+	var r dhcpRange
+	if s == "" {
+		return r, fmt.Errorf("is required")
+	}
+
+	fields := strings.Split(s, ",")
+	for len(fields) > 0 && (strings.HasPrefix(fields[0], "set:") || strings.HasPrefix(fields[0], "tag:")) {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return r, fmt.Errorf("%q is not of the form start,end[,netmask][,lease]", s)
+	}
+
+	r.Start = net.ParseIP(fields[0]).To4()
+	r.End = net.ParseIP(fields[1]).To4()
+	if r.Start == nil || r.End == nil {
+		return r, fmt.Errorf("%q does not start with two IPv4 addresses", s)
+	}
+	if bytes.Compare(r.Start, r.End) > 0 {
+		return r, fmt.Errorf("start %s is after end %s", r.Start, r.End)
+	}
+
+	rest := fields[2:]
+	if len(rest) > 0 {
+		if mask := net.ParseIP(rest[0]).To4(); mask != nil {
+			r.Mask = net.IPMask(mask)
+			if ones, bits := r.Mask.Size(); ones == 0 && bits == 0 {
+				return r, fmt.Errorf("netmask %s is not valid", rest[0])
+			}
+			rest = rest[1:]
+		}
+	}
+	if len(rest) > 0 {
+		r.Lease = rest[0]
+		if !validLease(r.Lease) {
+			return r, fmt.Errorf("lease time %q is not valid, use e.g. 1h, 30m or infinite", r.Lease)
+		}
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		return r, fmt.Errorf("%q has unexpected fields %s", s, strings.Join(rest, ","))
+	}
+
+	return r, nil
+}
+
+var leaseTime = regexp.MustCompile(`^[0-9]+[smhdw]?$`)
+
+func validLease(s string) bool {
+	return s == "infinite" || leaseTime.MatchString(s)
+}
+
+func ipInRange(ip net.IP, start net.IP, end net.IP) bool {
+	n := binary.BigEndian.Uint32(ip.To4())
+	return n >= binary.BigEndian.Uint32(start) && n <= binary.BigEndian.Uint32(end)
+}
+
+// validatePath checks that a path is absolute.
+func validatePath(v *validator, field string, path string, required bool) {
+	if path == "" {
+		if required {
+			v.add(field, "is required")
+		}
+		return
+	}
+	if !filepath.IsAbs(path) {
+		v.add(field, "%q is not an absolute path", path)
+	}
+}
@@ -0,0 +1,213 @@
+package iotwifi
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func validCfg() *SetupCfg {
+	return &SetupCfg{
+		DnsmasqCfg: DnsmasqCfg{
+			Address:     "/#/192.168.27.1",
+			DhcpRange:   "192.168.27.100,192.168.27.150,1h",
+			VendorClass: "set:device,IoT",
+		},
+		HostApdCfg: HostApdCfg{
+			Ip:            "192.168.27.1",
+			Ssid:          "iot-wifi",
+			WpaPassphrase: "iotwifipass",
+			Channel:       "6",
+		},
+		WpaSupplicantCfg: WpaSupplicantCfg{
+			CfgFile: "/etc/wpa_supplicant/wpa_supplicant.conf",
+		},
+	}
+}
+
+// fields returns the fields of the validation errors in err.
+func fields(t *testing.T, err error) []string {
+	if err == nil {
+		return nil
+	}
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ValidationErrors, got %T: %s", err, err)
+	}
+	out := make([]string, len(errs))
+	for i, e := range errs {
+		out[i] = e.Field
+	}
+	return out
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*SetupCfg)
+		want   []string
+	}{
+		{"valid", func(c *SetupCfg) {}, nil},
+		{"open ap", func(c *SetupCfg) { c.HostApdCfg.WpaPassphrase = "" }, nil},
+		{"hex psk", func(c *SetupCfg) { c.HostApdCfg.WpaPassphrase = strings.Repeat("ab", 32) }, nil},
+		{"cidr ip", func(c *SetupCfg) {
+			c.HostApdCfg.Ip = "10.0.0.1/16"
+			c.DnsmasqCfg.DhcpRange = "10.0.1.10,10.0.2.200,12h"
+		}, nil},
+		{"netmask", func(c *SetupCfg) {
+			c.HostApdCfg.Ip = "10.0.0.1"
+			c.DnsmasqCfg.DhcpRange = "set:ap,10.0.1.10,10.0.2.200,255.255.0.0,infinite"
+		}, nil},
+		{"short passphrase", func(c *SetupCfg) { c.HostApdCfg.WpaPassphrase = "12345" }, []string{"host_apd_cfg.wpa_passphrase"}},
+		{"long ssid", func(c *SetupCfg) { c.HostApdCfg.Ssid = strings.Repeat("x", 33) }, []string{"host_apd_cfg.ssid"}},
+		{"ssid with a newline", func(c *SetupCfg) { c.HostApdCfg.Ssid = "iot\nwpa=0" }, []string{"host_apd_cfg.ssid"}},
+		{"ssid not UTF-8", func(c *SetupCfg) { c.HostApdCfg.Ssid = "iot\xff" }, []string{"host_apd_cfg.ssid"}},
+		{"ssid in UTF-8", func(c *SetupCfg) { c.HostApdCfg.Ssid = `Café "Ünter" 42` }, nil},
+		{"templates", func(c *SetupCfg) {
+			c.HostApdCfg.Ssid = "iot-{{.MacSuffix}}"
+			c.HostApdCfg.WpaPassphrase = `{{passphrase "s3cret"}}`
+		}, nil},
+		{"bad template", func(c *SetupCfg) { c.HostApdCfg.Ssid = "iot-{{.Mac" }, []string{"host_apd_cfg.ssid"}},
+		{"bad channel", func(c *SetupCfg) { c.HostApdCfg.Channel = "36" }, []string{"host_apd_cfg.channel"}},
+		{"5GHz", func(c *SetupCfg) {
+			c.HostApdCfg.Band, c.HostApdCfg.Channel, c.HostApdCfg.CountryCode = Band5GHz, "36", "DE"
+			c.HostApdCfg.Ieee80211n, c.HostApdCfg.Ieee80211ac, c.HostApdCfg.VhtOperChwidth = true, true, 1
+		}, nil},
+		{"5GHz channel on 2.4GHz", func(c *SetupCfg) { c.HostApdCfg.Channel = "36" }, []string{"host_apd_cfg.channel"}},
+		{"5GHz without country", func(c *SetupCfg) { c.HostApdCfg.Band = Band5GHz; c.HostApdCfg.Channel = "36" }, []string{"host_apd_cfg.country_code"}},
+		{"bad band", func(c *SetupCfg) { c.HostApdCfg.Band = "60GHz" }, []string{"host_apd_cfg.band"}},
+		{"bad country", func(c *SetupCfg) { c.HostApdCfg.CountryCode = "germany" }, []string{"host_apd_cfg.country_code"}},
+		{"802.11ac on 2.4GHz", func(c *SetupCfg) { c.HostApdCfg.Ieee80211ac = true }, []string{"host_apd_cfg.ieee80211ac", "host_apd_cfg.ieee80211ac"}},
+		{"ht40 off band", func(c *SetupCfg) {
+			c.HostApdCfg.Channel, c.HostApdCfg.Ieee80211n, c.HostApdCfg.HtCapab = "11", true, "[HT40+]"
+		}, []string{"host_apd_cfg.ht_capab"}},
+		{"ht_capab without n", func(c *SetupCfg) { c.HostApdCfg.HtCapab = "[HT40-]" }, []string{"host_apd_cfg.ht_capab"}},
+		{"160MHz without center", func(c *SetupCfg) {
+			c.HostApdCfg.Band, c.HostApdCfg.Channel, c.HostApdCfg.CountryCode = Band5GHz, "36", "DE"
+			c.HostApdCfg.Ieee80211n, c.HostApdCfg.Ieee80211ac, c.HostApdCfg.VhtOperChwidth = true, true, 2
+		}, []string{"host_apd_cfg.vht_oper_centr_freq_seg0_idx"}},
+		{"limits", func(c *SetupCfg) { c.HostApdCfg.MaxStations, c.HostApdCfg.BeaconInterval = 3000, 5 }, []string{"host_apd_cfg.max_num_sta", "host_apd_cfg.beacon_int"}},
+		{"negative limit", func(c *SetupCfg) { c.HostApdCfg.MaxStations = -1 }, []string{"host_apd_cfg.max_num_sta"}},
+		{"no limits", func(c *SetupCfg) { c.HostApdCfg.MaxStations, c.HostApdCfg.BeaconInterval = 0, 0 }, nil},
+		{"wpa3", func(c *SetupCfg) { c.HostApdCfg.Security = SecurityWpa3 }, nil},
+		{"owe", func(c *SetupCfg) { c.HostApdCfg.Security, c.HostApdCfg.WpaPassphrase = SecurityOwe, "" }, nil},
+		{"bad security", func(c *SetupCfg) { c.HostApdCfg.Security = "wep" }, []string{"host_apd_cfg.security"}},
+		{"wpa2 without passphrase", func(c *SetupCfg) { c.HostApdCfg.Security, c.HostApdCfg.WpaPassphrase = SecurityWpa2, "" }, []string{"host_apd_cfg.wpa_passphrase"}},
+		{"owe with passphrase", func(c *SetupCfg) { c.HostApdCfg.Security = SecurityOwe }, []string{"host_apd_cfg.wpa_passphrase"}},
+		{"sae hex key", func(c *SetupCfg) {
+			c.HostApdCfg.Security, c.HostApdCfg.WpaPassphrase = SecurityTransition, strings.Repeat("ab", 32)
+		}, []string{"host_apd_cfg.wpa_passphrase"}},
+		{"wpa3 without pmf", func(c *SetupCfg) { c.HostApdCfg.Security, c.HostApdCfg.Pmf = SecurityWpa3, PmfOptional }, []string{"host_apd_cfg.pmf"}},
+		{"open with pmf", func(c *SetupCfg) { c.HostApdCfg.WpaPassphrase, c.HostApdCfg.Pmf = "", PmfRequired }, []string{"host_apd_cfg.pmf"}},
+		{"bad pmf", func(c *SetupCfg) { c.HostApdCfg.Pmf = "yes" }, []string{"host_apd_cfg.pmf"}},
+		{"empty dhcp range", func(c *SetupCfg) { c.DnsmasqCfg.DhcpRange = "" }, []string{"dnsmasq_cfg.dhcp_range"}},
+		{"reversed range", func(c *SetupCfg) { c.DnsmasqCfg.DhcpRange = "192.168.27.150,192.168.27.100" }, []string{"dnsmasq_cfg.dhcp_range"}},
+		{"bad lease", func(c *SetupCfg) { c.DnsmasqCfg.DhcpRange = "192.168.27.100,192.168.27.150,soon" }, []string{"dnsmasq_cfg.dhcp_range"}},
+		{"other subnet", func(c *SetupCfg) { c.DnsmasqCfg.DhcpRange = "192.168.28.100,192.168.28.150,1h" }, []string{"dnsmasq_cfg.dhcp_range"}},
+		{"ap ip in range", func(c *SetupCfg) { c.HostApdCfg.Ip = "192.168.27.120" }, []string{"dnsmasq_cfg.dhcp_range"}},
+		{"bad address", func(c *SetupCfg) { c.DnsmasqCfg.Address = "/#/not-an-ip" }, []string{"dnsmasq_cfg.address"}},
+		{"dns", func(c *SetupCfg) {
+			c.DnsmasqCfg.Addresses = []string{"/setup.example.com/192.168.27.1"}
+			c.DnsmasqCfg.Records = []DnsRecord{{Name: "setup.local", Ip: "192.168.27.1"}}
+			c.DnsmasqCfg.Servers = []string{"1.1.1.1", "2606:4700::1111", "/corp/10.0.0.1#5353"}
+		}, nil},
+		{"bad dns", func(c *SetupCfg) {
+			c.DnsmasqCfg.Addresses = []string{"setup.local"}
+			c.DnsmasqCfg.Records = []DnsRecord{{Name: "setup..local", Ip: "192.168.27"}}
+			c.DnsmasqCfg.Servers = []string{"one.one.one.one", "1.1.1.1#dns"}
+		}, []string{"dnsmasq_cfg.addresses[0]", "dnsmasq_cfg.records[0].name", "dnsmasq_cfg.records[0].ip",
+			"dnsmasq_cfg.servers[0]", "dnsmasq_cfg.servers[1]"}},
+		{"dhcp options", func(c *SetupCfg) {
+			c.DnsmasqCfg.Router = RouterNone
+			c.DnsmasqCfg.DnsServers = []string{"192.168.27.1"}
+			c.DnsmasqCfg.DhcpRange = "192.168.27.100,192.168.27.150"
+			c.DnsmasqCfg.LeaseTime = "12h"
+			c.DnsmasqCfg.Options = []string{"option:ntp-server,192.168.27.1"}
+			c.DnsmasqCfg.Extra = []string{"log-dhcp"}
+		}, nil},
+		{"bad dhcp options", func(c *SetupCfg) {
+			c.DnsmasqCfg.Router = "gateway"
+			c.DnsmasqCfg.DnsServers = []string{"::1"}
+			c.DnsmasqCfg.LeaseTime = "12h"
+			c.DnsmasqCfg.Options = []string{" "}
+			c.DnsmasqCfg.Extra = []string{"log-dhcp\nconf-file=/tmp/x"}
+		}, []string{"dnsmasq_cfg.router", "dnsmasq_cfg.dns_servers[0]", "dnsmasq_cfg.lease_time",
+			"dnsmasq_cfg.dhcp_options[0]", "dnsmasq_cfg.extra[0]"}},
+		{"reservation", func(c *SetupCfg) {
+			c.DnsmasqCfg.Hosts = []DhcpHost{{Mac: "b8:27:eb:12:34:56", Ip: "192.168.27.20", Hostname: "sensor-1", Lease: "infinite"}}
+		}, nil},
+		{"bad reservation", func(c *SetupCfg) {
+			c.DnsmasqCfg.Hosts = []DhcpHost{{Mac: "b8:27:eb", Ip: "192.168.27", Hostname: "sensor_1", Lease: "soon"}}
+		}, []string{"dnsmasq_cfg.hosts[0].mac", "dnsmasq_cfg.hosts[0].ip", "dnsmasq_cfg.hosts[0].hostname", "dnsmasq_cfg.hosts[0].lease"}},
+		{"numeric hostname", func(c *SetupCfg) {
+			c.DnsmasqCfg.Hosts = []DhcpHost{{Mac: "b8:27:eb:12:34:56", Ip: "192.168.27.20", Hostname: "42"}}
+		}, []string{"dnsmasq_cfg.hosts[0].hostname"}},
+		{"duplicate reservations", func(c *SetupCfg) {
+			c.DnsmasqCfg.Hosts = []DhcpHost{{Mac: "b8:27:eb:12:34:56", Ip: "192.168.27.20"}, {Mac: "B8-27-EB-12-34-56", Ip: "192.168.27.20"}}
+		}, []string{"dnsmasq_cfg.hosts[1].mac", "dnsmasq_cfg.hosts[1].ip"}},
+		{"reservation outside subnet", func(c *SetupCfg) {
+			c.DnsmasqCfg.Hosts = []DhcpHost{{Mac: "b8:27:eb:12:34:56", Ip: "192.168.28.20"}, {Mac: "b8:27:eb:12:34:57", Ip: "192.168.27.1"}}
+		}, []string{"dnsmasq_cfg.hosts[0].ip", "dnsmasq_cfg.hosts[1].ip"}},
+		{"relative path", func(c *SetupCfg) { c.WpaSupplicantCfg.CfgFile = "wpa.conf" }, []string{"wpa_supplicant_cfg.cfg_file"}},
+		{"routing", func(c *SetupCfg) { c.Routing = RoutingCfg{Enabled: true, Firewall: FirewallNftables} }, nil},
+		{"bad firewall", func(c *SetupCfg) { c.Routing = RoutingCfg{Enabled: true, Firewall: "ufw"} }, []string{"routing.firewall"}},
+		{"same interfaces", func(c *SetupCfg) { c.Interfaces = InterfaceCfg{Station: "wlan0", Ap: "wlan0"} }, []string{"interfaces.ap"}},
+		{"restart policy", func(c *SetupCfg) {
+			c.RestartPolicies = map[string]RestartPolicy{
+				"hostapd": {Restart: "sometimes", MinBackoff: "10s", MaxBackoff: "1s"},
+				"ntpd":    {},
+			}
+		}, []string{"restart_policies.hostapd.restart", "restart_policies.hostapd.max_backoff", "restart_policies.ntpd"}},
+		{"everything at once", func(c *SetupCfg) {
+			*c = SetupCfg{}
+		}, []string{"host_apd_cfg.ssid", "host_apd_cfg.channel", "host_apd_cfg.ip", "dnsmasq_cfg.dhcp_range", "wpa_supplicant_cfg.cfg_file"}},
+	}
+
+	for _, tt := range tests {
+		cfg := validCfg()
+		tt.modify(cfg)
+		got := fields(t, cfg.Validate())
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got errors for %q, want %q (%v)", tt.name, got, tt.want, cfg.Validate())
+		}
+	}
+}
+
+func TestLoadCfg(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.json")
+	bad := filepath.Join(dir, "bad.json")
+	ioutil.WriteFile(good, []byte(`{"host_apd_cfg":{"ip":"192.168.27.1","ssid":"iot","channel":"6"},
+		"dnsmasq_cfg":{"dhcp_range":"192.168.27.100,192.168.27.150,1h"},
+		"wpa_supplicant_cfg":{"cfg_file":"/etc/wpa_supplicant/wpa_supplicant.conf"}}`), 0600)
+	ioutil.WriteFile(bad, []byte(`{"host_apd_cfg":{"ip":"192.168.27.1","ssid":"iot","channel":"6","wpa_passphrase":"short"}}`), 0600)
+
+	if _, err := LoadCfg(good); err != nil {
+		t.Errorf("expected valid config, got %s", err)
+	}
+
+	cfg, err := LoadCfg(bad)
+	if cfg == nil || cfg.HostApdCfg.Ssid != "iot" {
+		t.Errorf("expected the decoded config along with the validation errors")
+	}
+	if got := fields(t, err); len(got) != 3 {
+		t.Errorf("expected 3 problems, got %q", got)
+	}
+
+	if _, err := LoadCfg(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	if _, err := LoadCfg(srv.URL); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+}
@@ -2,9 +2,15 @@ package iotwifi
 
 import (
 	"bytes"
-	"os/exec"
-	"regexp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,21 +20,76 @@ import (
 type WpaCfg struct {
 	WpaCmd []string
 	WpaCfg *SetupCfg
+	Ctrl   *WpaCtrl
+	Certs  *CertStore // certificates of enterprise networks
+
+	scanMu sync.Mutex // one scan at a time
 }
 
-// WpaNetwork defines a wifi network to connect to.
+// ErrConnectFailed is returned when a network was configured but
+// wpa_supplicant never reached the COMPLETED state.
+var ErrConnectFailed = errors.New("unable to connect to network")
+
+// wpaStartTimeout bounds how long ConnectNetwork waits for wpa_supplicant.
+const wpaStartTimeout = 60 * time.Second
+
+var (
+	// connectTimeout bounds association and authentication.
+	connectTimeout = 30 * time.Second
+	// dhcpTimeout bounds the wait for an address once associated.
+	dhcpTimeout = 15 * time.Second
+	// connectPollInterval is how often the state is polled while connecting.
+	connectPollInterval = time.Second
+	// scanTimeout bounds the wait for scan results.
+	scanTimeout = 10 * time.Second
+	// scanStartTimeout bounds the start of a scan-only wpa_supplicant.
+	scanStartTimeout = 5 * time.Second
+)
+
+// WpaNetwork defines a wifi network to connect to, a single BSS of
+// the scan results. Ssid is empty when the SSID is hidden or not valid
+// UTF-8, SsidHex always holds the raw bytes.
 type WpaNetwork struct {
-	Bssid       string `json:"bssid"`
-	Frequency   string `json:"frequency"`
-	SignalLevel string `json:"signal_level"`
-	Flags       string `json:"flags"`
-	Ssid        string `json:"ssid"`
+	Bssid       string      `json:"bssid"`
+	Frequency   int         `json:"frequency"`    // MHz
+	SignalLevel int         `json:"signal_level"` // dBm
+	Flags       string      `json:"flags"`
+	Ssid        string      `json:"ssid"`
+	SsidHex     string      `json:"ssid_hex"`
+	Hidden      bool        `json:"hidden"`
+	Security    WpaSecurity `json:"security"`
 }
 
 // WpaCredentials defines wifi network credentials.
 type WpaCredentials struct {
-	Ssid string `json:"ssid"`
-	Psk  string `json:"psk"`
+	Ssid     string `json:"ssid"`
+	Psk      string `json:"psk"`
+	Priority int    `json:"priority,omitempty"`
+
+	// KeyMgmt defaults to wpa2-eap with Eap, wpa2 with a psk and open
+	// without either.
+	KeyMgmt string `json:"key_mgmt,omitempty"` // wpa2, wpa3, wpa2-wpa3, owe, open, wpa2-eap or wpa3-eap
+	Pmf     string `json:"pmf,omitempty"`      // ieee80211w: disabled, optional or required
+	Hidden  bool   `json:"hidden,omitempty"`   // scan_ssid=1, probe for the SSID
+	Bssid   string `json:"bssid,omitempty"`    // only connect to this access point
+
+	// Eap holds the credentials of WPA2/WPA3-Enterprise networks.
+	Eap *EapCredentials `json:"eap,omitempty"`
+}
+
+// EapCredentials are 802.1X credentials. Certificates and keys are
+// referenced by the name they were uploaded with, see CertStore.
+type EapCredentials struct {
+	Method            string `json:"method"`                        // PEAP, TTLS or TLS
+	Identity          string `json:"identity"`                      // identity="user@example.com"
+	AnonymousIdentity string `json:"anonymous_identity,omitempty"`  // outer identity of PEAP and TTLS
+	Password          string `json:"password,omitempty"`            // PEAP and TTLS
+	Phase2            string `json:"phase2,omitempty"`              // MSCHAPV2, MSCHAP, PAP, CHAP or GTC
+	CaCert            string `json:"ca_cert"`                       // ca.pem, verifies the server
+	DomainSuffixMatch string `json:"domain_suffix_match,omitempty"` // radius.example.com
+	ClientCert        string `json:"client_cert,omitempty"`         // TLS
+	PrivateKey        string `json:"private_key,omitempty"`         // TLS, a PEM key or a .p12 bundle
+	PrivateKeyPasswd  string `json:"private_key_passwd,omitempty"`
 }
 
 // WpaConnection defines a WPA connection.
@@ -37,190 +98,233 @@ type WpaConnection struct {
 	State   string `json:"state"`
 	Ip      string `json:"ip"`
 	Message string `json:"message"`
+	Reason  string `json:"reason,omitempty"`
 }
 
 // NewWpaCfg produces WpaCfg configuration types.
 func NewWpaCfg(setupCfg *SetupCfg) *WpaCfg {
+	setupCfg.DiscoverInterfaces()
+
 	return &WpaCfg{
 		WpaCfg: setupCfg,
+		Ctrl:   NewWpaCtrl(setupCfg.WpaSupplicantCfg.CtrlInterface, setupCfg.Interfaces.Station),
+		Certs:  NewCertStore(setupCfg.WpaSupplicantCfg.CertDir),
 	}
 }
 
-func apdState(iface string) string {
-	rState := regexp.MustCompile("(?m)state=(.*)\n")
-	stateOut, err := exec.Command("hostapd_cli", "-i", iface, "status").Output()
-	if err != nil {
-		return "NONE"
-	}
-	ms := rState.FindSubmatch(stateOut)
-	if len(ms) > 0 {
-		state := string(ms[1])
-		return state
+// waitWpa waits for wpa_supplicant to answer on its control socket.
+func (wpa *WpaCfg) waitWpa(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := wpa.Ctrl.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(250 * time.Millisecond)
 	}
-	return "NONE"
 }
 
-func apdHasClient(iface string) bool {
-	apdClientListOut, err := exec.Command("hostapd_cli", "-i", iface, "all_sta").Output()
-	if err != nil {
-		return false
-	}
-	apdClientListOutArr := strings.Split(string(apdClientListOut), "\n")
-	if len(apdClientListOutArr) > 1 {
-		return true
-	}
-	return false
+// ConnectNetwork connects to a wifi network
+func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) (WpaConnection, error) {
+	return wpa.ConnectNetworkProgress(creds, nil)
 }
 
-func wpaState(iface string) string {
-	// regex for state
-	rState := regexp.MustCompile("(?m)wpa_state=(.*)\n")
-	stateOut, err := exec.Command("wpa_cli", "-i", iface, "status").Output()
-	if err != nil {
-		return "NONE"
+// ConnectNetworkProgress connects to a wifi network, calling progress
+// with the stage and wpa_state whenever the attempt moves to a new stage.
+func (wpa *WpaCfg) ConnectNetworkProgress(creds WpaCredentials, progress func(ConnectStage, string)) (WpaConnection, error) {
+	if progress == nil {
+		progress = func(ConnectStage, string) {}
 	}
-	ms := rState.FindSubmatch(stateOut)
-	if len(ms) > 0 {
-		state := string(ms[1])
-		// see https://developer.android.com/reference/android/net/wifi/SupplicantState.html
-		return state
+	connection := WpaConnection{Ssid: creds.Ssid}
+
+	fail := func(reason string, err error) (WpaConnection, error) {
+		log.Error(err.Error())
+		connection.State = "FAIL"
+		connection.Reason = reason
+		connection.Message = err.Error()
+		return connection, err
 	}
-	return "NONE"
-}
 
-// ConnectNetwork connects to a wifi network
-func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) {
-	connection := WpaConnection{}
+	if err := creds.Validate(); err != nil {
+		return fail(ReasonInvalid, err)
+	}
 
 	log.Info("-=-=- wait for wpa_supplicant to start -=-=-")
-	for {
-		if wpaState("wlan0") != "NONE" {
-			log.Info("-=-=- wpa_supplicant started -=-=-")
-			break
-		}
+	if err := wpa.waitWpa(wpaStartTimeout); err != nil {
+		return fail(ReasonUnavailable, err)
 	}
+	log.Info("-=-=- wpa_supplicant started -=-=-")
 
-	// remove network
-	//Todo: document support for only 1 network
-	wpa.DisconnectNetwork("0")
+	// the saved networks are kept; selecting the new network disables
+	// them until the attempt is over
+	saved, err := wpa.Ctrl.ListNetworks()
+	if err != nil {
+		return fail(ReasonError, err)
+	}
 
 	// 1. Add a network
-	addNetOut, err := exec.Command("wpa_cli", "-i", "wlan0", "add_network").Output()
+	net, err := wpa.Ctrl.AddNetwork()
 	if err != nil {
-		log.Fatal(err.Error())
-		return
+		return fail(ReasonError, err)
 	}
-	net := strings.TrimSpace(string(addNetOut))
-	log.Info("WPA add network got: %s", net)
+	log.Infof("WPA add network got: %s", net)
 
-	// 2. Set the ssid for the new network
-	addSsidOut, err := exec.Command("wpa_cli", "-i", "wlan0", "set_network", net, "ssid", "\""+creds.Ssid+"\"").Output()
-	if err != nil {
-		log.Fatal(err.Error())
-		return
+	// abandon drops the new network and re-enables the saved ones
+	abandon := func() {
+		if err := wpa.Ctrl.RemoveNetwork(net); err != nil {
+			log.Warn(err.Error())
+		}
+		wpa.enableNetworks(saved)
 	}
-	ssidStatus := strings.TrimSpace(string(addSsidOut))
-	log.Info("WPA add ssid got: %s", ssidStatus)
 
-	// 3. Set the psk for the new network
-	addPskOut, err := exec.Command("wpa_cli", "-i", "wlan0", "set_network", net, "psk", "\""+creds.Psk+"\"").Output()
-	if err != nil {
-		log.Fatal(err.Error())
-		return
+	// 2. Set the ssid, psk and priority for the new network
+	if err := wpa.setCredentials(net, creds); err != nil {
+		wpa.Ctrl.RemoveNetwork(net)
+		return fail(ReasonError, err)
 	}
-	pskStatus := strings.TrimSpace(string(addPskOut))
-	log.Info("WPA psk got: %s", pskStatus)
 
-	// 4. Enable the new network
-	enableOut, err := exec.Command("wpa_cli", "-i", "wlan0", "enable_network", net).Output()
-	if err != nil {
-		log.Fatal(err.Error())
-		return
+	// watch for events explaining a failure while the state is polled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := wpa.Ctrl.Events(ctx)
+
+	// 3. Select the new network
+	if err := wpa.Ctrl.SelectNetwork(net); err != nil {
+		abandon()
+		return fail(ReasonError, err)
 	}
-	enableStatus := strings.TrimSpace(string(enableOut))
-	log.Info("WPA enable got: %s", enableStatus)
 
-	// regex for state
-	rState := regexp.MustCompile("(?m)wpa_state=(.*)\n")
+	stage := StageAssociating
+	progress(stage, "")
+
+	poll := time.NewTicker(connectPollInterval)
+	defer poll.Stop()
+	deadline := time.NewTimer(connectTimeout)
+	defer deadline.Stop()
+
+	state := ""
+	notFound := false
+	rejected := false
+	completed := false
+
+	for {
+		select {
+		case ev := <-events:
+			switch ev.Name {
+			case "CTRL-EVENT-SSID-TEMP-DISABLED":
+				if strings.Contains(ev.Message, "reason=WRONG_KEY") {
+					abandon()
+					return fail(ReasonWrongKey, fmt.Errorf("%w: wrong password for %s", ErrConnectFailed, creds.Ssid))
+				}
+			case "CTRL-EVENT-NETWORK-NOT-FOUND":
+				notFound = true
+			case "CTRL-EVENT-ASSOC-REJECT":
+				rejected = true
+			}
+			continue
+		case <-deadline.C:
+			if completed {
+				// associated but no address was assigned in time
+				connection.Message = "connected without an IP address"
+				progress(StageDone, state)
+				return connection, nil
+			}
 
-	// loop for status every second
-	for i := 0; i < 5; i++ {
-		log.Info("WPA Checking wifi state")
+			abandon()
 
-		stateOut, err := exec.Command("wpa_cli", "-i", "wlan0", "status").Output()
+			reason, msg := ReasonTimeout, "timed out connecting to "+creds.Ssid
+			switch {
+			case state == "4WAY_HANDSHAKE" || state == "GROUP_HANDSHAKE":
+				reason, msg = ReasonWrongKey, "handshake with "+creds.Ssid+" failed, check the password"
+			case rejected:
+				reason, msg = ReasonAssocRejected, creds.Ssid+" rejected the association"
+			case notFound || state == "SCANNING" || state == "DISCONNECTED" || state == "INACTIVE":
+				reason, msg = ReasonNotFound, creds.Ssid+" not found or out of range"
+			}
+			return fail(reason, fmt.Errorf("%w: %s", ErrConnectFailed, msg))
+		case <-poll.C:
+		}
+
+		status, err := wpa.Ctrl.Status()
 		if err != nil {
-			log.Fatal("Got error checking state: %s", err.Error())
-			return
+			log.Errorf("Got error checking state: %s", err.Error())
+			return fail(ReasonUnavailable, err)
 		}
-		ms := rState.FindSubmatch(stateOut)
-
-		if len(ms) > 0 {
-			state := string(ms[1])
-			log.Info("WPA Enable state: %s", state)
-			// see https://developer.android.com/reference/android/net/wifi/SupplicantState.html
-			if state == "COMPLETED" {
-				// save the config
-				saveOut, err := exec.Command("wpa_cli", "-i", "wlan0", "save_config").Output()
-				if err != nil {
-					log.Fatal(err.Error())
-					return
-				}
-				saveStatus := strings.TrimSpace(string(saveOut))
-				log.Info("WPA save got: %s", saveStatus)
 
-				connection.Ssid = creds.Ssid
-				connection.State = state
+		state = status["wpa_state"]
+		ip := status["ip_address"]
+		if next := stageForState(state, ip); next != stage {
+			log.Infof("WPA Enable state: %s", state)
+			stage = next
+			progress(stage, state)
+		}
+
+		// see https://developer.android.com/reference/android/net/wifi/SupplicantState.html
+		if state == "COMPLETED" && !completed {
+			completed = true
+			connection.State = state
+
+			// the new credentials replace any saved for the same ssid
+			for _, n := range saved {
+				if n.Ssid == creds.Ssid {
+					log.Infof("WPA replace net: %s", n.Id)
+					wpa.Ctrl.RemoveNetwork(n.Id)
+				}
+			}
+			wpa.enableNetworks(saved)
 
-				return
+			// save the config
+			if err := wpa.Ctrl.SaveConfig(); err != nil {
+				return fail(ReasonError, err)
 			}
+
+			// give DHCP its own time budget
+			deadline.Reset(dhcpTimeout)
 		}
 
-		time.Sleep(3 * time.Second)
+		if completed && ip != "" {
+			connection.Ip = ip
+			return connection, nil
+		}
 	}
+}
 
-	// remove network
-	if err := wpa.DisconnectNetwork(net); err != nil {
-		return
+// enableNetworks re-enables the networks that were not disabled.
+// Networks removed since are skipped by wpa_supplicant with a FAIL.
+func (wpa *WpaCfg) enableNetworks(networks []WpaSavedNetwork) {
+	for _, n := range networks {
+		if !n.Disabled {
+			wpa.Ctrl.EnableNetwork(n.Id)
+		}
 	}
-
-	connection.State = "FAIL"
-	connection.Message = "Unable to connection to " + creds.Ssid
-	return
 }
 
+// DisconnectNetwork removes a saved network, or every network for id
+// "all", and saves the configuration.
 func (wpa *WpaCfg) DisconnectNetwork(id string) error {
-	// remove network
-	//Todo: document support for only 1 network
-	log.Info("WPA remove net: %s", "0")
-	removeNetOut, err := exec.Command("wpa_cli", "-i", "wlan0", "remove_network", "0").Output()
-	if err != nil {
+	log.Infof("WPA remove net: %s", id)
+	if err := wpa.Ctrl.RemoveNetwork(id); err != nil {
 		log.Warn(err.Error())
 		return err
 	}
-	removeNetStatus := strings.TrimSpace(string(removeNetOut))
-	log.Info("WPA remove network got: %s", removeNetStatus)
 
-	saveOut, err := exec.Command("wpa_cli", "-i", "wlan0", "save_config").Output()
-	if err != nil {
-		log.Fatal(err.Error())
+	if err := wpa.Ctrl.SaveConfig(); err != nil {
+		log.Error(err.Error())
 		return err
 	}
-	saveStatus := strings.TrimSpace(string(saveOut))
-	log.Info("WPA save got: %s", saveStatus)
 	return nil
 }
 
 // Status returns the WPA wireless status.
 func (wpa *WpaCfg) Status() (map[string]string, error) {
-	cfgMap := make(map[string]string, 0)
-
-	stateOut, err := exec.Command("wpa_cli", "-i", "wlan0", "status").Output()
+	cfgMap, err := wpa.Ctrl.Status()
 	if err != nil {
-		log.Warn("Got error checking state: %s", err.Error())
-		cfgMap["wpa_state"] = "NONE"
+		log.Warnf("Got error checking state: %s", err.Error())
+		cfgMap = map[string]string{"wpa_state": "NONE"}
 		return cfgMap, err
-	} else {
-		cfgMap = cfgMapper(stateOut)
 	}
 
 	return cfgMap, nil
@@ -233,7 +337,7 @@ func cfgMapper(data []byte) map[string]string {
 	lines := bytes.Split(data, []byte("\n"))
 
 	for _, line := range lines {
-		kv := bytes.Split(line, []byte("="))
+		kv := bytes.SplitN(line, []byte("="), 2)
 		if len(kv) > 1 {
 			cfgMap[string(kv[0])] = string(kv[1])
 		}
@@ -242,65 +346,67 @@ func cfgMapper(data []byte) map[string]string {
 	return cfgMap
 }
 
-// ScanNetworks returns a map of WpaNetwork data structures.
-func (wpa *WpaCfg) ScanNetworks() (map[string]WpaNetwork, error) {
-	wpaNetworks := make(map[string]WpaNetwork, 0)
-	bssid := ""
-	ssid := ""
-	freq := ""
-	flags := ""
-	signalLevel := ""
-	networkListOut, err := exec.Command("iwlist", "wlan0", "scan").Output()
+// ScanNetworks scans through the running wpa_supplicant and returns
+// every BSS found. In access point mode, where wpa_supplicant is not
+// running, a scan-only instance is started for the duration of the scan.
+func (wpa *WpaCfg) ScanNetworks() ([]WpaNetwork, error) {
+	wpa.scanMu.Lock()
+	defer wpa.scanMu.Unlock()
+
+	if wpa.Ctrl.Running() {
+		networks, err := wpa.Ctrl.Scan(scanTimeout)
+		if err != nil {
+			log.Warn(err.Error())
+		}
+		return networks, err
+	}
+
+	networks, err := wpa.scanStandalone()
 	if err != nil {
 		log.Warn(err.Error())
-		return wpaNetworks, err
 	}
+	return networks, err
+}
 
-	networkListOutArr := strings.Split(string(networkListOut), "\n")
-	fieldsFound := 0
-	for _, netListOutLine := range networkListOutArr[1:] {
-		//           Cell 01 - Address: xx:yy:zz:aa:bb:cc
-		if strings.Contains(netListOutLine, "Address") {
-			bssid = strings.Fields(netListOutLine)[4]
-			fieldsFound = 1
-		}
-		//                    Frequency:5.785 GHz
-		if strings.Contains(netListOutLine, "Frequency") {
-			freq = strings.Split(strings.Split(netListOutLine, ":")[1], " ")[0]
-			fieldsFound++
-		}
-		//                    Quality=69/70  Signal level=-41 dBm
-		if strings.Contains(netListOutLine, "Signal level") {
-			signalLevel = strings.Split(netListOutLine, "=")[2]
-			fieldsFound++
-		}
-		//                    ESSID:"networkname"
-		//This will break in the ?unlikely? event that the ESSID
-		//  has a " in it.
-		if strings.Contains(netListOutLine, "ESSID") {
-			ssid = strings.Split(netListOutLine, "\"")[1]
-			fieldsFound++
-		}
-		//                    IE: IEEE 802.11i/WPA2 Version 1
-		if strings.Contains(netListOutLine, "IEEE") {
-			flags = strings.Split(netListOutLine, "IEEE ")[1]
-			fieldsFound++
-		}
+// scanStandalone starts wpa_supplicant without a configuration and with
+// a private control socket, scans and stops it again.
+//
+// This runs next to hostapd on the same phy. The instance only manages
+// the station interface, never the AP interface hostapd owns, and having
+// no networks it never associates, so it can't move the radio off the
+// access point's channel. The scan itself leaves the channel briefly, as
+// iwlist scans did.
+func (wpa *WpaCfg) scanStandalone() ([]WpaNetwork, error) {
+	station := wpa.WpaCfg.Interfaces.Station
+
+	ctrlDir, err := ioutil.TempDir("", "txwifi_scan")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(ctrlDir)
 
-		if fieldsFound == 5 && ssid != "" {
-			wpaNetworks[ssid] = WpaNetwork{
-				Bssid:       bssid,
-				Frequency:   freq,
-				SignalLevel: signalLevel,
-				Flags:       flags,
-				Ssid:        ssid,
-			}
-			bssid = ""
-			ssid = ""
-			freq = ""
-			flags = ""
-			signalLevel = ""
+	log.Infof("Starting scan-only wpa_supplicant on %s", station)
+	p, err := wpa.WpaCfg.executor().Start("wpa_supplicant", "-Dnl80211", "-i"+station, "-C"+ctrlDir)
+	if err != nil {
+		return nil, err
+	}
+	go io.Copy(ioutil.Discard, p.Stdout())
+	go io.Copy(ioutil.Discard, p.Stderr())
+	defer func() {
+		p.Signal(syscall.SIGTERM)
+		p.Wait()
+	}()
+
+	ctrl := NewWpaCtrl(ctrlDir, station)
+	defer ctrl.Close()
+
+	deadline := time.Now().Add(scanStartTimeout)
+	for !ctrl.Running() {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("scan-only wpa_supplicant on %s: %w", station, ErrCtrlTimeout)
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	return wpaNetworks, nil
+
+	return ctrl.Scan(scanTimeout)
 }
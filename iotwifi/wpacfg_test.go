@@ -0,0 +1,188 @@
+package iotwifi
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fastConnect shortens the connect timers for the duration of a test.
+func fastConnect(t *testing.T) {
+	timeout, dhcp, poll := connectTimeout, dhcpTimeout, connectPollInterval
+	connectTimeout, dhcpTimeout, connectPollInterval = 500*time.Millisecond, 300*time.Millisecond, 20*time.Millisecond
+	t.Cleanup(func() {
+		connectTimeout, dhcpTimeout, connectPollInterval = timeout, dhcp, poll
+	})
+}
+
+// connectReplies are the replies of a wpa_supplicant accepting a network.
+func connectReplies(status string) map[string]string {
+	return map[string]string{
+		"REMOVE_NETWORK": "OK\n",
+		"SAVE_CONFIG":    "OK\n",
+		"ADD_NETWORK":    "0\n",
+		"SET_NETWORK":    "OK\n",
+		"ENABLE_NETWORK": "OK\n",
+		"SELECT_NETWORK": "OK\n",
+		"LIST_NETWORKS":  "network id / ssid / bssid / flags\n",
+		"STATUS":         status,
+	}
+}
+
+func TestCfgMapper(t *testing.T) {
+	m := cfgMapper([]byte("wpa_state=COMPLETED\nssid=a=b\n\nnoise\n"))
+
+	if m["wpa_state"] != "COMPLETED" {
+		t.Errorf("wpa_state = %q", m["wpa_state"])
+	}
+	if m["ssid"] != "a=b" {
+		t.Errorf("ssid = %q", m["ssid"])
+	}
+	if len(m) != 2 {
+		t.Errorf("unexpected keys %v", m)
+	}
+}
+
+func TestConnectNetwork(t *testing.T) {
+	fastConnect(t)
+	r := newFakeRadio(t)
+	d := startFakeDaemon(t, filepath.Join(r.cfg.WpaSupplicantCfg.CtrlInterface, "wlan0"),
+		connectReplies("wpa_state=COMPLETED\nssid=home\nip_address=192.168.1.20\n"))
+
+	var stages []ConnectStage
+	wpa := NewWpaCfg(r.cfg)
+	conn, err := wpa.ConnectNetworkProgress(WpaCredentials{Ssid: "home", Psk: "secret123"}, func(stage ConnectStage, wpaState string) {
+		stages = append(stages, stage)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stages) != 2 || stages[0] != StageAssociating || stages[1] != StageDone {
+		t.Errorf("stages %v", stages)
+	}
+	if conn.State != "COMPLETED" || conn.Ip != "192.168.1.20" || conn.Ssid != "home" {
+		t.Errorf("unexpected connection %+v", conn)
+	}
+
+	assertOrder(t, d.Requests(),
+		"ADD_NETWORK",
+		`SET_NETWORK 0 ssid "home"`,
+		`SET_NETWORK 0 psk "secret123"`,
+		"SELECT_NETWORK 0",
+		"STATUS",
+		"SAVE_CONFIG",
+	)
+}
+
+func TestConnectNetworkKeepsSaved(t *testing.T) {
+	fastConnect(t)
+	r := newFakeRadio(t)
+	replies := connectReplies("wpa_state=COMPLETED\nssid=home\nip_address=192.168.1.20\n")
+	replies["ADD_NETWORK"] = "3\n"
+	replies["LIST_NETWORKS"] = "network id / ssid / bssid / flags\n" +
+		"0\twarehouse\tany\t\n" +
+		"1\thome\tany\t\n" +
+		"2\tshop\tany\t[DISABLED]\n"
+	d := startFakeDaemon(t, filepath.Join(r.cfg.WpaSupplicantCfg.CtrlInterface, "wlan0"), replies)
+
+	wpa := NewWpaCfg(r.cfg)
+	if _, err := wpa.ConnectNetwork(WpaCredentials{Ssid: "home", Psk: "newpass123", Priority: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := d.Requests()
+	assertOrder(t, requests,
+		"ADD_NETWORK",
+		"SET_NETWORK 3 priority 2",
+		"SELECT_NETWORK 3",
+		"REMOVE_NETWORK 1",
+		"ENABLE_NETWORK 0",
+		"SAVE_CONFIG",
+	)
+	for _, req := range requests {
+		if req == "REMOVE_NETWORK 0" || req == "REMOVE_NETWORK 3" || req == "ENABLE_NETWORK 2" {
+			t.Errorf("unexpected request %q", req)
+		}
+	}
+}
+
+func TestConnectNetworkFails(t *testing.T) {
+	r := newFakeRadio(t)
+	startFakeDaemon(t, filepath.Join(r.cfg.WpaSupplicantCfg.CtrlInterface, "wlan0"), map[string]string{
+		"REMOVE_NETWORK": "OK\n",
+		"SAVE_CONFIG":    "OK\n",
+		"ADD_NETWORK":    "0\n",
+		"SET_NETWORK":    "FAIL\n",
+		"LIST_NETWORKS":  "network id / ssid / bssid / flags\n",
+	})
+
+	wpa := NewWpaCfg(r.cfg)
+	conn, err := wpa.ConnectNetwork(WpaCredentials{Ssid: "home", Psk: "short"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if conn.State != "FAIL" {
+		t.Errorf("state = %q, want FAIL", conn.State)
+	}
+}
+
+func TestConnectNetworkWrongKey(t *testing.T) {
+	fastConnect(t)
+	r := newFakeRadio(t)
+	d := startFakeDaemon(t, filepath.Join(r.cfg.WpaSupplicantCfg.CtrlInterface, "wlan0"),
+		connectReplies("wpa_state=4WAY_HANDSHAKE\n"))
+
+	go func() {
+		d.waitAttached(t)
+		d.Emit(`<3>CTRL-EVENT-SSID-TEMP-DISABLED id=0 ssid="home" auth_failures=1 duration=10 reason=WRONG_KEY`)
+	}()
+
+	wpa := NewWpaCfg(r.cfg)
+	conn, err := wpa.ConnectNetwork(WpaCredentials{Ssid: "home", Psk: "wrongpass"})
+	if !errors.Is(err, ErrConnectFailed) {
+		t.Fatalf("err = %v", err)
+	}
+	if conn.Reason != ReasonWrongKey {
+		t.Errorf("reason = %q, want %q", conn.Reason, ReasonWrongKey)
+	}
+}
+
+func TestConnectNetworkNotFound(t *testing.T) {
+	fastConnect(t)
+	r := newFakeRadio(t)
+	d := startFakeDaemon(t, filepath.Join(r.cfg.WpaSupplicantCfg.CtrlInterface, "wlan0"),
+		connectReplies("wpa_state=SCANNING\n"))
+
+	wpa := NewWpaCfg(r.cfg)
+	conn, err := wpa.ConnectNetwork(WpaCredentials{Ssid: "faraway", Psk: "secret123"})
+	if !errors.Is(err, ErrConnectFailed) {
+		t.Fatalf("err = %v", err)
+	}
+	if conn.Reason != ReasonNotFound {
+		t.Errorf("reason = %q, want %q", conn.Reason, ReasonNotFound)
+	}
+	assertOrder(t, d.Requests(), "SELECT_NETWORK 0", "REMOVE_NETWORK 0")
+}
+
+func TestConnectNetworkNoAddress(t *testing.T) {
+	fastConnect(t)
+	r := newFakeRadio(t)
+	startFakeDaemon(t, filepath.Join(r.cfg.WpaSupplicantCfg.CtrlInterface, "wlan0"),
+		connectReplies("wpa_state=COMPLETED\nssid=home\n"))
+
+	var stages []ConnectStage
+	wpa := NewWpaCfg(r.cfg)
+	conn, err := wpa.ConnectNetworkProgress(WpaCredentials{Ssid: "home", Psk: "secret123"}, func(stage ConnectStage, wpaState string) {
+		stages = append(stages, stage)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.State != "COMPLETED" || conn.Ip != "" {
+		t.Errorf("unexpected connection %+v", conn)
+	}
+	if stages[len(stages)-1] != StageDone || stages[len(stages)-2] != StageDhcp {
+		t.Errorf("stages %v", stages)
+	}
+}
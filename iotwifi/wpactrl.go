@@ -0,0 +1,139 @@
+package iotwifi
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// DefaultWpaCtrlDir is where wpa_supplicant creates its control sockets
+// unless ctrl_interface says otherwise.
+const DefaultWpaCtrlDir = "/var/run/wpa_supplicant"
+
+// WpaCtrl is a client for the wpa_supplicant control interface of a
+// single network interface.
+type WpaCtrl struct {
+	*ctrlClient
+	Iface string
+}
+
+// NewWpaCtrl produces a WpaCtrl for the socket of iface in ctrlDir.
+func NewWpaCtrl(ctrlDir string, iface string) *WpaCtrl {
+	if ctrlDir == "" {
+		ctrlDir = DefaultWpaCtrlDir
+	}
+	return &WpaCtrl{
+		ctrlClient: newCtrlClient(filepath.Join(ctrlDir, iface)),
+		Iface:      iface,
+	}
+}
+
+// Status returns the key/value pairs of the STATUS command.
+func (w *WpaCtrl) Status() (map[string]string, error) {
+	reply, err := w.Request("STATUS")
+	if err != nil {
+		return nil, err
+	}
+	return cfgMapper([]byte(reply)), nil
+}
+
+// State returns the current wpa_state, e.g. COMPLETED or SCANNING.
+func (w *WpaCtrl) State() (string, error) {
+	status, err := w.Status()
+	if err != nil {
+		return "", err
+	}
+	return status["wpa_state"], nil
+}
+
+// AddNetwork adds an empty, disabled network and returns its id.
+func (w *WpaCtrl) AddNetwork() (string, error) {
+	reply, err := w.Request("ADD_NETWORK")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(reply), nil
+}
+
+// SetNetwork sets a network variable. Quoting of string values is left
+// to the caller, as wpa_supplicant expects e.g. ssid "\"name\"".
+func (w *WpaCtrl) SetNetwork(id string, key string, value string) error {
+	return w.requestOK("SET_NETWORK " + id + " " + key + " " + value)
+}
+
+// EnableNetwork enables a network.
+func (w *WpaCtrl) EnableNetwork(id string) error {
+	return w.requestOK("ENABLE_NETWORK " + id)
+}
+
+// SelectNetwork enables a network and disables all others.
+func (w *WpaCtrl) SelectNetwork(id string) error {
+	return w.requestOK("SELECT_NETWORK " + id)
+}
+
+// DisableNetwork disables a network.
+func (w *WpaCtrl) DisableNetwork(id string) error {
+	return w.requestOK("DISABLE_NETWORK " + id)
+}
+
+// GetNetwork returns a network variable. Passwords are never returned
+// by wpa_supplicant.
+func (w *WpaCtrl) GetNetwork(id string, key string) (string, error) {
+	reply, err := w.Request("GET_NETWORK " + id + " " + key)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(reply), nil
+}
+
+// ListNetworks returns the configured networks.
+func (w *WpaCtrl) ListNetworks() ([]WpaSavedNetwork, error) {
+	reply, err := w.Request("LIST_NETWORKS")
+	if err != nil {
+		return nil, err
+	}
+	return parseListNetworks(reply), nil
+}
+
+// parseListNetworks parses the tab separated LIST_NETWORKS reply:
+//
+//	network id / ssid / bssid / flags
+//	0	home	any	[CURRENT]
+func parseListNetworks(reply string) []WpaSavedNetwork {
+	networks := make([]WpaSavedNetwork, 0)
+
+	lines := strings.Split(reply, "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		n := WpaSavedNetwork{
+			Id:    fields[0],
+			Ssid:  fields[1],
+			Bssid: fields[2],
+		}
+		if len(fields) > 3 {
+			n.Flags = fields[3]
+			n.Current = strings.Contains(n.Flags, "[CURRENT]")
+			n.Disabled = strings.Contains(n.Flags, "[DISABLED]")
+		}
+		networks = append(networks, n)
+	}
+
+	return networks
+}
+
+// RemoveNetwork removes a network, or every network for id "all".
+func (w *WpaCtrl) RemoveNetwork(id string) error {
+	return w.requestOK("REMOVE_NETWORK " + id)
+}
+
+// SaveConfig writes the current networks to the configuration file.
+func (w *WpaCtrl) SaveConfig() error {
+	return w.requestOK("SAVE_CONFIG")
+}
+
+// Reconfigure makes wpa_supplicant reload its configuration file.
+func (w *WpaCtrl) Reconfigure() error {
+	return w.requestOK("RECONFIGURE")
+}